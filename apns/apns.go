@@ -0,0 +1,329 @@
+// Package apns sends notifications straight to the Apple Push Notification
+// service over HTTP/2, with token (.p8) or certificate authentication.
+package apns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sinangedik/zeropush"
+	"github.com/sinangedik/zeropush/internal/jws"
+)
+
+const (
+	HOST_PRODUCTION  = "https://api.push.apple.com"
+	HOST_DEVELOPMENT = "https://api.sandbox.push.apple.com"
+)
+
+// Apple rejects provider tokens older than an hour and throttles ones
+// renewed more often than every 20 minutes.
+const TOKEN_LIFETIME = 50 * time.Minute
+
+// Token signs the provider authentication tokens of a .p8 signing key.
+type Token struct {
+	Key    *ecdsa.PrivateKey
+	KeyID  string
+	TeamID string
+
+	mutex     sync.Mutex
+	bearer    string
+	issued_at time.Time
+}
+
+// LoadToken reads the .p8 key downloaded from the Apple developer account.
+func LoadToken(path string, key_id string, team_id string) (*Token, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := jws.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	key, ok := signer.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ECDSA key", path)
+	}
+	return &Token{Key: key, KeyID: key_id, TeamID: team_id}, nil
+}
+
+// Bearer returns the current token, signing a new one when it is due.
+func (t *Token) Bearer() (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.bearer != "" && time.Since(t.issued_at) < TOKEN_LIFETIME {
+		return t.bearer, nil
+	}
+	now := time.Now()
+	bearer, err := jws.Sign(map[string]interface{}{"kid": t.KeyID}, map[string]interface{}{"iss": t.TeamID, "iat": now.Unix()}, t.Key)
+	if err != nil {
+		return "", err
+	}
+	t.bearer, t.issued_at = bearer, now
+	return bearer, nil
+}
+
+// Error is the failure of one device that is not about the device token
+// itself, e.g. a bad provider token or throttling.
+type Error struct {
+	DeviceToken string
+	Status      int
+	Reason      string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("apns: %s: %d %s", e.DeviceToken, e.Status, e.Reason)
+}
+
+// Provider implements zeropush.Provider against APNs. Device tokens Apple
+// reports as Unregistered or ExpiredToken come back as InactiveTokens, bad
+// tokens and tokens of another app as UnregisteredTokens.
+type Provider struct {
+	Host string
+	//the bundle ID of the app
+	Topic string
+	//nil when the HTTP client authenticates with a certificate
+	Token       *Token
+	HTTPClient  *http.Client
+	Concurrency int
+}
+
+var _ zeropush.Provider = (*Provider)(nil)
+
+func NewTokenProvider(token *Token, topic string) *Provider {
+	return &Provider{
+		Host:        HOST_PRODUCTION,
+		Topic:       topic,
+		Token:       token,
+		HTTPClient:  &http.Client{Transport: &http.Transport{ForceAttemptHTTP2: true}, Timeout: 30 * time.Second},
+		Concurrency: 16,
+	}
+}
+
+// NewCertificateProvider authenticates with a push certificate, e.g. from
+// tls.LoadX509KeyPair.
+func NewCertificateProvider(certificate tls.Certificate, topic string) *Provider {
+	transport := &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{Certificates: []tls.Certificate{certificate}},
+	}
+	return &Provider{
+		Host:        HOST_PRODUCTION,
+		Topic:       topic,
+		HTTPClient:  &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		Concurrency: 16,
+	}
+}
+
+func (p *Provider) Notify(alert string, badge string, sound string, info string, expiry string, content_available string, category string, device_tokens ...string) (*zeropush.NotifyResponse, error) {
+	return p.Send(&zeropush.Notification{
+		Alert:            alert,
+		Badge:            badge,
+		Sound:            sound,
+		Info:             info,
+		Expiry:           expiry,
+		ContentAvailable: content_available,
+		Category:         category,
+		DeviceTokens:     device_tokens,
+	})
+}
+
+// Broadcast is not supported, APNs has no channels.
+func (p *Provider) Broadcast(channel string, alert string, badge string, sound string, info string, expiry string, content_available string, category string) (*zeropush.BroadcastResponse, error) {
+	return nil, zeropush.ErrBroadcastNotSupported
+}
+
+type device_result struct {
+	device_token string
+	status       int
+	reason       string
+	apns_id      string
+	err          error
+}
+
+// Send pushes n to each of its device tokens. The response body has one
+// entry per device with its status and reason; the error is the first
+// failure that was not about a device token.
+func (p *Provider) Send(n *zeropush.Notification) (*zeropush.NotifyResponse, error) {
+	if n.Channel != "" {
+		return nil, zeropush.ErrBroadcastNotSupported
+	}
+	if len(n.DeviceTokens) == 0 {
+		return nil, errors.New("device tokens cannot be empty")
+	}
+	body, err := payload(n)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := p.headers(n)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]device_result, len(n.DeviceTokens))
+	concurrency := p.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, token := range n.DeviceTokens {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, token string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = p.push(token, headers, body)
+		}(i, token)
+	}
+	wg.Wait()
+
+	response := &zeropush.NotifyResponse{ZeroResponse: &zeropush.ZeroResponse{}}
+	var first_err error
+	for _, result := range results {
+		entry := map[string]interface{}{"device_token": result.device_token, "status": result.status}
+		if result.reason != "" {
+			entry["reason"] = result.reason
+		}
+		if result.apns_id != "" {
+			entry["apns_id"] = result.apns_id
+		}
+		response.Body = append(response.Body, entry)
+		switch {
+		case result.err != nil:
+			if first_err == nil {
+				first_err = result.err
+			}
+		case result.status == http.StatusOK:
+			response.SentCount++
+		case result.reason == "Unregistered" || result.reason == "ExpiredToken":
+			response.InactiveTokens = append(response.InactiveTokens, result.device_token)
+		case result.reason == "BadDeviceToken" || result.reason == "DeviceTokenNotForTopic":
+			response.UnregisteredTokens = append(response.UnregisteredTokens, result.device_token)
+		default:
+			if first_err == nil {
+				first_err = &Error{DeviceToken: result.device_token, Status: result.status, Reason: result.reason}
+			}
+		}
+	}
+	if first_err != nil {
+		log.Printf("Error sending to APNs: %s", first_err)
+		response.Error = map[string]string{"error": first_err.Error()}
+	}
+	return response, first_err
+}
+
+func (p *Provider) headers(n *zeropush.Notification) (http.Header, error) {
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/json")
+	if p.Topic != "" {
+		headers.Set("apns-topic", p.Topic)
+	}
+	if n.Alert == "" && n.Sound == "" && n.Badge == "" && content_available(n) {
+		headers.Set("apns-push-type", "background")
+		headers.Set("apns-priority", "5")
+	} else {
+		headers.Set("apns-push-type", "alert")
+		headers.Set("apns-priority", "10")
+	}
+	if n.Expiry != "" {
+		seconds, err := strconv.Atoi(n.Expiry)
+		if err != nil {
+			return nil, fmt.Errorf("expiry %q must be a number of seconds", n.Expiry)
+		}
+		headers.Set("apns-expiration", strconv.FormatInt(time.Now().Add(time.Duration(seconds)*time.Second).Unix(), 10))
+	}
+	if p.Token != nil {
+		bearer, err := p.Token.Bearer()
+		if err != nil {
+			return nil, err
+		}
+		headers.Set("Authorization", "bearer "+bearer)
+	}
+	return headers, nil
+}
+
+func (p *Provider) push(device_token string, headers http.Header, body []byte) device_result {
+	result := device_result{device_token: device_token}
+	req, err := http.NewRequest("POST", p.Host+"/3/device/"+device_token, bytes.NewReader(body))
+	if err != nil {
+		result.err = err
+		return result
+	}
+	req.Header = headers.Clone()
+	res, err := p.HTTPClient.Do(req)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer res.Body.Close()
+	result.status = res.StatusCode
+	result.apns_id = res.Header.Get("apns-id")
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Reason string `json:"reason"`
+		}
+		data, _ := io.ReadAll(res.Body)
+		if json.Unmarshal(data, &e) == nil {
+			result.reason = e.Reason
+		}
+	}
+	return result
+}
+
+func content_available(n *zeropush.Notification) bool {
+	return n.ContentAvailable != "" && n.ContentAvailable != "0" && n.ContentAvailable != "false"
+}
+
+// payload builds the APNs JSON body. Info is merged in at the top level
+// when it is a JSON object, as ZeroPush does, else sent as "info".
+func payload(n *zeropush.Notification) ([]byte, error) {
+	aps := map[string]interface{}{}
+	if n.Alert != "" {
+		aps["alert"] = n.Alert
+	}
+	if n.Badge != "" {
+		if strings.HasPrefix(n.Badge, "+") || strings.HasPrefix(n.Badge, "-") {
+			return nil, fmt.Errorf("badge %q: APNs only takes absolute badges, see zeropush.BadgeManager", n.Badge)
+		}
+		badge, err := strconv.Atoi(n.Badge)
+		if err != nil {
+			return nil, fmt.Errorf("badge %q must be a number", n.Badge)
+		}
+		aps["badge"] = badge
+	}
+	if n.Sound != "" {
+		aps["sound"] = n.Sound
+	}
+	if n.Category != "" {
+		aps["category"] = n.Category
+	}
+	if content_available(n) {
+		aps["content-available"] = 1
+	}
+	body := map[string]interface{}{}
+	if n.Info != "" {
+		var info map[string]interface{}
+		if json.Unmarshal([]byte(n.Info), &info) == nil {
+			for key, value := range info {
+				body[key] = value
+			}
+		} else {
+			body["info"] = n.Info
+		}
+	}
+	body["aps"] = aps
+	return json.Marshal(body)
+}
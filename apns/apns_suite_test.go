@@ -0,0 +1,13 @@
+package apns_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestAPNs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "APNs Suite")
+}
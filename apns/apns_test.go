@@ -0,0 +1,144 @@
+package apns_test
+
+import (
+	. "github.com/sinangedik/zeropush/apns"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+func write_p8(dir string, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).Should(BeNil())
+	path := filepath.Join(dir, "AuthKey_ABC123.p8")
+	Expect(os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)).To(Succeed())
+	return path
+}
+
+func client_certificate() tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Apple Push Services: com.example.app"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).Should(BeNil())
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+var _ = Describe("Provider", func() {
+	var (
+		key      *ecdsa.PrivateKey
+		server   *testutil.APNsTestServer
+		provider *Provider
+		dir      string
+	)
+
+	BeforeEach(func() {
+		key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		dir, _ = os.MkdirTemp("", "zeropush")
+	})
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("With token authentication", func() {
+		BeforeEach(func() {
+			server = testutil.NewAPNsTestServer(&key.PublicKey)
+			token, err := LoadToken(write_p8(dir, key), "ABC123", "TEAM123")
+			Expect(err).Should(BeNil())
+			provider = NewTokenProvider(token, "com.example.app")
+			provider.Host = server.URL
+			provider.HTTPClient = server.Client()
+		})
+
+		It("should send the payload over HTTP/2", func() {
+			response, err := provider.Notify("hello", "3", "default", `{"thread":"42"}`, "3600", "", "MESSAGE", "a", "b")
+			Expect(err).Should(BeNil())
+			Expect(response.SentCount).To(Equal(2))
+			requests := server.Requests()
+			Expect(requests).To(HaveLen(2))
+
+			request := requests[0]
+			Expect(request.Header.Get("apns-topic")).To(Equal("com.example.app"))
+			Expect(request.Header.Get("apns-push-type")).To(Equal("alert"))
+			Expect(request.Header.Get("apns-expiration")).ShouldNot(BeEmpty())
+			Expect(request.Payload["thread"]).To(Equal("42"))
+			aps := request.Payload["aps"].(map[string]interface{})
+			Expect(aps["alert"]).To(Equal("hello"))
+			Expect(aps["badge"]).To(Equal(float64(3)))
+			Expect(aps["category"]).To(Equal("MESSAGE"))
+		})
+		It("should reuse the provider token", func() {
+			provider.Notify("hello", "", "", "", "", "", "", "a")
+			provider.Notify("hello", "", "", "", "", "", "", "a")
+			requests := server.Requests()
+			Expect(requests[0].Header.Get("Authorization")).To(Equal(requests[1].Header.Get("Authorization")))
+		})
+		It("should send background notifications with a low priority", func() {
+			provider.Notify("", "", "", "", "", "1", "", "a")
+			request := server.Requests()[0]
+			Expect(request.Header.Get("apns-push-type")).To(Equal("background"))
+			Expect(request.Header.Get("apns-priority")).To(Equal("5"))
+		})
+		It("should map device reasons to inactive and unregistered tokens", func() {
+			response, err := provider.Notify("hello", "", "", "", "", "", "", "a", testutil.APNS_UNREGISTERED_TOKEN, testutil.APNS_BAD_TOKEN)
+			Expect(err).Should(BeNil())
+			Expect(response.SentCount).To(Equal(1))
+			Expect(response.InactiveTokens).To(Equal([]string{testutil.APNS_UNREGISTERED_TOKEN}))
+			Expect(response.UnregisteredTokens).To(Equal([]string{testutil.APNS_BAD_TOKEN}))
+			Expect(response.Body[1]["reason"]).To(Equal("Unregistered"))
+		})
+		It("should fail with a key Apple does not know", func() {
+			other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			provider.Token = &Token{Key: other, KeyID: "ABC123", TeamID: "TEAM123"}
+			_, err := provider.Notify("hello", "", "", "", "", "", "", "a")
+			Expect(err).To(BeAssignableToTypeOf(&Error{}))
+			Expect(err.(*Error).Reason).To(Equal("InvalidProviderToken"))
+		})
+		It("should refuse relative badges and broadcasts", func() {
+			_, err := provider.Notify("hello", "+1", "", "", "", "", "", "a")
+			Expect(err).ShouldNot(BeNil())
+			_, err = provider.Broadcast("news", "hello", "", "", "", "", "", "")
+			Expect(err).To(Equal(zeropush.ErrBroadcastNotSupported))
+			Expect(server.Requests()).To(BeEmpty())
+		})
+	})
+
+	Context("With certificate authentication", func() {
+		BeforeEach(func() {
+			server = testutil.NewAPNsTestServer(nil)
+			provider = NewCertificateProvider(client_certificate(), "com.example.app")
+			provider.Host = server.URL
+			roots := x509.NewCertPool()
+			roots.AddCert(server.Certificate())
+			provider.HTTPClient.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+		})
+
+		It("should send with the client certificate", func() {
+			response, err := provider.Send(&zeropush.Notification{Alert: "hello", DeviceTokens: []string{"a"}})
+			Expect(err).Should(BeNil())
+			Expect(response.SentCount).To(Equal(1))
+			Expect(server.Requests()[0].Header.Get("Authorization")).To(BeEmpty())
+		})
+	})
+})
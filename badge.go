@@ -0,0 +1,238 @@
+package zeropush
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BadgeStore keeps the badge of each device token.
+type BadgeStore interface {
+	//ok is false for tokens without a badge yet
+	Get(device_token string) (badge int, ok bool, err error)
+	Set(device_token string, badge int) error
+}
+
+type MemoryBadgeStore struct {
+	mutex  sync.Mutex
+	badges map[string]int
+}
+
+func NewMemoryBadgeStore() *MemoryBadgeStore {
+	return &MemoryBadgeStore{badges: make(map[string]int)}
+}
+
+func (s *MemoryBadgeStore) Get(device_token string) (int, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	badge, ok := s.badges[device_token]
+	return badge, ok, nil
+}
+
+func (s *MemoryBadgeStore) Set(device_token string, badge int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.badges[device_token] = badge
+	return nil
+}
+
+// DEFAULT_BADGE_ATTEMPTS is used when MaxAttempts is not set.
+const DEFAULT_BADGE_ATTEMPTS = 5
+
+// BadgeManager keeps the badges of devices in a store and pushes them with
+// SetBadge. Changes made within Delay of each other go out together, one
+// SetBadge per changed token with its latest value. Tokens whose SetBadge
+// failed with a transport error, an open circuit or a 429 or 5xx answer are
+// flushed again after Backoff, up to MaxAttempts calls; other failures, e.g.
+// of unknown tokens, are only reported to OnError.
+type BadgeManager struct {
+	Client *Client
+	Store  BadgeStore
+	Delay  time.Duration
+	//delay before the given retry, defaults to exponential backoff from 1s to 5m
+	Backoff func(attempt int) time.Duration
+	//SetBadge calls of a token before its change is given up, DEFAULT_BADGE_ATTEMPTS when not set
+	MaxAttempts int
+	//called with the tokens whose badge could not be set
+	OnError func(device_token string, err error)
+
+	mutex sync.Mutex
+	dirty map[string]bool
+	timer *time.Timer
+	//failed SetBadge calls in a row of the tokens awaiting a retry
+	attempts map[string]int
+}
+
+func NewBadgeManager(client *Client, store BadgeStore) *BadgeManager {
+	return &BadgeManager{
+		Client:      client,
+		Store:       store,
+		Delay:       time.Second,
+		Backoff:     default_backoff,
+		MaxAttempts: DEFAULT_BADGE_ATTEMPTS,
+		dirty:       make(map[string]bool),
+		attempts:    make(map[string]int),
+	}
+}
+
+func (b *BadgeManager) Badge(device_token string) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	badge, _, err := b.Store.Get(device_token)
+	return badge, err
+}
+
+func (b *BadgeManager) Increment(by int, device_tokens ...string) error {
+	return b.update(device_tokens, func(badge int) int { return badge + by })
+}
+
+// Decrement lowers the badges, never below zero.
+func (b *BadgeManager) Decrement(by int, device_tokens ...string) error {
+	return b.update(device_tokens, func(badge int) int {
+		if badge < by {
+			return 0
+		}
+		return badge - by
+	})
+}
+
+func (b *BadgeManager) Reset(device_tokens ...string) error {
+	return b.update(device_tokens, func(int) int { return 0 })
+}
+
+func (b *BadgeManager) update(device_tokens []string, change func(int) int) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, token := range device_tokens {
+		badge, _, err := b.Store.Get(token)
+		if err != nil {
+			return err
+		}
+		if err = b.Store.Set(token, change(badge)); err != nil {
+			return err
+		}
+		b.dirty[token] = true
+	}
+	if b.timer == nil && len(b.dirty) > 0 {
+		b.timer = time.AfterFunc(b.Delay, func() { b.Flush() })
+	}
+	return nil
+}
+
+// SyncFromServer replaces the stored badges with the ones the API reports.
+// Pending changes of these tokens are dropped.
+func (b *BadgeManager) SyncFromServer(device_tokens ...string) error {
+	for _, token := range device_tokens {
+		device, err := b.Client.GetDevice(token)
+		if err != nil {
+			log.Printf("Error getting the badge of %s: %s", token, err)
+			return err
+		}
+		b.mutex.Lock()
+		err = b.Store.Set(token, device.Badge)
+		delete(b.dirty, token)
+		b.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry_later arms the timer to flush again after a failure, as soon as the
+// token with the fewest failed attempts is due; callers hold the mutex.
+func (b *BadgeManager) retry_later() {
+	if b.timer != nil {
+		return
+	}
+	attempt := 0
+	for token := range b.dirty {
+		if n := b.attempts[token]; n > 0 && (attempt == 0 || n < attempt) {
+			attempt = n
+		}
+	}
+	if attempt == 0 {
+		attempt = 1
+	}
+	backoff := b.Backoff
+	if backoff == nil {
+		backoff = default_backoff
+	}
+	b.timer = time.AfterFunc(backoff(attempt), func() { b.Flush() })
+}
+
+// failed records a failed SetBadge and tells whether the token is retried;
+// callers hold the mutex.
+func (b *BadgeManager) failed(device_token string, err error) bool {
+	if b.attempts == nil {
+		b.attempts = make(map[string]int)
+	}
+	b.attempts[device_token]++
+	max_attempts := b.MaxAttempts
+	if max_attempts <= 0 {
+		max_attempts = DEFAULT_BADGE_ATTEMPTS
+	}
+	if !retryable(err) || b.attempts[device_token] >= max_attempts {
+		delete(b.attempts, device_token)
+		return false
+	}
+	b.dirty[device_token] = true
+	return true
+}
+
+// Flush sends the pending changes right away and returns the first error.
+// Tokens that failed with a retryable error are sent again with the next
+// flush, which runs after Backoff if nothing else triggers it.
+func (b *BadgeManager) Flush() error {
+	b.mutex.Lock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	tokens := make([]string, 0, len(b.dirty))
+	for token := range b.dirty {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	badges := make(map[string]int, len(tokens))
+	for _, token := range tokens {
+		badge, _, err := b.Store.Get(token)
+		if err != nil {
+			b.retry_later()
+			b.mutex.Unlock()
+			return err
+		}
+		badges[token] = badge
+	}
+	b.dirty = make(map[string]bool)
+	b.mutex.Unlock()
+
+	var first_err error
+	retry := false
+	for _, token := range tokens {
+		_, err := b.Client.SetBadge(token, badges[token])
+		b.mutex.Lock()
+		if err == nil {
+			delete(b.attempts, token)
+		} else if b.failed(token, err) {
+			retry = true
+		}
+		b.mutex.Unlock()
+		if err != nil {
+			log.Printf("Error setting the badge of %s: %s", token, err)
+			if first_err == nil {
+				first_err = err
+			}
+			if b.OnError != nil {
+				b.OnError(token, err)
+			}
+		}
+	}
+	if retry {
+		b.mutex.Lock()
+		b.retry_later()
+		b.mutex.Unlock()
+	}
+	return first_err
+}
@@ -0,0 +1,121 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("BadgeManager", func() {
+	var (
+		client *Client
+		server *testutil.RecordingServer
+		badges *BadgeManager
+	)
+	calls := func() []string {
+		var set []string
+		for _, query := range server.Queries("/set_badge") {
+			set = append(set, query.Get("device_token")+"="+query.Get("badge"))
+		}
+		return set
+	}
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+		badges = NewBadgeManager(client, NewMemoryBadgeStore())
+		badges.Delay = time.Hour
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should track increments, decrements and resets", func() {
+		Expect(badges.Increment(3, "phone", "tablet")).To(Succeed())
+		Expect(badges.Decrement(1, "phone")).To(Succeed())
+		Expect(badges.Badge("phone")).To(Equal(2))
+		Expect(badges.Badge("tablet")).To(Equal(3))
+		Expect(badges.Decrement(5, "phone")).To(Succeed())
+		Expect(badges.Badge("phone")).To(Equal(0))
+		Expect(badges.Reset("tablet")).To(Succeed())
+		Expect(badges.Badge("tablet")).To(Equal(0))
+	})
+	It("should send one SetBadge per token with its latest badge", func() {
+		badges.Increment(1, "phone", "tablet")
+		badges.Increment(1, "phone")
+		Expect(calls()).To(BeEmpty())
+		Expect(badges.Flush()).To(Succeed())
+		Expect(calls()).To(Equal([]string{"phone=2", "tablet=1"}))
+		Expect(badges.Flush()).To(Succeed())
+		Expect(calls()).To(HaveLen(2))
+	})
+	It("should send the changes after the delay", func() {
+		badges.Delay = 10 * time.Millisecond
+		badges.Increment(1, "phone")
+		badges.Increment(1, "phone")
+		Eventually(calls).Should(Equal([]string{"phone=2"}))
+	})
+	It("should send failed tokens again with the next flush", func() {
+		server.FailWith(503, "/set_badge")
+		var failed []string
+		badges.OnError = func(device_token string, err error) { failed = append(failed, device_token) }
+		badges.Increment(1, "phone")
+		Expect(badges.Flush()).ShouldNot(Succeed())
+		Expect(failed).To(Equal([]string{"phone"}))
+
+		server.FailWith(0)
+		Expect(badges.Flush()).To(Succeed())
+		Expect(calls()).To(Equal([]string{"phone=1", "phone=1"}))
+	})
+	It("should retry a failed flush after the backoff", func() {
+		badges.Delay = time.Millisecond
+		var attempts []int
+		var mutex sync.Mutex
+		badges.Backoff = func(attempt int) time.Duration {
+			mutex.Lock()
+			defer mutex.Unlock()
+			attempts = append(attempts, attempt)
+			return 10 * time.Millisecond
+		}
+		server.FailNext(1)
+		badges.Increment(1, "phone")
+		Eventually(func() int { return server.Succeeded() }).Should(Equal(1))
+		Expect(calls()).To(Equal([]string{"phone=1", "phone=1"}))
+		mutex.Lock()
+		defer mutex.Unlock()
+		Expect(attempts).To(Equal([]int{1}))
+	})
+	It("should not retry tokens the API refused", func() {
+		server.FailWith(404, "/set_badge")
+		var failed []string
+		badges.OnError = func(device_token string, err error) { failed = append(failed, device_token) }
+		badges.Increment(1, "phone")
+		Expect(badges.Flush()).ShouldNot(Succeed())
+		Expect(failed).To(Equal([]string{"phone"}))
+
+		server.FailWith(0)
+		Expect(badges.Flush()).To(Succeed())
+		Expect(calls()).To(Equal([]string{"phone=1"}))
+	})
+	It("should give up on a token after the maximum number of attempts", func() {
+		badges.MaxAttempts = 2
+		server.FailWith(503, "/set_badge")
+		badges.Increment(1, "phone")
+		Expect(badges.Flush()).ShouldNot(Succeed())
+		Expect(badges.Flush()).ShouldNot(Succeed())
+		Expect(badges.Flush()).To(Succeed())
+		Expect(calls()).To(HaveLen(2))
+	})
+	It("should take the badge from the server when syncing", func() {
+		badges.Increment(5, "phone")
+		Expect(badges.SyncFromServer("phone")).To(Succeed())
+		Expect(badges.Badge("phone")).To(Equal(1))
+		Expect(badges.Flush()).To(Succeed())
+		Expect(calls()).To(BeEmpty())
+	})
+})
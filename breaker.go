@@ -0,0 +1,215 @@
+package zeropush
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	CIRCUIT_CLOSED    = "closed"
+	CIRCUIT_OPEN      = "open"
+	CIRCUIT_HALF_OPEN = "half_open"
+)
+
+// DEFAULT_TRIAL_TIMEOUT is used when TrialTimeout is not set.
+const DEFAULT_TRIAL_TIMEOUT = time.Minute
+
+var ErrCircuitOpen = errors.New("the circuit to the ZeroPush API is open")
+
+// CircuitOpenError is returned without calling the API while the circuit is
+// open. errors.Is(err, ErrCircuitOpen) holds for it.
+type CircuitOpenError struct {
+	//when the circuit lets a trial call through, or while trials are under way,
+	//when they time out
+	RetryAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s, retrying at %s", ErrCircuitOpen, e.RetryAt.Format(time.RFC3339))
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// CircuitBreaker stops calling the API once too many calls fail. It opens
+// when at least MinRequests calls within Window were made and FailureRatio of
+// them failed, then after CoolDown lets HalfOpenRequests trial calls through:
+// it closes if they all succeed and opens again if any fails or they do not
+// all report back within TrialTimeout. Transport errors and 5xx responses
+// count as failures, other API errors do not.
+type CircuitBreaker struct {
+	FailureRatio     float64
+	MinRequests      int
+	Window           time.Duration
+	CoolDown         time.Duration
+	HalfOpenRequests int
+	TrialTimeout     time.Duration
+	//called after every state change, outside the breaker's lock
+	OnStateChange func(from string, to string)
+	//the breaker's clock, defaults to time.Now
+	Now func() time.Time
+
+	mutex          sync.Mutex
+	state          string
+	requests       int
+	failures       int
+	since          time.Time
+	opened_at      time.Time
+	half_opened_at time.Time
+	//bumped on every half-open, so trials that timed out are not counted later
+	round     int
+	trials    int
+	succeeded int
+}
+
+func NewCircuitBreaker(failure_ratio float64, cool_down time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureRatio:     failure_ratio,
+		MinRequests:      10,
+		Window:           time.Minute,
+		CoolDown:         cool_down,
+		HalfOpenRequests: 1,
+		TrialTimeout:     DEFAULT_TRIAL_TIMEOUT,
+		state:            CIRCUIT_CLOSED,
+	}
+}
+
+// State returns CIRCUIT_CLOSED, CIRCUIT_OPEN or CIRCUIT_HALF_OPEN. An open
+// circuit turns half-open on the first call after its cool-down.
+func (b *CircuitBreaker) State() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.current_state()
+}
+
+// Allow asks to make a call. It returns a *CircuitOpenError while the
+// circuit is open, else a function to report the outcome of the call with.
+func (b *CircuitBreaker) Allow() (func(failed bool), error) {
+	b.mutex.Lock()
+	now := b.now()
+	from := b.current_state()
+	var err error
+	switch b.state {
+	case CIRCUIT_CLOSED:
+		if b.Window > 0 && now.Sub(b.since) >= b.Window {
+			b.requests, b.failures, b.since = 0, 0, now
+		}
+	case CIRCUIT_OPEN:
+		if retry_at := b.opened_at.Add(b.CoolDown); now.Before(retry_at) {
+			err = &CircuitOpenError{RetryAt: retry_at}
+		} else {
+			b.state, b.half_opened_at, b.trials, b.succeeded = CIRCUIT_HALF_OPEN, now, 0, 0
+			b.round++
+		}
+	}
+	if err == nil && b.state == CIRCUIT_HALF_OPEN {
+		if b.trials < b.half_open_requests() {
+			b.trials++
+		} else if deadline := b.half_opened_at.Add(b.trial_timeout()); now.Before(deadline) {
+			//wait for the trials under way
+			err = &CircuitOpenError{RetryAt: deadline}
+		} else {
+			//the trials never reported back, e.g. hung calls
+			b.state, b.opened_at = CIRCUIT_OPEN, now
+			err = &CircuitOpenError{RetryAt: now.Add(b.CoolDown)}
+		}
+	}
+	to, round := b.state, b.round
+	b.mutex.Unlock()
+	b.state_changed(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var once sync.Once
+	return func(failed bool) {
+		once.Do(func() { b.report(failed, round) })
+	}, nil
+}
+
+func (b *CircuitBreaker) current_state() string {
+	if b.state == "" {
+		b.state = CIRCUIT_CLOSED
+	}
+	return b.state
+}
+
+func (b *CircuitBreaker) now() time.Time {
+	if b.Now == nil {
+		return time.Now()
+	}
+	return b.Now()
+}
+
+func (b *CircuitBreaker) half_open_requests() int {
+	if b.HalfOpenRequests < 1 {
+		return 1
+	}
+	return b.HalfOpenRequests
+}
+
+func (b *CircuitBreaker) trial_timeout() time.Duration {
+	if b.TrialTimeout <= 0 {
+		return DEFAULT_TRIAL_TIMEOUT
+	}
+	return b.TrialTimeout
+}
+
+func (b *CircuitBreaker) report(failed bool, round int) {
+	b.mutex.Lock()
+	from := b.state
+	now := b.now()
+	switch b.state {
+	case CIRCUIT_CLOSED:
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if failed && b.requests >= b.MinRequests && float64(b.failures) >= b.FailureRatio*float64(b.requests) {
+			b.state, b.opened_at = CIRCUIT_OPEN, now
+		}
+	case CIRCUIT_HALF_OPEN:
+		if round != b.round {
+			//a trial of an earlier round that timed out
+			break
+		}
+		if failed {
+			b.state, b.opened_at = CIRCUIT_OPEN, now
+		} else {
+			b.succeeded++
+			if b.succeeded >= b.half_open_requests() {
+				b.state, b.requests, b.failures, b.since = CIRCUIT_CLOSED, 0, 0, now
+			}
+		}
+	}
+	to := b.state
+	b.mutex.Unlock()
+	b.state_changed(from, to)
+}
+
+func (b *CircuitBreaker) state_changed(from string, to string) {
+	if from != to && b.OnStateChange != nil {
+		b.OnStateChange(from, to)
+	}
+}
+
+// WithBreaker makes the requests that reach it ask breaker first, so placed
+// inside Retry every attempt takes a permit and counts as an outcome. The
+// client adds it inside its middleware when Breaker is set.
+func WithBreaker(breaker *CircuitBreaker) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(req *http.Request) (*http.Response, error) {
+			done, err := breaker.Allow()
+			if err != nil {
+				return nil, err
+			}
+			res, err := next.Do(req)
+			done(err != nil || res.StatusCode >= 500)
+			return res, err
+		})
+	}
+}
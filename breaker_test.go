@@ -0,0 +1,167 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("CircuitBreaker", func() {
+	var (
+		breaker *CircuitBreaker
+		mutex   sync.Mutex
+		changes []string
+		clock   time.Time
+	)
+	advance := func(d time.Duration) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		clock = clock.Add(d)
+	}
+	state_changes := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), changes...)
+	}
+	call := func(failed bool) error {
+		done, err := breaker.Allow()
+		if err == nil {
+			done(failed)
+		}
+		return err
+	}
+
+	BeforeEach(func() {
+		changes = nil
+		clock = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		breaker = NewCircuitBreaker(0.5, 20*time.Second)
+		breaker.Now = func() time.Time {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return clock
+		}
+		breaker.MinRequests = 4
+		breaker.OnStateChange = func(from string, to string) {
+			mutex.Lock()
+			changes = append(changes, from+">"+to)
+			mutex.Unlock()
+		}
+	})
+
+	It("should open once the failure ratio is reached", func() {
+		Expect(call(false)).To(Succeed())
+		Expect(call(true)).To(Succeed())
+		Expect(call(false)).To(Succeed())
+		Expect(breaker.State()).To(Equal(CIRCUIT_CLOSED))
+		Expect(call(true)).To(Succeed())
+		Expect(breaker.State()).To(Equal(CIRCUIT_OPEN))
+
+		err := call(false)
+		Expect(errors.Is(err, ErrCircuitOpen)).To(BeTrue())
+		Expect(err.(*CircuitOpenError).RetryAt).To(Equal(clock.Add(20 * time.Second)))
+		Expect(state_changes()).To(Equal([]string{"closed>open"}))
+	})
+	It("should close after a successful trial", func() {
+		for i := 0; i < 4; i++ {
+			call(true)
+		}
+		advance(25 * time.Second)
+		done, err := breaker.Allow()
+		Expect(err).Should(BeNil())
+		Expect(breaker.State()).To(Equal(CIRCUIT_HALF_OPEN))
+		//one trial at a time
+		Expect(call(false)).ShouldNot(Succeed())
+		done(false)
+		Expect(breaker.State()).To(Equal(CIRCUIT_CLOSED))
+		Expect(state_changes()).To(Equal([]string{"closed>open", "open>half_open", "half_open>closed"}))
+	})
+	It("should open again when the trial fails", func() {
+		for i := 0; i < 4; i++ {
+			call(true)
+		}
+		advance(25 * time.Second)
+		Expect(call(true)).To(Succeed())
+		Expect(breaker.State()).To(Equal(CIRCUIT_OPEN))
+		Expect(call(false)).ShouldNot(Succeed())
+	})
+	It("should open again when the trial does not report back in time", func() {
+		breaker.TrialTimeout = 10 * time.Second
+		for i := 0; i < 4; i++ {
+			call(true)
+		}
+		advance(25 * time.Second)
+		hung, err := breaker.Allow()
+		Expect(err).Should(BeNil())
+		err = call(false)
+		Expect(errors.Is(err, ErrCircuitOpen)).To(BeTrue())
+		Expect(err.(*CircuitOpenError).RetryAt).To(Equal(clock.Add(10 * time.Second)))
+
+		advance(15 * time.Second)
+		Expect(call(false)).ShouldNot(Succeed())
+		Expect(breaker.State()).To(Equal(CIRCUIT_OPEN))
+
+		advance(25 * time.Second)
+		done, err := breaker.Allow()
+		Expect(err).Should(BeNil())
+		//the hung trial finishing late does not count
+		hung(false)
+		Expect(breaker.State()).To(Equal(CIRCUIT_HALF_OPEN))
+		done(false)
+		Expect(breaker.State()).To(Equal(CIRCUIT_CLOSED))
+	})
+	It("should forget failures outside the window", func() {
+		breaker.Window = 10 * time.Second
+		call(true)
+		call(true)
+		call(true)
+		advance(15 * time.Second)
+		call(true)
+		Expect(breaker.State()).To(Equal(CIRCUIT_CLOSED))
+	})
+
+	Context("In a client", func() {
+		var (
+			client *Client
+			server *testutil.RecordingServer
+		)
+
+		BeforeEach(func() {
+			server = testutil.NewRecordingServer()
+			client = server.Client()
+			client.Breaker = breaker
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should fail fast during an outage", func() {
+			server.FailWith(503)
+			for i := 0; i < 4; i++ {
+				_, err := client.Notify("hello", "", "", "", "", "", "", "abc")
+				Expect(err).ShouldNot(BeNil())
+			}
+			_, err := client.Notify("hello", "", "", "", "", "", "", "abc")
+			Expect(errors.Is(err, ErrCircuitOpen)).To(BeTrue())
+			Expect(server.Requests()).To(HaveLen(4))
+
+			server.FailWith(0)
+			advance(25 * time.Second)
+			_, err = client.VerifyCredentials()
+			Expect(err).Should(BeNil())
+			Expect(breaker.State()).To(Equal(CIRCUIT_CLOSED))
+		})
+		It("should not count client errors as failures", func() {
+			server.FailWith(404)
+			for i := 0; i < 6; i++ {
+				client.Notify("hello", "", "", "", "", "", "", "abc")
+			}
+			Expect(breaker.State()).To(Equal(CIRCUIT_CLOSED))
+		})
+	})
+})
@@ -0,0 +1,419 @@
+package zeropush
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+var ErrMessageNotFound = errors.New("message not found in the catalog")
+
+// Catalog holds message bundles per locale. Messages are text/template
+// strings rendered with the caller's arguments plus .Count, with one form
+// per plural category of the locale, e.g. ["{{.Count}} new follower",
+// "{{.Count}} new followers"].
+type Catalog struct {
+	//used for devices whose locale has no bundle or lacks the message
+	Fallback string
+
+	mutex   sync.RWMutex
+	bundles map[string]*bundle
+}
+
+type bundle struct {
+	locale   string
+	plural   func(n int) int
+	messages map[string][]*template.Template
+}
+
+func NewCatalog(fallback string) *Catalog {
+	return &Catalog{Fallback: normalize_locale(fallback), bundles: make(map[string]*bundle)}
+}
+
+// normalize_locale turns "pt_BR.UTF-8" and "PT-br" into "pt-br".
+func normalize_locale(locale string) string {
+	if i := strings.IndexAny(locale, ".@"); i >= 0 {
+		locale = locale[:i]
+	}
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+// Add adds or replaces the messages of a locale. plural_forms is a gettext
+// Plural-Forms header or expression such as "nplurals=2; plural=(n != 1);",
+// if empty the rule of the language is used.
+func (c *Catalog) Add(locale string, plural_forms string, messages map[string][]string) error {
+	locale = normalize_locale(locale)
+	if locale == "" {
+		return errors.New("locale cannot be empty")
+	}
+	if plural_forms == "" {
+		plural_forms = default_plural_forms(locale)
+	}
+	plural, err := parse_plural_forms(plural_forms)
+	if err != nil {
+		return fmt.Errorf("%s: plural forms: %s", locale, err)
+	}
+	b := &bundle{locale: locale, plural: plural, messages: make(map[string][]*template.Template)}
+	for id, forms := range messages {
+		for _, form := range forms {
+			t, err := template.New(id).Option("missingkey=error").Parse(form)
+			if err != nil {
+				return fmt.Errorf("%s: %s", locale, err)
+			}
+			b.messages[id] = append(b.messages[id], t)
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.bundles[locale] = b
+	return nil
+}
+
+// json_bundle is the JSON file format, a message is a string or a list of
+// plural forms.
+type json_bundle struct {
+	Locale      string                     `json:"locale"`
+	PluralForms string                     `json:"plural_forms"`
+	Messages    map[string]json.RawMessage `json:"messages"`
+}
+
+// LoadFile loads a .json or gettext .po bundle. The locale is taken from the
+// file ("locale" or the Language header) or else from the file name, tr.po.
+func (c *Catalog) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		file := &json_bundle{}
+		if err = json.Unmarshal(data, file); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		messages := make(map[string][]string, len(file.Messages))
+		for id, raw := range file.Messages {
+			var forms []string
+			var single string
+			if err = json.Unmarshal(raw, &single); err == nil {
+				forms = []string{single}
+			} else if err = json.Unmarshal(raw, &forms); err != nil {
+				return fmt.Errorf("%s: message %s must be a string or a list of strings", path, id)
+			}
+			messages[id] = forms
+		}
+		if file.Locale == "" {
+			file.Locale = name
+		}
+		err = c.Add(file.Locale, file.PluralForms, messages)
+	case ".po":
+		locale, plural_forms, messages, parse_err := parse_po(data)
+		if parse_err != nil {
+			return fmt.Errorf("%s: %s", path, parse_err)
+		}
+		if locale == "" {
+			locale = name
+		}
+		err = c.Add(locale, plural_forms, messages)
+	default:
+		return fmt.Errorf("%s: unknown catalog format, use .json or .po", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// LoadDir loads every .json and .po file in dir.
+func (c *Catalog) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".json" && ext != ".po") {
+			continue
+		}
+		if err = c.LoadFile(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Catalog) Locales() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	locales := make([]string, 0, len(c.bundles))
+	for locale := range c.bundles {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// resolve returns the bundle used for id in locale: the locale itself, its
+// language ("pt" for "pt-br"), then the fallback.
+func (c *Catalog) resolve(locale string, id string) (*bundle, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	locale = normalize_locale(locale)
+	candidates := []string{locale}
+	if i := strings.Index(locale, "-"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	candidates = append(candidates, c.Fallback)
+	for _, candidate := range candidates {
+		if b, ok := c.bundles[candidate]; ok && len(b.messages[id]) > 0 {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrMessageNotFound, id)
+}
+
+// Translate renders message id for locale. args may be nil; .Count is set
+// to count unless args already has it.
+func (c *Catalog) Translate(locale string, id string, count int, args map[string]interface{}) (string, error) {
+	b, err := c.resolve(locale, id)
+	if err != nil {
+		return "", err
+	}
+	return b.render(id, count, args)
+}
+
+func (b *bundle) render(id string, count int, args map[string]interface{}) (string, error) {
+	forms := b.messages[id]
+	form := b.plural(count)
+	if form < 0 || form >= len(forms) {
+		form = len(forms) - 1
+	}
+	data := make(map[string]interface{}, len(args)+1)
+	data["Count"] = count
+	for key, value := range args {
+		data[key] = value
+	}
+	var buffer bytes.Buffer
+	if err := forms[form].Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// LocaleLookup returns the locale of a device token, "" if unknown.
+type LocaleLookup interface {
+	Locale(device_token string) (string, error)
+}
+
+type LocalizedMessage struct {
+	ID    string
+	Count int
+	Args  map[string]interface{}
+	//badge, sound and the rest are copied into every notification
+	Base Notification
+}
+
+// LocaleBatch is the Notify call for the devices resolved to one locale.
+type LocaleBatch struct {
+	Locale       string
+	DeviceTokens []string
+	Notification *Notification
+	Response     *NotifyResponse
+	Err          error
+}
+
+// SendLocalized resolves the locale of every device token, renders the
+// message once per locale and sends one Notify per locale. The returned
+// error is the first failed batch.
+func (c *Client) SendLocalized(catalog *Catalog, lookup LocaleLookup, message LocalizedMessage, device_tokens ...string) ([]*LocaleBatch, error) {
+	var batches []*LocaleBatch
+	by_locale := make(map[string]*LocaleBatch)
+	for _, token := range device_tokens {
+		locale, err := lookup.Locale(token)
+		if err != nil {
+			log.Printf("Error looking up the locale of %s, using the fallback: %s", token, err)
+			locale = ""
+		}
+		b, err := catalog.resolve(locale, message.ID)
+		resolved := ""
+		if b != nil {
+			resolved = b.locale
+		}
+		batch, ok := by_locale[resolved]
+		if !ok {
+			batch = &LocaleBatch{Locale: resolved, Err: err}
+			if err == nil {
+				batch.Notification, batch.Err = localized_notification(b, message)
+			}
+			by_locale[resolved] = batch
+			batches = append(batches, batch)
+		}
+		batch.DeviceTokens = append(batch.DeviceTokens, token)
+	}
+
+	var first_err error
+	for _, batch := range batches {
+		if batch.Err == nil {
+			batch.Notification.DeviceTokens = batch.DeviceTokens
+			batch.Response, batch.Err = c.Send(batch.Notification)
+		}
+		if batch.Err != nil && first_err == nil {
+			first_err = batch.Err
+		}
+	}
+	return batches, first_err
+}
+
+func localized_notification(b *bundle, message LocalizedMessage) (*Notification, error) {
+	alert, err := b.render(message.ID, message.Count, message.Args)
+	if err != nil {
+		return nil, err
+	}
+	n := message.Base
+	n.Alert = alert
+	n.DeviceTokens = nil
+	if n.IdempotencyKey != "" {
+		sum := sha1.Sum([]byte(b.locale))
+		n.IdempotencyKey += "/" + hex.EncodeToString(sum[:8])
+	}
+	return &n, nil
+}
+
+// parse_po reads the translated entries of a gettext .po file, keyed by msgid.
+func parse_po(data []byte) (string, string, map[string][]string, error) {
+	messages := make(map[string][]string)
+	var locale, plural_forms string
+	var id, field string
+	var strs map[int]string
+
+	flush := func() {
+		if strs == nil {
+			return
+		}
+		if id == "" {
+			//the header
+			for _, line := range strings.Split(strs[0], "\n") {
+				if i := strings.Index(line, ":"); i > 0 {
+					value := strings.TrimSpace(line[i+1:])
+					switch strings.ToLower(strings.TrimSpace(line[:i])) {
+					case "language":
+						locale = value
+					case "plural-forms":
+						plural_forms = value
+					}
+				}
+			}
+		} else {
+			forms := make([]string, len(strs))
+			translated := true
+			for i := range forms {
+				forms[i] = strs[i]
+				if forms[i] == "" {
+					translated = false
+				}
+			}
+			if translated && len(forms) > 0 {
+				messages[id] = forms
+			}
+		}
+		id, field, strs = "", "", nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyword := line
+		value := ""
+		if i := strings.Index(line, " "); i > 0 && !strings.HasPrefix(line, `"`) {
+			keyword, value = line[:i], strings.TrimSpace(line[i+1:])
+		} else if strings.HasPrefix(line, `"`) {
+			keyword, value = "", line
+		}
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("line %d: %s", line_number, err)
+		}
+		switch {
+		case keyword == "":
+			//continuation of the previous string
+			switch {
+			case field == "msgid":
+				id += s
+			case strings.HasPrefix(field, "msgstr"):
+				strs[po_index(field)] += s
+			}
+		case keyword == "msgctxt":
+			flush()
+			field = keyword
+		case keyword == "msgid":
+			if strs != nil {
+				flush()
+			}
+			id, field = s, keyword
+		case keyword == "msgid_plural":
+			//the plural forms are in msgstr[n]
+			field = keyword
+		case strings.HasPrefix(keyword, "msgstr"):
+			if strs == nil {
+				strs = make(map[int]string)
+			}
+			field = keyword
+			strs[po_index(keyword)] = s
+		default:
+			return "", "", nil, fmt.Errorf("line %d: unknown keyword %s", line_number, keyword)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", nil, err
+	}
+	flush()
+	return locale, plural_forms, messages, nil
+}
+
+// po_index returns n of msgstr[n], 0 for msgstr.
+func po_index(field string) int {
+	start := strings.Index(field, "[")
+	if start < 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSuffix(field[start+1:], "]"))
+	return n
+}
+
+// default_plural_forms is the gettext rule of the locale's language.
+func default_plural_forms(locale string) string {
+	language := locale
+	if i := strings.Index(locale, "-"); i > 0 {
+		language = locale[:i]
+	}
+	switch {
+	case locale == "pt-br" || language == "fr":
+		return "n > 1"
+	case language == "ja" || language == "zh" || language == "ko" || language == "vi" || language == "th" || language == "id":
+		return "0"
+	case language == "ru" || language == "uk":
+		return "n%10==1 && n%100!=11 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2"
+	case language == "pl":
+		return "n==1 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2"
+	case language == "ar":
+		return "n==0 ? 0 : n==1 ? 1 : n==2 ? 2 : n%100>=3 && n%100<=10 ? 3 : n%100>=11 ? 4 : 5"
+	}
+	return "n != 1"
+}
@@ -0,0 +1,149 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+type locale_map map[string]string
+
+func (m locale_map) Locale(device_token string) (string, error) {
+	if device_token == "broken" {
+		return "", errors.New("lookup failed")
+	}
+	return m[device_token], nil
+}
+
+const english_bundle = `{
+	"locale": "en",
+	"messages": {
+		"followers": ["{{.Count}} new follower", "{{.Count}} new followers"],
+		"welcome": "Welcome, {{.Name}}!"
+	}
+}`
+
+const russian_po = `# Russian
+msgid ""
+msgstr ""
+"Language: ru\n"
+"Plural-Forms: nplurals=3; plural=(n%10==1 && n%100!=11 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2);\n"
+
+msgid "followers"
+msgid_plural "followers"
+msgstr[0] "{{.Count}} новый подписчик"
+msgstr[1] "{{.Count}} новых "
+"подписчика"
+msgstr[2] "{{.Count}} новых подписчиков"
+
+#, fuzzy
+msgid "welcome"
+msgstr ""
+`
+
+var _ = Describe("Catalog", func() {
+	var (
+		catalog *Catalog
+		dir     string
+	)
+
+	write := func(name string, contents string) {
+		Expect(os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		dir, _ = os.MkdirTemp("", "zeropush")
+		write("en.json", english_bundle)
+		write("messages.ru.po", russian_po)
+		write("fr.json", `{"messages": {"followers": ["{{.Count}} nouvel abonné", "{{.Count}} nouveaux abonnés"]}}`)
+		write("README.txt", "not a bundle")
+		catalog = NewCatalog("en")
+		Expect(catalog.LoadDir(dir)).To(Succeed())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Context("When loading", func() {
+		It("should take the locale from the file or its name", func() {
+			Expect(catalog.Locales()).To(Equal([]string{"en", "fr", "ru"}))
+		})
+		It("should reject broken bundles", func() {
+			write("de.json", `{"messages": {"welcome": 42}}`)
+			Expect(catalog.LoadFile(filepath.Join(dir, "de.json"))).ShouldNot(Succeed())
+			write("de.po", "msgid \"x\"\nmsgstr \"y")
+			Expect(catalog.LoadFile(filepath.Join(dir, "de.po"))).ShouldNot(Succeed())
+		})
+		It("should reject broken plural forms", func() {
+			Expect(catalog.Add("xx", "nplurals=2; plural=n ==;", nil)).ShouldNot(Succeed())
+		})
+	})
+
+	Context("When translating", func() {
+		It("should pick the plural form of the locale", func() {
+			for count, expected := range map[int]string{1: "1 new follower", 0: "0 new followers", 2: "2 new followers"} {
+				Expect(catalog.Translate("en-US", "followers", count, nil)).To(Equal(expected))
+			}
+			for count, expected := range map[int]string{1: "1 новый подписчик", 3: "3 новых подписчика", 11: "11 новых подписчиков", 21: "21 новый подписчик"} {
+				Expect(catalog.Translate("ru_RU.UTF-8", "followers", count, nil)).To(Equal(expected))
+			}
+			//French counts zero as singular
+			Expect(catalog.Translate("fr", "followers", 0, nil)).To(Equal("0 nouvel abonné"))
+		})
+		It("should fall back for untranslated messages and unknown locales", func() {
+			Expect(catalog.Translate("ru", "welcome", 0, map[string]interface{}{"Name": "Ivan"})).To(Equal("Welcome, Ivan!"))
+			Expect(catalog.Translate("xx", "welcome", 0, map[string]interface{}{"Name": "X"})).To(Equal("Welcome, X!"))
+		})
+		It("should fail on unknown messages and missing arguments", func() {
+			_, err := catalog.Translate("en", "nope", 0, nil)
+			Expect(errors.Is(err, ErrMessageNotFound)).To(BeTrue())
+			_, err = catalog.Translate("en", "welcome", 0, nil)
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+
+	Context("When sending", func() {
+		var (
+			client *Client
+			server *testutil.RecordingServer
+		)
+		lookup := locale_map{"a": "en", "b": "ru", "c": "ru-RU", "d": "de", "e": "fr"}
+
+		BeforeEach(func() {
+			server = testutil.NewRecordingServer()
+			client = server.Client()
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should send one notification per locale", func() {
+			message := LocalizedMessage{ID: "followers", Count: 5, Base: Notification{Badge: "+1"}}
+			batches, err := client.SendLocalized(catalog, lookup, message, "a", "b", "c", "d", "e", "broken")
+			Expect(err).Should(BeNil())
+			Expect(batches).To(HaveLen(3))
+			Expect(batches[0].Locale).To(Equal("en"))
+			Expect(batches[0].DeviceTokens).To(Equal([]string{"a", "d", "broken"}))
+			Expect(batches[1].Locale).To(Equal("ru"))
+			Expect(batches[1].DeviceTokens).To(Equal([]string{"b", "c"}))
+			Expect(batches[1].Notification.Alert).To(Equal("5 новых подписчиков"))
+
+			requests := server.Queries("/notify")
+			Expect(requests).To(HaveLen(3))
+			Expect(requests[2].Get("alert")).To(Equal("5 nouveaux abonnés"))
+			Expect(requests[2].Get("badge")).To(Equal("+1"))
+		})
+		It("should report messages that cannot be rendered", func() {
+			batches, err := client.SendLocalized(catalog, lookup, LocalizedMessage{ID: "welcome"}, "a")
+			Expect(err).ShouldNot(BeNil())
+			Expect(batches[0].Err).To(Equal(err))
+			Expect(batches[0].DeviceTokens).To(Equal([]string{"a"}))
+		})
+	})
+})
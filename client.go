@@ -1,6 +1,7 @@
 package zeropush
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,22 +10,42 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"time"
 )
 
 var (
 	BASE_URL = "https://api.zeropush.com"
 )
 
+// DEFAULT_TIMEOUT bounds the API calls of clients without an HTTPClient.
+const DEFAULT_TIMEOUT = 30 * time.Second
+
+var default_http_client = &http.Client{Timeout: DEFAULT_TIMEOUT}
+
 type Client struct {
 	BaseURL   string
 	AuthToken string
+	//when set, sends with an idempotency key are answered from here within IdempotencyTTL
+	Idempotency    IdempotencyStore
+	IdempotencyTTL time.Duration
+	//when set, API calls fail fast with a *CircuitOpenError during outages
+	Breaker *CircuitBreaker
+	Metrics Metrics
+	Tracer  Tracer
+	//defaults to a client with a DEFAULT_TIMEOUT timeout
+	HTTPClient *http.Client
+
+	ctx        context.Context
+	middleware []Middleware
+	//returned by every API call, e.g. of a Registry client for an unknown app
+	err error
 }
 
 type DeviceResponse struct {
 	*ZeroResponse
 	DeviceToken      string
 	Active           bool
-	MarkedInactiveAt string
+	MarkedInactiveAt time.Time
 	Badge            int
 	Channels         []string
 }
@@ -42,7 +63,7 @@ type BroadcastResponse struct {
 
 type TokenDetail struct {
 	DeviceToken      string
-	MarkedInactiveAt string
+	MarkedInactiveAt time.Time
 }
 
 //Responses
@@ -51,6 +72,32 @@ type ZeroResponse struct {
 	Headers map[string][]string
 	Error   map[string]string
 }
+// APIError is an error answered by the API, with its HTTP status.
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// retryable tells whether a call that failed with err may succeed later:
+// transport errors, timeouts, an open circuit and 429 or 5xx answers.
+func retryable(err error) bool {
+	var api_err *APIError
+	var url_err *url.Error
+	switch {
+	case errors.As(err, &api_err):
+		return api_err.Status == http.StatusTooManyRequests || api_err.Status >= 500
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.Is(err, context.Canceled):
+		return false
+	}
+	return errors.As(err, &url_err)
+}
+
 type SuccessResponse struct {
 	*ZeroResponse
 	Message       string
@@ -75,21 +122,42 @@ func (zr *ZeroResponse) GetHeader(key string) string {
 	return ""
 }
 
+// NewClient picks the token of the ENV environment, development by default.
+// On an unknown ENV it logs the error and returns a client without a token,
+// whose calls fail, rather than one holding the wrong token.
 func NewClient() *Client {
-	var auth_token string
-	if os.Getenv("ENV") == "production" {
+	client, err := NewClientFromEnv()
+	if err != nil {
+		log.Printf("Error : %s", err)
+		return &Client{BaseURL: BASE_URL}
+	}
+	return client
+}
+
+// NewClientFromEnv is NewClient returning the error of an unknown ENV.
+func NewClientFromEnv() (*Client, error) {
+	env := Development
+	if os.Getenv("ENV") != "" {
+		var err error
+		if env, err = ParseEnvironment(os.Getenv("ENV")); err != nil {
+			return nil, err
+		}
+	}
+	auth_token := os.Getenv("ZEROPUSH_DEV_TOKEN")
+	if env == Production {
 		auth_token = os.Getenv("ZEROPUSH_PROD_TOKEN")
-	} else {
-		auth_token = os.Getenv("ZEROPUSH_DEV_TOKEN")
 	}
-	return &Client{BaseURL: BASE_URL, AuthToken: auth_token}
+	return &Client{BaseURL: BASE_URL, AuthToken: auth_token}, nil
 }
 
-func add_authorization(req *http.Request, auth_token string) error {
-	if auth_token == "" {
+func (c *Client) add_authorization(req *http.Request) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.AuthToken == "" {
 		return errors.New("Auth Token is not set.")
 	}
-	req.Header.Add("Authorization", `Token token="`+auth_token+`"`)
+	req.Header.Add("Authorization", `Token token="`+c.AuthToken+`"`)
 	return nil
 }
 
@@ -100,11 +168,11 @@ func (c *Client) VerifyCredentials() (*SuccessResponse, error) {
 		log.Printf("Error : %s", err)
 		return nil, err
 	}
-	if err = add_authorization(req, c.AuthToken); err != nil {
+	if err = c.add_authorization(req); err != nil {
 		log.Printf("Error : %s", err)
 		return nil, err
 	}
-	response, err := send_request(req, false)
+	response, err := c.send_request(req, false)
 	if err != nil {
 		return &SuccessResponse{ZeroResponse: response}, err
 	}
@@ -115,12 +183,13 @@ func (c *Client) VerifyCredentials() (*SuccessResponse, error) {
 	}, nil
 }
 
-func send_request(req *http.Request, expect_array bool) (*ZeroResponse, error) {
-	http_client := &http.Client{}
+func (c *Client) send_request(req *http.Request, expect_array bool) (*ZeroResponse, error) {
 	var res *http.Response
 	var err error
-	if res, err = http_client.Do(req); err != nil {
-		log.Printf("Error : %s", err)
+	if res, err = c.doer().Do(req.WithContext(c.context())); err != nil {
+		if !errors.Is(err, ErrCircuitOpen) {
+			log.Printf("Error : %s", err)
+		}
 		return nil, err
 	} else {
 		defer res.Body.Close()
@@ -132,10 +201,10 @@ func send_request(req *http.Request, expect_array bool) (*ZeroResponse, error) {
 			var e map[string]string
 			if err = decoder.Decode(&e); err != nil {
 				log.Printf("Error: %s", err)
-				return nil, err
+				return nil, &APIError{Status: res.StatusCode, Message: res.Status}
 			}
 			zero_response.Error = e
-			err = errors.New(e["error"])
+			err = &APIError{Status: res.StatusCode, Message: e["error"]}
 			return zero_response, err
 		}
 		if expect_array {
@@ -160,24 +229,40 @@ func send_request(req *http.Request, expect_array bool) (*ZeroResponse, error) {
 }
 
 func (c *Client) GetInactiveTokens() (*TokenResponse, error) {
+	return c.GetInactiveTokensSince(time.Time{})
+}
+
+// GetInactiveTokensSince returns the tokens marked inactive at or after since.
+func (c *Client) GetInactiveTokensSince(since time.Time) (*TokenResponse, error) {
 	var req *http.Request
 	var err error
-	if req, err = http.NewRequest("GET", c.BaseURL+"/inactive_tokens", nil); err != nil {
+	urlStr := c.BaseURL + "/inactive_tokens"
+	if !since.IsZero() {
+		urlStr += "?" + url.Values{"since": {since.Format(time.RFC3339)}}.Encode()
+	}
+	if req, err = http.NewRequest("GET", urlStr, nil); err != nil {
 		log.Printf("Error : %s", err)
 		return nil, err
 	}
-	if err = add_authorization(req, c.AuthToken); err != nil {
+	if err = c.add_authorization(req); err != nil {
 		log.Printf("Error : %s", err)
 		return nil, err
 	}
-	response, err := send_request(req, true)
+	response, err := c.send_request(req, true)
 	if err != nil {
 		return &TokenResponse{ZeroResponse: response}, err
 	}
-	var token_details []TokenDetail = make([]TokenDetail, len(response.Body))
-	for i, token_detail := range response.Body {
-		token_details[i].DeviceToken = token_detail["device_token"].(string)
-		token_details[i].MarkedInactiveAt = token_detail["marked_inactive_at"].(string)
+	var token_details []TokenDetail = make([]TokenDetail, 0, len(response.Body))
+	for _, token_detail := range response.Body {
+		detail := TokenDetail{DeviceToken: token_detail["device_token"].(string)}
+		if detail.MarkedInactiveAt, err = parse_time(token_detail["marked_inactive_at"]); err != nil {
+			log.Printf("Error parsing marked_inactive_at of %s: %s", detail.DeviceToken, err)
+		}
+		//the API may ignore since, so filter here as well
+		if !since.IsZero() && detail.MarkedInactiveAt.Before(since) {
+			continue
+		}
+		token_details = append(token_details, detail)
 	}
 	return &TokenResponse{
 		ZeroResponse: response,
@@ -198,11 +283,11 @@ func (c *Client) GetDevice(device_token string) (*DeviceResponse, error) {
 		log.Printf("Error : %s", err)
 		return nil, err
 	}
-	if err = add_authorization(req, c.AuthToken); err != nil {
+	if err = c.add_authorization(req); err != nil {
 		log.Printf("Error : %s", err)
 		return nil, err
 	}
-	response, err := send_request(req, false)
+	response, err := c.send_request(req, false)
 	if err != nil {
 		return &DeviceResponse{ZeroResponse: response}, err
 	}
@@ -210,9 +295,9 @@ func (c *Client) GetDevice(device_token string) (*DeviceResponse, error) {
 	for i, channel := range response.Body[0]["channels"].([]interface{}) {
 		channels[i] = channel.(string)
 	}
-	marked_inactive_at := ""
-	if response.Body[0]["marked_inactive_at"] != nil {
-		marked_inactive_at = response.Body[0]["marked_inactive_at"].(string)
+	marked_inactive_at, err := parse_time(response.Body[0]["marked_inactive_at"])
+	if err != nil {
+		log.Printf("Error parsing marked_inactive_at: %s", err)
 	}
 	return &DeviceResponse{
 		ZeroResponse:     response,
@@ -252,12 +337,12 @@ func (c *Client) register(device_token string, channel string, register bool) (*
 		log.Printf("Error creating the request : %s", err)
 		return nil, err
 	}
-	if err = add_authorization(req, c.AuthToken); err != nil {
+	if err = c.add_authorization(req); err != nil {
 		log.Printf("Error adding the authorization header: %s", err)
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	response, err := send_request(req, false)
+	response, err := c.send_request(req, false)
 	if err != nil {
 		return &SuccessResponse{ZeroResponse: response}, err
 	}
@@ -290,12 +375,12 @@ func (c *Client) SetBadge(device_token string, badge int) (*SuccessResponse, err
 		log.Printf("Error creating the request : %s", err)
 		return nil, err
 	}
-	if err = add_authorization(req, c.AuthToken); err != nil {
+	if err = c.add_authorization(req); err != nil {
 		log.Printf("Error adding the authorization header: %s", err)
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	response, err := send_request(req, false)
+	response, err := c.send_request(req, false)
 	if err != nil {
 		return &SuccessResponse{ZeroResponse: response}, err
 	}
@@ -305,42 +390,34 @@ func (c *Client) SetBadge(device_token string, badge int) (*SuccessResponse, err
 	}, nil
 }
 func (c *Client) Notify(alert string, badge string, sound string, info string, expiry string, content_available string, category string, device_tokens ...string) (*NotifyResponse, error) {
+	return c.notify(&Notification{
+		Alert:            alert,
+		Badge:            badge,
+		Sound:            sound,
+		Info:             info,
+		Expiry:           expiry,
+		ContentAvailable: content_available,
+		Category:         category,
+		DeviceTokens:     device_tokens,
+	})
+}
+
+func (c *Client) notify(n *Notification) (*NotifyResponse, error) {
 	var req *http.Request
 	var err error
-	if device_tokens == nil || len(device_tokens) == 0 {
+	if len(n.DeviceTokens) == 0 {
 		return nil, errors.New("device tokens cannot be empty")
 	}
 
-	if alert == "" && info == "" {
+	if n.Alert == "" && n.Info == "" {
 		return nil, errors.New("Either alert of info must be set")
 	}
-	data := url.Values{}
-	for _, device_token := range device_tokens {
+	data := n.values()
+	for _, device_token := range n.DeviceTokens {
 		if device_token != "" {
 			data.Add("device_tokens[]", device_token)
 		}
 	}
-	if alert != "" {
-		data.Add("alert", alert)
-	}
-	if badge != "" {
-		data.Add("badge", badge)
-	}
-	if sound != "" {
-		data.Add("sound", sound)
-	}
-	if info != "" {
-		data.Add("info", info)
-	}
-	if expiry != "" {
-		data.Add("expiry", expiry)
-	}
-	if category != "" {
-		data.Add("category", category)
-	}
-	if content_available != "" {
-		data.Add("content_available", content_available)
-	}
 	u, _ := url.ParseRequestURI(c.BaseURL)
 	u.Path = "/notify"
 	request_type := "POST"
@@ -351,12 +428,15 @@ func (c *Client) Notify(alert string, badge string, sound string, info string, e
 		log.Printf("Error creating the request : %s", err)
 		return nil, err
 	}
-	if err = add_authorization(req, c.AuthToken); err != nil {
+	if err = c.add_authorization(req); err != nil {
 		log.Printf("Error adding the authorization header: %s", err)
 		return nil, err
 	}
+	if n.IdempotencyKey != "" {
+		req.Header.Set(IDEMPOTENCY_HEADER, n.IdempotencyKey)
+	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	response, err := send_request(req, false)
+	response, err := c.send_request(req, false)
 	if err != nil {
 		return &NotifyResponse{ZeroResponse: response}, err
 	}
@@ -368,41 +448,44 @@ func (c *Client) Notify(alert string, badge string, sound string, info string, e
 	for i, unregistered_token := range response.Body[0]["unregistered_tokens"].([]interface{}) {
 		unregistered_tokens[i] = unregistered_token.(string)
 	}
+	sent_count := int(response.Body[0]["sent_count"].(float64))
+	c.observe_tokens("/notify", sent_count, len(inactive_tokens), len(unregistered_tokens))
 	return &NotifyResponse{
 		ZeroResponse:       response,
 		InactiveTokens:     inactive_tokens,
 		UnregisteredTokens: unregistered_tokens,
-		SentCount:          int(response.Body[0]["sent_count"].(float64)),
+		SentCount:          sent_count,
 	}, nil
 
 }
 
 func (c *Client) Broadcast(channel string, alert string, badge string, sound string, info string, expiry string, content_available string, category string) (*BroadcastResponse, error) {
+	return c.broadcast(&Notification{
+		Channel:          channel,
+		Alert:            alert,
+		Badge:            badge,
+		Sound:            sound,
+		Info:             info,
+		Expiry:           expiry,
+		ContentAvailable: content_available,
+		Category:         category,
+	})
+}
+
+func (c *Client) broadcast(n *Notification) (*BroadcastResponse, error) {
 	var req *http.Request
 	var err error
 
-	if channel == "" {
+	if n.Channel == "" {
 		return nil, errors.New("Channel must be set")
 	}
 
-	if alert == "" && info == "" {
+	if n.Alert == "" && n.Info == "" {
 		return nil, errors.New("Either alert of info must be set")
 	}
-	data := url.Values{}
-	if badge != "" {
-		data.Add("badge", badge)
-	}
-	if info != "" {
-		data.Add("info", info)
-	}
-	if expiry != "" {
-		data.Add("expiry", expiry)
-	}
-	if content_available != "" {
-		data.Add("content_available", content_available)
-	}
+	data := n.values()
 	u, _ := url.ParseRequestURI(c.BaseURL)
-	u.Path = "/broadcast/" + channel
+	u.Path = "/broadcast/" + n.Channel
 	request_type := "POST"
 	u.RawQuery = data.Encode()
 	urlStr := fmt.Sprintf("%v", u)
@@ -411,18 +494,23 @@ func (c *Client) Broadcast(channel string, alert string, badge string, sound str
 		log.Printf("Error creating the request : %s", err)
 		return nil, err
 	}
-	if err = add_authorization(req, c.AuthToken); err != nil {
+	if err = c.add_authorization(req); err != nil {
 		log.Printf("Error adding the authorization header: %s", err)
 		return nil, err
 	}
+	if n.IdempotencyKey != "" {
+		req.Header.Set(IDEMPOTENCY_HEADER, n.IdempotencyKey)
+	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	response, err := send_request(req, false)
+	response, err := c.send_request(req, false)
 	if err != nil {
 		return &BroadcastResponse{ZeroResponse: response}, err
 	}
+	sent_count := int(response.Body[0]["sent_count"].(float64))
+	c.observe_tokens("/broadcast", sent_count, 0, 0)
 	return &BroadcastResponse{
 		ZeroResponse: response,
-		SentCount:    int(response.Body[0]["sent_count"].(float64)),
+		SentCount:    sent_count,
 	}, nil
 }
 
@@ -453,12 +541,12 @@ func (c *Client) subscribe(device_token string, channel string, sub bool) (*Subs
 		log.Printf("Error creating the request : %s", err)
 		return nil, err
 	}
-	if err = add_authorization(req, c.AuthToken); err != nil {
+	if err = c.add_authorization(req); err != nil {
 		log.Printf("Error adding the authorization header: %s", err)
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	response, err := send_request(req, false)
+	response, err := c.send_request(req, false)
 	if err != nil {
 		return &SubscribeResponse{ZeroResponse: response}, err
 	}
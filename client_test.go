@@ -8,6 +8,7 @@ import (
 	"github.com/sinangedik/zeropush/testutil"
 	"net/http/httptest"
 	"net/url"
+	"time"
 )
 
 var _ = Describe("Client", func() {
@@ -44,6 +45,7 @@ var _ = Describe("Client", func() {
 	})
 
 	Describe("/inactive_tokens", func() {
+		marked_inactive_at := time.Date(2013, 3, 11, 20, 25, 14, 0, time.UTC)
 		Context("With the correct credentials", func() {
 			client.AuthToken = testutil.CORRECT_AUTH_TOKEN
 			response, err := client.GetInactiveTokens()
@@ -53,11 +55,27 @@ var _ = Describe("Client", func() {
 				Expect(response.Body[0]["marked_inactive_at"]).To(Equal("2013-03-11T16:25:14-04:00"))
 				Expect(len(response.TokenDetails)).To(Equal(2))
 				Expect(response.TokenDetails[0].DeviceToken).To(Equal("1234567890abcdef1234567890abcdef1234567890abcdef1234567890abcedf"))
-				Expect(response.TokenDetails[0].MarkedInactiveAt).To(Equal("2013-03-11T16:25:14-04:00"))
+				Expect(response.TokenDetails[0].MarkedInactiveAt).To(BeTemporally("==", marked_inactive_at))
 				Expect(response.Body[1]["device_token"]).To(Equal("1234567890abcdef1234567890abcdef1234567890abcdef1234567890abcedf"))
 				Expect(response.Body[1]["marked_inactive_at"]).To(Equal("2013-03-11T16:25:14-04:00"))
 				Expect(response.TokenDetails[1].DeviceToken).To(Equal("1234567890abcdef1234567890abcdef1234567890abcdef1234567890abcedf"))
-				Expect(response.TokenDetails[1].MarkedInactiveAt).To(Equal("2013-03-11T16:25:14-04:00"))
+				Expect(response.TokenDetails[1].MarkedInactiveAt).To(BeTemporally("==", marked_inactive_at))
+			})
+		})
+		Context("Since a time before the tokens were marked inactive", func() {
+			client.AuthToken = testutil.CORRECT_AUTH_TOKEN
+			response, err := client.GetInactiveTokensSince(marked_inactive_at.Add(-time.Hour))
+			It("should get the inactive tokens", func() {
+				Expect(err).Should(BeNil())
+				Expect(len(response.TokenDetails)).To(Equal(2))
+			})
+		})
+		Context("Since a time after the tokens were marked inactive", func() {
+			client.AuthToken = testutil.CORRECT_AUTH_TOKEN
+			response, err := client.GetInactiveTokensSince(marked_inactive_at.Add(time.Second))
+			It("should filter the tokens out", func() {
+				Expect(err).Should(BeNil())
+				Expect(len(response.TokenDetails)).To(Equal(0))
 			})
 		})
 		Context("With incorrect credentials", func() {
@@ -211,7 +229,7 @@ var _ = Describe("Client", func() {
 				Expect((res.Body[0]["channels"].([]interface{}))[0].(string)).To(Equal("testflight"))
 				Expect(res.DeviceToken).To(Equal("1234567890abcdef1234567890abcdef1234567890abcdef1234567890abcedf"))
 				Expect(res.Active).To(Equal(true))
-				Expect(res.MarkedInactiveAt).To(Equal(""))
+				Expect(res.MarkedInactiveAt.IsZero()).To(BeTrue())
 				Expect(res.Badge).To(Equal(1))
 				Expect(res.Channels[0]).To(Equal("testflight"))
 			})
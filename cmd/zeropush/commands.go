@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sinangedik/zeropush"
+)
+
+type payload_flags struct {
+	alert             string
+	badge             string
+	sound             string
+	info              string
+	expiry            string
+	content_available string
+	category          string
+}
+
+func new_flag_set(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func parse_payload(name string, args []string) (*payload_flags, []string, error) {
+	p := &payload_flags{}
+	fs := new_flag_set(name)
+	fs.StringVar(&p.alert, "alert", "", "alert text")
+	fs.StringVar(&p.badge, "badge", "", "badge, e.g. 3 or +1")
+	fs.StringVar(&p.sound, "sound", "", "sound file name")
+	fs.StringVar(&p.info, "info", "", "custom JSON payload")
+	fs.StringVar(&p.expiry, "expiry", "", "expiry in seconds")
+	fs.StringVar(&p.content_available, "content-available", "", "content_available flag")
+	fs.StringVar(&p.category, "category", "", "notification category")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, errUsage
+	}
+	return p, fs.Args(), nil
+}
+
+func run_verify(c *zeropush.Client, args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	return c.VerifyCredentials()
+}
+
+func run_notify(c *zeropush.Client, args []string) (interface{}, error) {
+	p, tokens, err := parse_payload("notify", args)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errUsage
+	}
+	return c.Notify(p.alert, p.badge, p.sound, p.info, p.expiry, p.content_available, p.category, tokens...)
+}
+
+func run_broadcast(c *zeropush.Client, args []string) (interface{}, error) {
+	p, rest, err := parse_payload("broadcast", args)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 1 {
+		return nil, errUsage
+	}
+	return c.Broadcast(rest[0], p.alert, p.badge, p.sound, p.info, p.expiry, p.content_available, p.category)
+}
+
+func parse_channel(name string, args []string) (string, string, error) {
+	var channel string
+	fs := new_flag_set(name)
+	fs.StringVar(&channel, "channel", "", "channel to (un)register the device with")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return "", "", errUsage
+	}
+	return fs.Arg(0), channel, nil
+}
+
+func run_register(c *zeropush.Client, args []string) (interface{}, error) {
+	token, channel, err := parse_channel("register", args)
+	if err != nil {
+		return nil, err
+	}
+	return c.Register(token, channel)
+}
+
+func run_unregister(c *zeropush.Client, args []string) (interface{}, error) {
+	token, channel, err := parse_channel("unregister", args)
+	if err != nil {
+		return nil, err
+	}
+	return c.Unregister(token, channel)
+}
+
+func run_subscribe(c *zeropush.Client, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errUsage
+	}
+	return c.Subscribe(args[0], args[1])
+}
+
+func run_unsubscribe(c *zeropush.Client, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errUsage
+	}
+	return c.Unsubscribe(args[0], args[1])
+}
+
+func run_device(c *zeropush.Client, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errUsage
+	}
+	return c.GetDevice(args[0])
+}
+
+func run_set_badge(c *zeropush.Client, args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errUsage
+	}
+	badge, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errUsage
+	}
+	return c.SetBadge(args[0], badge)
+}
+
+func run_inactive_tokens(c *zeropush.Client, args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	return c.GetInactiveTokens()
+}
+
+func run_import(c *zeropush.Client, args []string) (interface{}, error) {
+	opts := zeropush.ImportOptions{}
+	var report_path string
+	fs := new_flag_set("import")
+	fs.StringVar(&opts.Format, "format", "", "csv or jsonl (default from the file extension)")
+	fs.IntVar(&opts.Concurrency, "concurrency", 4, "rows processed in parallel")
+	fs.Float64Var(&opts.RequestsPerSecond, "rate", 10, "maximum API requests per second, 0 for unlimited")
+	fs.StringVar(&opts.CheckpointFile, "checkpoint", "", "checkpoint file for resuming an interrupted import")
+	fs.StringVar(&report_path, "report", "", "write per-row results as CSV to this file")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return nil, errUsage
+	}
+	path := fs.Arg(0)
+	if opts.Format == "" {
+		opts.Format = zeropush.IMPORT_CSV
+		if ext := filepath.Ext(path); ext == ".jsonl" || ext == ".json" {
+			opts.Format = zeropush.IMPORT_JSONL
+		}
+	}
+	input, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	if report_path != "" {
+		report, err := os.Create(report_path)
+		if err != nil {
+			return nil, err
+		}
+		defer report.Close()
+		opts.Report = report
+	}
+	summary, err := c.Import(input, opts)
+	if err == nil && summary.Failed > 0 {
+		return nil, fmt.Errorf("%d of %d rows failed (succeeded: %d, skipped: %d)", summary.Failed, summary.Total, summary.Succeeded, summary.Skipped)
+	}
+	return summary, err
+}
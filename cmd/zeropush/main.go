@@ -0,0 +1,272 @@
+// Command zeropush is a small command-line front end for the ZeroPush API.
+//
+// Usage:
+//
+//	zeropush [-token t] [-config file] [-url base] [-json] [-v] <command> [arguments]
+//
+// The auth token is taken from the -token flag, then from the
+// ZEROPUSH_PROD_TOKEN / ZEROPUSH_DEV_TOKEN environment variables (selected by
+// ENV=production as in zeropush.NewClient), then from the config file
+// ($HOME/.zeropush.json unless -config is given).
+//
+// Exit codes: 0 on success, 1 when the API call or a row of an import fails,
+// 2 on usage errors and 3 when no auth token could be found.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sinangedik/zeropush"
+)
+
+const (
+	EXIT_OK     = 0
+	EXIT_FAILED = 1
+	EXIT_USAGE  = 2
+	EXIT_CONFIG = 3
+)
+
+var errUsage = errors.New("usage")
+
+type options struct {
+	token    string
+	config   string
+	base_url string
+	json     bool
+	verbose  bool
+}
+
+type config_file struct {
+	AuthToken string `json:"auth_token"`
+	BaseURL   string `json:"base_url"`
+}
+
+type command struct {
+	usage string
+	run   func(c *zeropush.Client, args []string) (interface{}, error)
+}
+
+var commands = map[string]command{
+	"verify":          {"verify", run_verify},
+	"notify":          {"notify [-alert a] [-badge b] [-sound s] [-info i] [-expiry e] [-content-available c] [-category c] token...", run_notify},
+	"broadcast":       {"broadcast [-alert a] [-badge b] [-sound s] [-info i] [-expiry e] [-content-available c] [-category c] channel", run_broadcast},
+	"register":        {"register [-channel c] token", run_register},
+	"unregister":      {"unregister [-channel c] token", run_unregister},
+	"subscribe":       {"subscribe token channel", run_subscribe},
+	"unsubscribe":     {"unsubscribe token channel", run_unsubscribe},
+	"device":          {"device token", run_device},
+	"set-badge":       {"set-badge token badge", run_set_badge},
+	"inactive-tokens": {"inactive-tokens", run_inactive_tokens},
+	"import":          {"import [-format csv|jsonl] [-concurrency n] [-rate r] [-checkpoint file] [-report file] file", run_import},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	opts := options{}
+	fs := flag.NewFlagSet("zeropush", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.token, "token", "", "ZeroPush server auth token")
+	fs.StringVar(&opts.config, "config", "", "config file (default $HOME/.zeropush.json)")
+	fs.StringVar(&opts.base_url, "url", "", "API base URL")
+	fs.BoolVar(&opts.json, "json", false, "print the raw API response as JSON")
+	fs.BoolVar(&opts.verbose, "v", false, "log outgoing requests")
+	fs.Usage = func() { usage(stderr, fs) }
+	if err := fs.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+	if fs.NArg() == 0 {
+		usage(stderr, fs)
+		return EXIT_USAGE
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "zeropush: unknown command %q\n", fs.Arg(0))
+		usage(stderr, fs)
+		return EXIT_USAGE
+	}
+
+	if !opts.verbose {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	client, err := new_client(opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "zeropush: %s\n", err)
+		return EXIT_CONFIG
+	}
+
+	result, err := cmd.run(client, fs.Args()[1:])
+	if err == errUsage {
+		fmt.Fprintf(stderr, "usage: zeropush %s\n", cmd.usage)
+		return EXIT_USAGE
+	}
+	if err != nil {
+		if opts.json {
+			print_json(stdout, map[string]string{"error": err.Error()})
+		} else {
+			fmt.Fprintf(stderr, "zeropush: %s\n", err)
+		}
+		return EXIT_FAILED
+	}
+	if opts.json {
+		print_json(stdout, raw_body(result))
+	} else {
+		print_human(stdout, result)
+	}
+	return EXIT_OK
+}
+
+func usage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintln(w, "usage: zeropush [flags] <command> [arguments]")
+	fmt.Fprintln(w, "\nflags:")
+	fs.PrintDefaults()
+	fmt.Fprintln(w, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", commands[name].usage)
+	}
+}
+
+func new_client(opts options) (*zeropush.Client, error) {
+	client, err := zeropush.NewClientFromEnv()
+	if err != nil {
+		//a misspelled ENV must not pick a token, unless -token makes it moot
+		if opts.token == "" {
+			return nil, err
+		}
+		client = &zeropush.Client{BaseURL: zeropush.BASE_URL}
+	}
+	cfg, err := load_config(opts.config)
+	if err != nil {
+		return nil, err
+	}
+	if client.AuthToken == "" {
+		client.AuthToken = cfg.AuthToken
+	}
+	if opts.token != "" {
+		client.AuthToken = opts.token
+	}
+	if cfg.BaseURL != "" {
+		client.BaseURL = cfg.BaseURL
+	}
+	if opts.base_url != "" {
+		client.BaseURL = opts.base_url
+	}
+	if client.AuthToken == "" {
+		return nil, errors.New("no auth token: use -token, ZEROPUSH_DEV_TOKEN/ZEROPUSH_PROD_TOKEN or a config file")
+	}
+	return client, nil
+}
+
+// load_config reads the JSON config file. A missing default file is not an error.
+func load_config(path string) (*config_file, error) {
+	cfg := &config_file{}
+	explicit := path != ""
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return cfg, nil
+		}
+		path = filepath.Join(home, ".zeropush.json")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return cfg, nil
+	}
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+func print_json(w io.Writer, v interface{}) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// raw_body returns the decoded API body of a response for -json output.
+func raw_body(result interface{}) interface{} {
+	switch r := result.(type) {
+	case *zeropush.TokenResponse:
+		return r.Body
+	case *zeropush.SuccessResponse:
+		return r.Body[0]
+	case *zeropush.NotifyResponse:
+		return r.Body[0]
+	case *zeropush.BroadcastResponse:
+		return r.Body[0]
+	case *zeropush.SubscribeResponse:
+		return r.Body[0]
+	case *zeropush.DeviceResponse:
+		return r.Body[0]
+	}
+	return result
+}
+
+func print_human(w io.Writer, result interface{}) {
+	switch r := result.(type) {
+	case *zeropush.SuccessResponse:
+		if r.AuthTokenType != "" {
+			fmt.Fprintf(w, "%s (%s)\n", r.Message, r.AuthTokenType)
+		} else {
+			fmt.Fprintln(w, r.Message)
+		}
+	case *zeropush.NotifyResponse:
+		fmt.Fprintf(w, "sent: %d\n", r.SentCount)
+		for _, token := range r.InactiveTokens {
+			fmt.Fprintf(w, "inactive: %s\n", token)
+		}
+		for _, token := range r.UnregisteredTokens {
+			fmt.Fprintf(w, "unregistered: %s\n", token)
+		}
+	case *zeropush.BroadcastResponse:
+		fmt.Fprintf(w, "sent: %d\n", r.SentCount)
+	case *zeropush.SubscribeResponse:
+		fmt.Fprintf(w, "%s: %s\n", r.DeviceToken, strings.Join(r.Channels, ", "))
+	case *zeropush.DeviceResponse:
+		fmt.Fprintf(w, "token:              %s\n", r.DeviceToken)
+		fmt.Fprintf(w, "active:             %t\n", r.Active)
+		fmt.Fprintf(w, "marked inactive at: %s\n", format_time(r.MarkedInactiveAt))
+		fmt.Fprintf(w, "badge:              %d\n", r.Badge)
+		fmt.Fprintf(w, "channels:           %s\n", strings.Join(r.Channels, ", "))
+	case *zeropush.TokenResponse:
+		for _, detail := range r.TokenDetails {
+			fmt.Fprintf(w, "%s\t%s\n", detail.DeviceToken, format_time(detail.MarkedInactiveAt))
+		}
+	case *zeropush.ImportSummary:
+		fmt.Fprintf(w, "rows: %d, succeeded: %d, failed: %d, skipped: %d\n", r.Total, r.Succeeded, r.Failed, r.Skipped)
+	}
+}
+
+func format_time(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("zeropush command", func() {
+	var (
+		server *httptest.Server
+		stdout *bytes.Buffer
+		stderr *bytes.Buffer
+		dir    string
+	)
+
+	BeforeEach(func() {
+		server = testutil.NewZeroTestServer()
+		stdout = &bytes.Buffer{}
+		stderr = &bytes.Buffer{}
+		os.Unsetenv("ZEROPUSH_DEV_TOKEN")
+		os.Unsetenv("ZEROPUSH_PROD_TOKEN")
+		dir, _ = os.MkdirTemp("", "zeropush")
+	})
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	zeropush := func(args ...string) int {
+		args = append([]string{"-url", server.URL, "-config", os.DevNull}, args...)
+		return run(args, stdout, stderr)
+	}
+
+	Context("Without a command", func() {
+		It("should exit with a usage error", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN)).To(Equal(EXIT_USAGE))
+			Expect(stderr.String()).To(ContainSubstring("commands:"))
+		})
+	})
+	Context("With an unknown command", func() {
+		It("should exit with a usage error", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "frobnicate")).To(Equal(EXIT_USAGE))
+		})
+	})
+	Context("Without a token", func() {
+		It("should exit with a config error", func() {
+			Expect(zeropush("verify")).To(Equal(EXIT_CONFIG))
+		})
+	})
+	Context("With a misspelled ENV", func() {
+		BeforeEach(func() {
+			os.Setenv("ENV", "prodution")
+			os.Setenv("ZEROPUSH_DEV_TOKEN", testutil.CORRECT_AUTH_TOKEN)
+		})
+		AfterEach(func() {
+			os.Unsetenv("ENV")
+		})
+		It("should exit with a config error instead of using the development token", func() {
+			Expect(zeropush("verify")).To(Equal(EXIT_CONFIG))
+			Expect(stderr.String()).To(ContainSubstring("unknown environment"))
+		})
+		It("should use an explicit token", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "verify")).To(Equal(EXIT_OK))
+		})
+	})
+	Context("With the token in a config file", func() {
+		It("should use it", func() {
+			path := filepath.Join(dir, "zeropush.json")
+			Expect(os.WriteFile(path, []byte(`{"auth_token":"`+testutil.CORRECT_AUTH_TOKEN+`"}`), 0600)).To(Succeed())
+			code := run([]string{"-url", server.URL, "-config", path, "verify"}, stdout, stderr)
+			Expect(code).To(Equal(EXIT_OK))
+		})
+	})
+	Context("With the token in the environment", func() {
+		It("should use it", func() {
+			os.Setenv("ZEROPUSH_DEV_TOKEN", testutil.CORRECT_AUTH_TOKEN)
+			Expect(zeropush("verify")).To(Equal(EXIT_OK))
+		})
+	})
+
+	Describe("verify", func() {
+		It("should print the token type", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "verify")).To(Equal(EXIT_OK))
+			Expect(stdout.String()).To(Equal("authenticated (server_token)\n"))
+		})
+		It("should print the raw response with -json", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "-json", "verify")).To(Equal(EXIT_OK))
+			var body map[string]interface{}
+			Expect(json.Unmarshal(stdout.Bytes(), &body)).To(Succeed())
+			Expect(body["auth_token_type"]).To(Equal("server_token"))
+		})
+		It("should fail with a wrong token", func() {
+			Expect(zeropush("-token", testutil.WRONG_AUTH_TOKEN, "verify")).To(Equal(EXIT_FAILED))
+			Expect(stderr.String()).To(ContainSubstring("unauthorized"))
+		})
+		It("should print the error as JSON with -json", func() {
+			Expect(zeropush("-token", testutil.WRONG_AUTH_TOKEN, "-json", "verify")).To(Equal(EXIT_FAILED))
+			Expect(stdout.String()).To(ContainSubstring(`"error": "unauthorized"`))
+		})
+	})
+
+	Describe("notify", func() {
+		It("should report unregistered tokens", func() {
+			code := zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "notify", "-alert", "hi", "-badge", "+1",
+				"1234567891abcdef1234567890abcdef1234567890abcdef1234567890abcedf")
+			Expect(code).To(Equal(EXIT_OK))
+			Expect(stdout.String()).To(ContainSubstring("sent: 0"))
+			Expect(stdout.String()).To(ContainSubstring("unregistered: 1234567891abcdef1234567890abcdef1234567890abcdef1234567890abcedf"))
+		})
+		It("should require a device token", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "notify", "-alert", "hi")).To(Equal(EXIT_USAGE))
+		})
+	})
+
+	Describe("broadcast", func() {
+		It("should print the sent count", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "broadcast", "-alert", "hi", "foo")).To(Equal(EXIT_OK))
+			Expect(stdout.String()).To(Equal("sent: 100\n"))
+		})
+	})
+
+	Describe("register and unregister", func() {
+		It("should register the device", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "register", "-channel", "foo", "abc")).To(Equal(EXIT_OK))
+			Expect(stdout.String()).To(Equal("ok\n"))
+		})
+		It("should unregister the device", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "unregister", "abc")).To(Equal(EXIT_OK))
+			Expect(stdout.String()).To(Equal("ok\n"))
+		})
+	})
+
+	Describe("subscribe and unsubscribe", func() {
+		It("should print the channels", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "subscribe", "abc", "foo")).To(Equal(EXIT_OK))
+			Expect(stdout.String()).To(Equal("1236372819B36278G6783G21678321: foo\n"))
+		})
+		It("should require a channel", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "unsubscribe", "abc")).To(Equal(EXIT_USAGE))
+		})
+	})
+
+	Describe("device", func() {
+		It("should print the device details", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "device", "abc")).To(Equal(EXIT_OK))
+			Expect(stdout.String()).To(ContainSubstring("channels:           testflight, user@example.com"))
+		})
+	})
+
+	Describe("set-badge", func() {
+		It("should set the badge", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "set-badge", "abc", "3")).To(Equal(EXIT_OK))
+		})
+		It("should reject a non-numeric badge", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "set-badge", "abc", "x")).To(Equal(EXIT_USAGE))
+		})
+	})
+
+	Describe("inactive-tokens", func() {
+		It("should list the inactive tokens", func() {
+			Expect(zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "inactive-tokens")).To(Equal(EXIT_OK))
+			Expect(stdout.String()).To(ContainSubstring("2013-03-11T16:25:14-04:00"))
+		})
+	})
+
+	Describe("import", func() {
+		It("should import the devices of a file", func() {
+			input := filepath.Join(dir, "devices.jsonl")
+			report := filepath.Join(dir, "report.csv")
+			Expect(os.WriteFile(input, []byte(`{"token":"abc","channels":["foo"]}`+"\n"), 0600)).To(Succeed())
+			code := zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "import", "-rate", "0", "-report", report, input)
+			Expect(code).To(Equal(EXIT_OK))
+			Expect(stdout.String()).To(Equal("rows: 1, succeeded: 1, failed: 0, skipped: 0\n"))
+			data, _ := os.ReadFile(report)
+			Expect(string(data)).To(ContainSubstring("1,abc,ok,"))
+		})
+		It("should fail when a row fails", func() {
+			input := filepath.Join(dir, "devices.csv")
+			Expect(os.WriteFile(input, []byte("abc\n,foo\n"), 0600)).To(Succeed())
+			code := zeropush("-token", testutil.CORRECT_AUTH_TOKEN, "import", "-rate", "0", input)
+			Expect(code).To(Equal(EXIT_FAILED))
+			Expect(stderr.String()).To(ContainSubstring("1 of 2 rows failed"))
+		})
+	})
+})
@@ -0,0 +1,177 @@
+package zeropush
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrCoalescerClosed = errors.New("coalescer is closed")
+
+// MergeFunc summarizes the notifications buffered for one device token and
+// collapse key, oldest first, into the one that is sent.
+type MergeFunc func(device_token string, collapse_key string, notifications []*Notification) *Notification
+
+// SummaryMerge returns a MergeFunc that sends the latest notification with
+// its alert replaced by format applied to the count, e.g. "%d new likes".
+func SummaryMerge(format string) MergeFunc {
+	return func(device_token string, collapse_key string, notifications []*Notification) *Notification {
+		n := *notifications[len(notifications)-1]
+		n.Alert = fmt.Sprintf(format, len(notifications))
+		return &n
+	}
+}
+
+type coalesce_key struct {
+	device_token string
+	collapse_key string
+}
+
+type coalesce_buffer struct {
+	notifications []*Notification
+	timer         *time.Timer
+}
+
+// Coalescer buffers notifications per device token and collapse key for
+// Window after the first one and then sends a single notification: the
+// buffered one if it is alone, else the result of Merge, or the latest one
+// when Merge is nil or returns nil. Its IdempotencyKey gets a suffix per device token and
+// collapse key.
+type Coalescer struct {
+	Client *Client
+	Window time.Duration
+	Merge  MergeFunc
+	//called with the notifications that could not be sent
+	OnError func(n *Notification, err error)
+
+	mutex    sync.Mutex
+	buffers  map[coalesce_key]*coalesce_buffer
+	closed   bool
+	inflight int
+	idle     *sync.Cond
+}
+
+func NewCoalescer(client *Client, window time.Duration, merge MergeFunc) *Coalescer {
+	c := &Coalescer{Client: client, Window: window, Merge: merge, buffers: make(map[coalesce_key]*coalesce_buffer)}
+	c.idle = sync.NewCond(&c.mutex)
+	return c
+}
+
+// Add buffers n for each of its device tokens. Urgent notifications are sent
+// right away.
+func (c *Coalescer) Add(collapse_key string, n *Notification) error {
+	if n == nil {
+		return errors.New("notification cannot be nil")
+	}
+	if n.Channel != "" {
+		return errors.New("broadcasts cannot be coalesced, their recipients are unknown")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return ErrCoalescerClosed
+	}
+	if n.Urgent {
+		c.inflight++
+		go c.send(n)
+		return nil
+	}
+	for _, token := range n.DeviceTokens {
+		single := *n
+		single.DeviceTokens = []string{token}
+		key := coalesce_key{device_token: token, collapse_key: collapse_key}
+		buffer, ok := c.buffers[key]
+		if !ok {
+			buffer = &coalesce_buffer{}
+			buffer.timer = time.AfterFunc(c.Window, func() { c.flush(key, buffer) })
+			c.buffers[key] = buffer
+		}
+		buffer.notifications = append(buffer.notifications, &single)
+	}
+	return nil
+}
+
+func (c *Coalescer) flush(key coalesce_key, buffer *coalesce_buffer) {
+	c.mutex.Lock()
+	if c.buffers[key] != buffer {
+		//already flushed
+		c.mutex.Unlock()
+		return
+	}
+	delete(c.buffers, key)
+	c.inflight++
+	c.mutex.Unlock()
+	c.send(c.merge(key, buffer.notifications))
+}
+
+func (c *Coalescer) merge(key coalesce_key, notifications []*Notification) *Notification {
+	var n *Notification
+	if len(notifications) > 1 && c.Merge != nil {
+		if n = c.Merge(key.device_token, key.collapse_key, notifications); n != nil {
+			n.DeviceTokens = []string{key.device_token}
+		} else {
+			log.Printf("Error merging the notifications for %s: Merge returned nil, sending the latest one", key.device_token)
+		}
+	}
+	if n == nil {
+		latest := *notifications[len(notifications)-1]
+		n = &latest
+	}
+	if n.IdempotencyKey != "" {
+		//the same key for every device would suppress all but the first send
+		sum := sha1.Sum([]byte(key.collapse_key + "\x00" + key.device_token))
+		n.IdempotencyKey += "/" + hex.EncodeToString(sum[:8])
+	}
+	return n
+}
+
+// send delivers n and marks it done; callers have counted it in inflight.
+func (c *Coalescer) send(n *Notification) {
+	defer func() {
+		c.mutex.Lock()
+		c.inflight--
+		if c.inflight == 0 {
+			c.idle.Broadcast()
+		}
+		c.mutex.Unlock()
+	}()
+	if _, err := c.Client.Send(n); err != nil {
+		log.Printf("Error sending the coalesced notification: %s", err)
+		if c.OnError != nil {
+			c.OnError(n, err)
+		}
+	}
+}
+
+// Flush sends everything buffered right away and waits for it.
+func (c *Coalescer) Flush() {
+	c.mutex.Lock()
+	buffers := c.buffers
+	c.buffers = make(map[coalesce_key]*coalesce_buffer)
+	for _, buffer := range buffers {
+		buffer.timer.Stop()
+	}
+	c.inflight += len(buffers)
+	c.mutex.Unlock()
+
+	for key, buffer := range buffers {
+		go c.send(c.merge(key, buffer.notifications))
+	}
+	c.mutex.Lock()
+	for c.inflight > 0 {
+		c.idle.Wait()
+	}
+	c.mutex.Unlock()
+}
+
+// Close flushes the buffers and refuses further notifications, meant for shutdown.
+func (c *Coalescer) Close() {
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+	c.Flush()
+}
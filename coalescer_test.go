@@ -0,0 +1,115 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Coalescer", func() {
+	var (
+		client    *Client
+		server    *testutil.RecordingServer
+		mutex     sync.Mutex
+		coalescer *Coalescer
+	)
+	alerts := func() []string {
+		var alerts []string
+		for _, request := range server.Queries("/notify") {
+			alerts = append(alerts, request.Get("alert")+" -> "+request.Get("device_tokens[]"))
+		}
+		sort.Strings(alerts)
+		return alerts
+	}
+	like := func(tokens ...string) *Notification {
+		return &Notification{Alert: "Someone liked your photo", Badge: "+1", DeviceTokens: tokens}
+	}
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+		coalescer = NewCoalescer(client, time.Hour, SummaryMerge("%d new likes"))
+	})
+	AfterEach(func() {
+		coalescer.Close()
+		server.Close()
+	})
+
+	It("should summarize a burst per device and collapse key", func() {
+		coalescer.Add("likes", like("a", "b"))
+		coalescer.Add("likes", like("a"))
+		coalescer.Add("likes", like("a"))
+		coalescer.Add("comments", &Notification{Alert: "New comment", DeviceTokens: []string{"a"}})
+		Expect(server.Requests()).To(BeEmpty())
+
+		coalescer.Flush()
+		Expect(alerts()).To(Equal([]string{
+			"3 new likes -> a",
+			"New comment -> a",
+			"Someone liked your photo -> b",
+		}))
+	})
+	It("should give each device and collapse key its own idempotency key", func() {
+		client.Idempotency = NewMemoryIdempotencyStore(10)
+		n := like("a", "b")
+		n.IdempotencyKey = "like-1"
+		coalescer.Add("likes", n)
+		coalescer.Add("comments", &Notification{Alert: "New comment", DeviceTokens: []string{"a"}, IdempotencyKey: "like-1"})
+		coalescer.Flush()
+		keys := map[string]bool{}
+		for _, request := range server.Requests() {
+			key := request.Header.Get(IDEMPOTENCY_HEADER)
+			Expect(key).To(HavePrefix("like-1/"))
+			keys[key] = true
+		}
+		Expect(keys).To(HaveLen(3))
+		Expect(n.IdempotencyKey).To(Equal("like-1"))
+	})
+	It("should send the latest notification when Merge returns nil", func() {
+		coalescer.Merge = func(device_token string, collapse_key string, notifications []*Notification) *Notification {
+			return nil
+		}
+		coalescer.Add("likes", like("a"))
+		coalescer.Add("likes", &Notification{Alert: "Someone else liked your photo", DeviceTokens: []string{"a"}})
+		coalescer.Flush()
+		Expect(alerts()).To(Equal([]string{"Someone else liked your photo -> a"}))
+	})
+	It("should send once the window has passed", func() {
+		coalescer.Window = 10 * time.Millisecond
+		coalescer.Add("likes", like("a"))
+		coalescer.Add("likes", like("a"))
+		Eventually(alerts).Should(Equal([]string{"2 new likes -> a"}))
+		Consistently(alerts, 50*time.Millisecond).Should(HaveLen(1))
+	})
+	It("should send urgent notifications right away", func() {
+		coalescer.Add("likes", &Notification{Alert: "Urgent", Urgent: true, DeviceTokens: []string{"a"}})
+		Eventually(alerts).Should(Equal([]string{"Urgent -> a"}))
+	})
+	It("should flush on close and refuse further notifications", func() {
+		coalescer.Add("likes", like("a"))
+		coalescer.Close()
+		Expect(alerts()).To(HaveLen(1))
+		Expect(coalescer.Add("likes", like("a"))).To(Equal(ErrCoalescerClosed))
+	})
+	It("should report failed sends", func() {
+		client.AuthToken = testutil.WRONG_AUTH_TOKEN
+		var failed []*Notification
+		coalescer.OnError = func(n *Notification, err error) {
+			mutex.Lock()
+			failed = append(failed, n)
+			mutex.Unlock()
+		}
+		coalescer.Add("likes", like("a"))
+		coalescer.Flush()
+		mutex.Lock()
+		defer mutex.Unlock()
+		Expect(failed).To(HaveLen(1))
+		Expect(failed[0].DeviceTokens).To(Equal([]string{"a"}))
+	})
+})
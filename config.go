@@ -0,0 +1,175 @@
+package zeropush
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+type Environment string
+
+const (
+	Development Environment = "development"
+	Production  Environment = "production"
+)
+
+// ParseEnvironment accepts "development"/"dev" and "production"/"prod" in any
+// case and rejects everything else, so a typo cannot select the wrong token.
+func ParseEnvironment(s string) (Environment, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "development", "dev":
+		return Development, nil
+	case "production", "prod":
+		return Production, nil
+	}
+	return "", fmt.Errorf("unknown environment %q, expected development or production", s)
+}
+
+// Config is layered from defaults, a config file and environment variables,
+// in that order of increasing precedence.
+type Config struct {
+	Environment Environment `json:"environment" yaml:"environment" toml:"environment"`
+	BaseURL     string      `json:"base_url" yaml:"base_url" toml:"base_url"`
+	DevToken    string      `json:"dev_token" yaml:"dev_token" toml:"dev_token"`
+	ProdToken   string      `json:"prod_token" yaml:"prod_token" toml:"prod_token"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{Environment: Development, BaseURL: BASE_URL}
+}
+
+// LoadConfig reads the defaults, then path (YAML, JSON or TOML by extension;
+// skipped if empty), then the ZEROPUSH_ENV (or ENV), ZEROPUSH_BASE_URL,
+// ZEROPUSH_DEV_TOKEN and ZEROPUSH_PROD_TOKEN environment variables.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		if err := cfg.load_file(path); err != nil {
+			return nil, err
+		}
+	}
+	cfg.load_env()
+	env, err := ParseEnvironment(string(cfg.Environment))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Environment = env
+	return cfg, nil
+}
+
+func (cfg *Config) load_file(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	file := &Config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, file)
+	case ".json":
+		err = json.Unmarshal(data, file)
+	case ".toml":
+		err = toml.Unmarshal(data, file)
+	default:
+		return fmt.Errorf("%s: unknown config format, use .yaml, .json or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	cfg.merge(file)
+	return nil
+}
+
+func (cfg *Config) load_env() {
+	env := os.Getenv("ZEROPUSH_ENV")
+	if env == "" {
+		env = os.Getenv("ENV")
+	}
+	cfg.merge(&Config{
+		Environment: Environment(env),
+		BaseURL:     os.Getenv("ZEROPUSH_BASE_URL"),
+		DevToken:    os.Getenv("ZEROPUSH_DEV_TOKEN"),
+		ProdToken:   os.Getenv("ZEROPUSH_PROD_TOKEN"),
+	})
+}
+
+func (cfg *Config) merge(other *Config) {
+	if other.Environment != "" {
+		cfg.Environment = other.Environment
+	}
+	if other.BaseURL != "" {
+		cfg.BaseURL = other.BaseURL
+	}
+	if other.DevToken != "" {
+		cfg.DevToken = other.DevToken
+	}
+	if other.ProdToken != "" {
+		cfg.ProdToken = other.ProdToken
+	}
+}
+
+// AuthToken returns the token of the selected environment.
+func (cfg *Config) AuthToken() string {
+	if env, _ := ParseEnvironment(string(cfg.Environment)); env == Production {
+		return cfg.ProdToken
+	}
+	return cfg.DevToken
+}
+
+// NewClient returns a client for the selected environment.
+func (cfg *Config) NewClient() (*Client, error) {
+	if _, err := ParseEnvironment(string(cfg.Environment)); err != nil {
+		return nil, err
+	}
+	if cfg.AuthToken() == "" {
+		return nil, fmt.Errorf("no auth token configured for %s", cfg.Environment)
+	}
+	base_url := cfg.BaseURL
+	if base_url == "" {
+		base_url = BASE_URL
+	}
+	return &Client{BaseURL: base_url, AuthToken: cfg.AuthToken()}, nil
+}
+
+// NewCheckedClient is NewClient followed by CheckEnvironment, meant to be
+// called at startup.
+func (cfg *Config) NewCheckedClient() (*Client, error) {
+	client, err := cfg.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	env, _ := ParseEnvironment(string(cfg.Environment))
+	if err = client.CheckEnvironment(env); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+var ErrEnvironmentMismatch = errors.New("auth token does not belong to the selected environment")
+
+// CheckEnvironment verifies the credentials and makes sure the token type
+// reported by the API does not name the other environment, e.g.
+// "development_server_token" in production. Token types naming no
+// environment, like the plain "server_token", cannot be told apart and pass.
+func (c *Client) CheckEnvironment(env Environment) error {
+	response, err := c.VerifyCredentials()
+	if err != nil {
+		return err
+	}
+	token_type := strings.ToLower(response.AuthTokenType)
+	is_production := strings.Contains(token_type, "production")
+	is_development := strings.Contains(token_type, "development")
+	if is_production && is_development {
+		return fmt.Errorf("%w: token type %q names both environments", ErrEnvironmentMismatch, response.AuthTokenType)
+	}
+	if (env == Production && is_development) || (env != Production && is_production) {
+		return fmt.Errorf("%w: token type %q, environment %s", ErrEnvironmentMismatch, response.AuthTokenType, env)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Config", func() {
+	var (
+		dir       string
+		variables = []string{"ENV", "ZEROPUSH_ENV", "ZEROPUSH_BASE_URL", "ZEROPUSH_DEV_TOKEN", "ZEROPUSH_PROD_TOKEN"}
+		saved     map[string]string
+	)
+
+	write_file := func(name string, contents string) string {
+		path := filepath.Join(dir, name)
+		Expect(os.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+		return path
+	}
+
+	BeforeEach(func() {
+		dir, _ = os.MkdirTemp("", "zeropush")
+		saved = make(map[string]string)
+		for _, name := range variables {
+			saved[name] = os.Getenv(name)
+			os.Unsetenv(name)
+		}
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+		for name, value := range saved {
+			os.Setenv(name, value)
+		}
+	})
+
+	Describe("ParseEnvironment", func() {
+		It("should accept the long and short names", func() {
+			Expect(ParseEnvironment("Production")).To(Equal(Production))
+			Expect(ParseEnvironment("prod")).To(Equal(Production))
+			Expect(ParseEnvironment("dev")).To(Equal(Development))
+		})
+		It("should reject typos", func() {
+			_, err := ParseEnvironment("prodution")
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+
+	Describe("LoadConfig", func() {
+		It("should default to development", func() {
+			cfg, err := LoadConfig("")
+			Expect(err).Should(BeNil())
+			Expect(cfg.Environment).To(Equal(Development))
+			Expect(cfg.BaseURL).To(Equal(BASE_URL))
+		})
+		It("should read YAML files", func() {
+			cfg, err := LoadConfig(write_file("zeropush.yml", "environment: prod\nprod_token: yaml_token\n"))
+			Expect(err).Should(BeNil())
+			Expect(cfg.Environment).To(Equal(Production))
+			Expect(cfg.AuthToken()).To(Equal("yaml_token"))
+		})
+		It("should read JSON files", func() {
+			cfg, err := LoadConfig(write_file("zeropush.json", `{"dev_token": "json_token", "base_url": "http://example.com"}`))
+			Expect(err).Should(BeNil())
+			Expect(cfg.AuthToken()).To(Equal("json_token"))
+			Expect(cfg.BaseURL).To(Equal("http://example.com"))
+		})
+		It("should read TOML files", func() {
+			cfg, err := LoadConfig(write_file("zeropush.toml", "environment = \"development\"\ndev_token = \"toml_token\"\n"))
+			Expect(err).Should(BeNil())
+			Expect(cfg.AuthToken()).To(Equal("toml_token"))
+		})
+		It("should reject unknown file types", func() {
+			_, err := LoadConfig(write_file("zeropush.ini", ""))
+			Expect(err).ShouldNot(BeNil())
+		})
+		It("should let the environment variables override the file", func() {
+			path := write_file("zeropush.json", `{"environment": "development", "dev_token": "file_token", "prod_token": "file_prod_token"}`)
+			os.Setenv("ZEROPUSH_ENV", "production")
+			os.Setenv("ZEROPUSH_DEV_TOKEN", "env_token")
+			cfg, err := LoadConfig(path)
+			Expect(err).Should(BeNil())
+			Expect(cfg.Environment).To(Equal(Production))
+			Expect(cfg.DevToken).To(Equal("env_token"))
+			Expect(cfg.AuthToken()).To(Equal("file_prod_token"))
+		})
+		It("should fail on a misspelled environment", func() {
+			os.Setenv("ENV", "prodution")
+			_, err := LoadConfig("")
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+
+	Describe("NewClient", func() {
+		It("should fail without a token for the environment", func() {
+			cfg := &Config{Environment: Production, DevToken: "dev"}
+			_, err := cfg.NewClient()
+			Expect(err).ShouldNot(BeNil())
+		})
+		It("should honour the short environment names", func() {
+			os.Setenv("ENV", "prod")
+			os.Setenv("ZEROPUSH_PROD_TOKEN", "prod_token")
+			Expect(NewClient().AuthToken).To(Equal("prod_token"))
+		})
+		It("should not fall back to the development token on an unknown ENV", func() {
+			os.Setenv("ENV", "prodution")
+			os.Setenv("ZEROPUSH_DEV_TOKEN", "dev_token")
+			_, err := NewClientFromEnv()
+			Expect(err).To(MatchError(ContainSubstring(`unknown environment "prodution"`)))
+			client := NewClient()
+			Expect(client.AuthToken).To(BeEmpty())
+			_, err = client.VerifyCredentials()
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+
+	Describe("CheckEnvironment", func() {
+		var server *httptest.Server
+		BeforeEach(func() {
+			server = testutil.NewZeroTestServer()
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should accept a token of the selected environment", func() {
+			cfg := &Config{Environment: Production, BaseURL: server.URL, ProdToken: testutil.PRODUCTION_AUTH_TOKEN}
+			client, err := cfg.NewCheckedClient()
+			Expect(err).Should(BeNil())
+			Expect(client.AuthToken).To(Equal(testutil.PRODUCTION_AUTH_TOKEN))
+		})
+		It("should reject a token of the other environment", func() {
+			cfg := &Config{Environment: Production, BaseURL: server.URL, ProdToken: testutil.DEVELOPMENT_AUTH_TOKEN}
+			_, err := cfg.NewCheckedClient()
+			Expect(errors.Is(err, ErrEnvironmentMismatch)).To(BeTrue())
+		})
+		It("should accept a token type without an environment in either environment", func() {
+			client := &Client{BaseURL: server.URL, AuthToken: testutil.CORRECT_AUTH_TOKEN}
+			Expect(client.CheckEnvironment(Development)).To(Succeed())
+			Expect(client.CheckEnvironment(Production)).To(Succeed())
+		})
+		It("should fail on wrong credentials", func() {
+			client := &Client{BaseURL: server.URL, AuthToken: testutil.WRONG_AUTH_TOKEN}
+			err := client.CheckEnvironment(Development)
+			Expect(err).ShouldNot(BeNil())
+			Expect(errors.Is(err, ErrEnvironmentMismatch)).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,468 @@
+// Package fcm sends notifications through the Firebase Cloud Messaging HTTP
+// v1 API, authenticated with a service account.
+package fcm
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sinangedik/zeropush"
+	"github.com/sinangedik/zeropush/internal/jws"
+)
+
+const (
+	BASE_URL  = "https://fcm.googleapis.com"
+	TOKEN_URL = "https://oauth2.googleapis.com/token"
+	SCOPE     = "https://www.googleapis.com/auth/firebase.messaging"
+)
+
+// Credentials are the parts of a service account key file the provider uses.
+// They mint OAuth2 access tokens and cache them until shortly before expiry.
+type Credentials struct {
+	ProjectID    string `json:"project_id"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+
+	key          *rsa.PrivateKey
+	mutex        sync.Mutex
+	access_token string
+	expires_at   time.Time
+}
+
+func LoadCredentials(path string) (*Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := ParseCredentials(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return credentials, nil
+}
+
+// ParseCredentials reads the JSON of a service account key.
+func ParseCredentials(data []byte) (*Credentials, error) {
+	c := &Credentials{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if c.ClientEmail == "" || c.PrivateKey == "" {
+		return nil, errors.New("client_email and private_key must be set")
+	}
+	signer, err := jws.ParsePrivateKey([]byte(c.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	key, ok := signer.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private_key is not an RSA key")
+	}
+	c.key = key
+	if c.TokenURI == "" {
+		c.TokenURI = TOKEN_URL
+	}
+	return c, nil
+}
+
+// AccessToken returns a cached access token, exchanging a freshly signed
+// assertion for a new one when it is about to expire.
+func (c *Credentials) AccessToken(http_client *http.Client) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.access_token != "" && time.Now().Before(c.expires_at.Add(-time.Minute)) {
+		return c.access_token, nil
+	}
+	now := time.Now()
+	assertion, err := jws.Sign(map[string]interface{}{"kid": c.PrivateKeyID}, map[string]interface{}{
+		"iss":   c.ClientEmail,
+		"scope": SCOPE,
+		"aud":   c.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}, c.key)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	res, err := http_client.PostForm(c.TokenURI, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", fmt.Errorf("fcm: token exchange failed: %d %s", res.StatusCode, token.Error)
+	}
+	c.access_token = token.AccessToken
+	c.expires_at = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return c.access_token, nil
+}
+
+// invalidate drops access_token from the cache, unless another call has
+// already replaced it.
+func (c *Credentials) invalidate(access_token string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.access_token == access_token {
+		c.access_token, c.expires_at = "", time.Time{}
+	}
+}
+
+// Error is a failure that is not about a device token.
+type Error struct {
+	DeviceToken string
+	Status      int
+	Code        string
+	Message     string
+}
+
+func (e *Error) Error() string {
+	if e.DeviceToken == "" {
+		return fmt.Sprintf("fcm: %d %s: %s", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("fcm: %s: %d %s: %s", e.DeviceToken, e.Status, e.Code, e.Message)
+}
+
+// Provider implements zeropush.Provider against FCM. Broadcasts go to the
+// topic named after the channel. Tokens FCM reports as UNREGISTERED come
+// back as InactiveTokens, invalid tokens and tokens of another sender as
+// UnregisteredTokens.
+type Provider struct {
+	Credentials *Credentials
+	//defaults to the project of the credentials
+	ProjectID   string
+	BaseURL     string
+	HTTPClient  *http.Client
+	Concurrency int
+}
+
+var _ zeropush.Provider = (*Provider)(nil)
+
+func NewProvider(credentials *Credentials) *Provider {
+	return &Provider{
+		Credentials: credentials,
+		ProjectID:   credentials.ProjectID,
+		BaseURL:     BASE_URL,
+		HTTPClient:  &http.Client{Timeout: 30 * time.Second},
+		Concurrency: 16,
+	}
+}
+
+func (p *Provider) Notify(alert string, badge string, sound string, info string, expiry string, content_available string, category string, device_tokens ...string) (*zeropush.NotifyResponse, error) {
+	return p.Send(&zeropush.Notification{
+		Alert:            alert,
+		Badge:            badge,
+		Sound:            sound,
+		Info:             info,
+		Expiry:           expiry,
+		ContentAvailable: content_available,
+		Category:         category,
+		DeviceTokens:     device_tokens,
+	})
+}
+
+// Broadcast sends to the topic of the channel. FCM does not say how many
+// devices a topic reaches, so SentCount stays 0.
+func (p *Provider) Broadcast(channel string, alert string, badge string, sound string, info string, expiry string, content_available string, category string) (*zeropush.BroadcastResponse, error) {
+	response, err := p.Send(&zeropush.Notification{
+		Channel:          channel,
+		Alert:            alert,
+		Badge:            badge,
+		Sound:            sound,
+		Info:             info,
+		Expiry:           expiry,
+		ContentAvailable: content_available,
+		Category:         category,
+	})
+	if response == nil {
+		return nil, err
+	}
+	return &zeropush.BroadcastResponse{ZeroResponse: response.ZeroResponse}, err
+}
+
+// TopicName maps a channel to a valid topic name: characters FCM does not
+// allow in topics, such as the @ of "user@example.com", are %-escaped.
+func TopicName(channel string) string {
+	var b strings.Builder
+	for _, c := range []byte(channel) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+type send_result struct {
+	device_token string
+	name         string
+	err          error
+}
+
+// Send sends one message per device token, or one topic message for a
+// broadcast. The response body has one entry per message.
+func (p *Provider) Send(n *zeropush.Notification) (*zeropush.NotifyResponse, error) {
+	if n.Channel == "" && len(n.DeviceTokens) == 0 {
+		return nil, errors.New("device tokens cannot be empty")
+	}
+	if n.Alert == "" && n.Info == "" {
+		return nil, errors.New("Either alert of info must be set")
+	}
+	message, err := build_message(n)
+	if err != nil {
+		return nil, err
+	}
+	access_token, err := p.Credentials.AccessToken(p.HTTPClient)
+	if err != nil {
+		log.Printf("Error getting an FCM access token: %s", err)
+		return nil, err
+	}
+
+	var results []send_result
+	if n.Channel != "" {
+		results = []send_result{p.send_message(access_token, message, "topic", TopicName(n.Channel))}
+	} else {
+		results = make([]send_result, len(n.DeviceTokens))
+		concurrency := p.Concurrency
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		slots := make(chan struct{}, concurrency)
+		var wg sync.WaitGroup
+		for i, token := range n.DeviceTokens {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(i int, token string) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				results[i] = p.send_message(access_token, message, "token", token)
+			}(i, token)
+		}
+		wg.Wait()
+	}
+
+	response := &zeropush.NotifyResponse{ZeroResponse: &zeropush.ZeroResponse{}}
+	var first_err error
+	for _, result := range results {
+		entry := map[string]interface{}{"device_token": result.device_token}
+		if result.name != "" {
+			entry["name"] = result.name
+		}
+		var e *Error
+		if errors.As(result.err, &e) {
+			entry["error"] = e.Code
+		}
+		response.Body = append(response.Body, entry)
+		switch {
+		case result.err == nil:
+			if n.Channel == "" {
+				response.SentCount++
+			}
+		case e != nil && e.Code == "UNREGISTERED":
+			response.InactiveTokens = append(response.InactiveTokens, result.device_token)
+		case e != nil && (e.Code == "INVALID_TOKEN" || e.Code == "SENDER_ID_MISMATCH"):
+			response.UnregisteredTokens = append(response.UnregisteredTokens, result.device_token)
+		default:
+			if first_err == nil {
+				first_err = result.err
+			}
+		}
+	}
+	if first_err != nil {
+		log.Printf("Error sending to FCM: %s", first_err)
+		response.Error = map[string]string{"error": first_err.Error()}
+	}
+	return response, first_err
+}
+
+func (p *Provider) send_message(access_token string, message map[string]interface{}, target string, value string) send_result {
+	result := send_result{}
+	if target == "token" {
+		result.device_token = value
+	}
+	m := make(map[string]interface{}, len(message)+1)
+	for key, v := range message {
+		m[key] = v
+	}
+	m[target] = value
+	body, err := json.Marshal(map[string]interface{}{"message": m})
+	if err != nil {
+		result.err = err
+		return result
+	}
+	status, data, err := p.post_message(access_token, body)
+	if err == nil && status == http.StatusUnauthorized {
+		//the access token was revoked before it expired, mint a new one and try once more
+		p.Credentials.invalidate(access_token)
+		if access_token, err = p.Credentials.AccessToken(p.HTTPClient); err == nil {
+			status, data, err = p.post_message(access_token, body)
+		}
+	}
+	if err != nil {
+		result.err = err
+		return result
+	}
+	if status == http.StatusOK {
+		var sent struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(data, &sent)
+		result.name = sent.Name
+		return result
+	}
+	result.err = parse_error(result.device_token, status, data)
+	return result
+}
+
+func (p *Provider) post_message(access_token string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequest("POST", p.BaseURL+"/v1/projects/"+p.ProjectID+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+access_token)
+	res, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	return res.StatusCode, data, err
+}
+
+// parse_error reads a google.rpc.Status error. The FCM error code in the
+// details wins over the canonical status, and an INVALID_ARGUMENT about the
+// token field becomes INVALID_TOKEN so a bad payload is not mistaken for
+// bad tokens.
+func parse_error(device_token string, status int, data []byte) error {
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+			Details []struct {
+				Type            string `json:"@type"`
+				ErrorCode       string `json:"errorCode"`
+				FieldViolations []struct {
+					Field string `json:"field"`
+				} `json:"fieldViolations"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	e := &Error{DeviceToken: device_token, Status: status}
+	if json.Unmarshal(data, &body) != nil {
+		e.Code, e.Message = http.StatusText(status), string(data)
+		return e
+	}
+	e.Code, e.Message = body.Error.Status, body.Error.Message
+	token_violation := false
+	for _, detail := range body.Error.Details {
+		if detail.ErrorCode != "" {
+			e.Code = detail.ErrorCode
+		}
+		for _, violation := range detail.FieldViolations {
+			if violation.Field == "message.token" {
+				token_violation = true
+			}
+		}
+	}
+	if e.Code == "INVALID_ARGUMENT" && device_token != "" && token_violation {
+		e.Code = "INVALID_TOKEN"
+	}
+	return e
+}
+
+func content_available(n *zeropush.Notification) bool {
+	return n.ContentAvailable != "" && n.ContentAvailable != "0" && n.ContentAvailable != "false"
+}
+
+// build_message maps a notification to an FCM message without its target.
+// Info is spread into the data payload when it is a JSON object.
+func build_message(n *zeropush.Notification) (map[string]interface{}, error) {
+	message := map[string]interface{}{}
+	android := map[string]interface{}{"priority": "high"}
+	android_notification := map[string]interface{}{}
+	if n.Alert != "" {
+		message["notification"] = map[string]interface{}{"body": n.Alert}
+	}
+	if n.Sound != "" {
+		android_notification["sound"] = n.Sound
+	}
+	if n.Category != "" {
+		android_notification["click_action"] = n.Category
+	}
+	if n.Badge != "" {
+		if strings.HasPrefix(n.Badge, "+") || strings.HasPrefix(n.Badge, "-") {
+			return nil, fmt.Errorf("badge %q: FCM only takes absolute badges, see zeropush.BadgeManager", n.Badge)
+		}
+		badge, err := strconv.Atoi(n.Badge)
+		if err != nil {
+			return nil, fmt.Errorf("badge %q must be a number", n.Badge)
+		}
+		android_notification["notification_count"] = badge
+	}
+	if n.Expiry != "" {
+		seconds, err := strconv.Atoi(n.Expiry)
+		if err != nil {
+			return nil, fmt.Errorf("expiry %q must be a number of seconds", n.Expiry)
+		}
+		android["ttl"] = strconv.Itoa(seconds) + "s"
+	}
+	if n.Alert == "" {
+		//data only messages wake the app like content-available does on iOS
+		android["priority"] = "normal"
+	}
+	if len(android_notification) > 0 {
+		android["notification"] = android_notification
+	}
+	message["android"] = android
+	if content_available(n) {
+		//for iOS devices, which FCM reaches through APNs
+		apns := map[string]interface{}{"payload": map[string]interface{}{"aps": map[string]interface{}{"content-available": 1}}}
+		if n.Alert == "" && n.Sound == "" && n.Badge == "" {
+			apns["headers"] = map[string]string{"apns-push-type": "background", "apns-priority": "5"}
+		}
+		message["apns"] = apns
+	}
+
+	if n.Info != "" {
+		data := map[string]string{}
+		var info map[string]interface{}
+		if json.Unmarshal([]byte(n.Info), &info) == nil {
+			for key, value := range info {
+				if s, ok := value.(string); ok {
+					data[key] = s
+				} else {
+					encoded, _ := json.Marshal(value)
+					data[key] = string(encoded)
+				}
+			}
+		} else {
+			data["info"] = n.Info
+		}
+		message["data"] = data
+	}
+	return message, nil
+}
@@ -0,0 +1,13 @@
+package fcm_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestFCM(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "FCM Suite")
+}
@@ -0,0 +1,161 @@
+package fcm_test
+
+import (
+	. "github.com/sinangedik/zeropush/fcm"
+
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+func write_service_account(dir string, key *rsa.PrivateKey, token_uri string) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).Should(BeNil())
+	data, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "example-app",
+		"private_key_id": "key123",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "push@example-app.iam.gserviceaccount.com",
+		"token_uri":      token_uri,
+	})
+	path := filepath.Join(dir, "service-account.json")
+	Expect(os.WriteFile(path, data, 0600)).To(Succeed())
+	return path
+}
+
+var _ = Describe("Provider", func() {
+	var (
+		key      *rsa.PrivateKey
+		server   *testutil.FCMTestServer
+		provider *Provider
+		dir      string
+	)
+
+	BeforeEach(func() {
+		key, _ = rsa.GenerateKey(rand.Reader, 2048)
+		dir, _ = os.MkdirTemp("", "zeropush")
+		server = testutil.NewFCMTestServer(&key.PublicKey)
+		credentials, err := LoadCredentials(write_service_account(dir, key, server.URL+"/token"))
+		Expect(err).Should(BeNil())
+		provider = NewProvider(credentials)
+		provider.BaseURL = server.URL
+	})
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("should send one message per device token", func() {
+		response, err := provider.Notify("hello", "3", "default", `{"thread":"42","count":7}`, "3600", "", "MESSAGE", "a", "b")
+		Expect(err).Should(BeNil())
+		Expect(response.SentCount).To(Equal(2))
+		requests := server.Requests()
+		Expect(requests).To(HaveLen(2))
+
+		request := requests[0]
+		if request.Message["token"] != "a" {
+			request = requests[1]
+		}
+		Expect(request.ProjectID).To(Equal("example-app"))
+		Expect(request.Message["notification"]).To(Equal(map[string]interface{}{"body": "hello"}))
+		Expect(request.Message["data"]).To(Equal(map[string]interface{}{"thread": "42", "count": "7"}))
+		android := request.Message["android"].(map[string]interface{})
+		Expect(android["ttl"]).To(Equal("3600s"))
+		Expect(android["notification"]).To(Equal(map[string]interface{}{
+			"sound":              "default",
+			"click_action":       "MESSAGE",
+			"notification_count": float64(3),
+		}))
+		Expect(response.Body[0]["name"]).ShouldNot(BeEmpty())
+	})
+	It("should cache the access token until it expires", func() {
+		provider.Notify("hello", "", "", "", "", "", "", "a")
+		provider.Notify("hello", "", "", "", "", "", "", "a")
+		Expect(server.TokenCount()).To(Equal(1))
+
+		server.TokenLifetime = 30
+		provider.Credentials, _ = LoadCredentials(filepath.Join(dir, "service-account.json"))
+		provider.Notify("hello", "", "", "", "", "", "", "a")
+		provider.Notify("hello", "", "", "", "", "", "", "a")
+		Expect(server.TokenCount()).To(Equal(3))
+	})
+	It("should mint a new access token when the cached one is refused", func() {
+		provider.Notify("hello", "", "", "", "", "", "", "a")
+		server.RevokeAccessTokens()
+		response, err := provider.Notify("hello", "", "", "", "", "", "", "a", "b")
+		Expect(err).Should(BeNil())
+		Expect(response.SentCount).To(Equal(2))
+		Expect(server.TokenCount()).To(Equal(2))
+
+		provider.Notify("hello", "", "", "", "", "", "", "a")
+		Expect(server.Requests()).To(HaveLen(4))
+	})
+	It("should fail when the service account key is not accepted", func() {
+		other, _ := rsa.GenerateKey(rand.Reader, 2048)
+		provider.Credentials, _ = LoadCredentials(write_service_account(dir, other, server.URL+"/token"))
+		_, err := provider.Notify("hello", "", "", "", "", "", "", "a")
+		Expect(err).ShouldNot(BeNil())
+		Expect(server.Requests()).To(BeEmpty())
+	})
+	It("should map error codes to inactive and unregistered tokens", func() {
+		response, err := provider.Notify("hello", "", "", "", "", "", "", "a", testutil.FCM_UNREGISTERED_TOKEN, testutil.FCM_INVALID_TOKEN)
+		Expect(err).Should(BeNil())
+		Expect(response.SentCount).To(Equal(1))
+		Expect(response.InactiveTokens).To(Equal([]string{testutil.FCM_UNREGISTERED_TOKEN}))
+		Expect(response.UnregisteredTokens).To(Equal([]string{testutil.FCM_INVALID_TOKEN}))
+		Expect(response.Body[1]["error"]).To(Equal("UNREGISTERED"))
+	})
+	It("should return other failures as errors", func() {
+		response, err := provider.Notify("hello", "", "", "", "", "", "", "a", testutil.FCM_QUOTA_TOKEN)
+		Expect(err).To(BeAssignableToTypeOf(&Error{}))
+		Expect(err.(*Error).Code).To(Equal("QUOTA_EXCEEDED"))
+		Expect(response.SentCount).To(Equal(1))
+		Expect(response.UnregisteredTokens).To(BeEmpty())
+	})
+	It("should broadcast to the topic of the channel", func() {
+		response, err := provider.Broadcast("user@example.com", "hello", "", "", "", "", "", "")
+		Expect(err).Should(BeNil())
+		Expect(response.Body).To(HaveLen(1))
+		Expect(server.Requests()[0].Message["topic"]).To(Equal("user%40example.com"))
+		Expect(server.Requests()[0].Message).ShouldNot(HaveKey("token"))
+	})
+	It("should send data only messages with a normal priority", func() {
+		provider.Send(&zeropush.Notification{Info: "sync", DeviceTokens: []string{"a"}})
+		message := server.Requests()[0].Message
+		Expect(message).ShouldNot(HaveKey("notification"))
+		Expect(message["data"]).To(Equal(map[string]interface{}{"info": "sync"}))
+		Expect(message["android"].(map[string]interface{})["priority"]).To(Equal("normal"))
+	})
+	It("should send content available to iOS devices as a background push", func() {
+		provider.Notify("", "", "", "sync", "", "1", "", "a")
+		Expect(server.Requests()[0].Message["apns"]).To(Equal(map[string]interface{}{
+			"payload": map[string]interface{}{"aps": map[string]interface{}{"content-available": float64(1)}},
+			"headers": map[string]interface{}{"apns-push-type": "background", "apns-priority": "5"},
+		}))
+
+		provider.Notify("hello", "", "", "", "", "false", "", "a")
+		Expect(server.Requests()[1].Message).ShouldNot(HaveKey("apns"))
+	})
+	It("should refuse relative badges", func() {
+		_, err := provider.Notify("hello", "+1", "", "", "", "", "", "a")
+		Expect(err).ShouldNot(BeNil())
+		Expect(server.TokenCount()).To(Equal(0))
+	})
+})
+
+var _ = Describe("TopicName", func() {
+	It("should keep valid topic characters and escape the rest", func() {
+		Expect(TopicName("news-en_US.daily~1")).To(Equal("news-en_US.daily~1"))
+		Expect(TopicName("a b/c")).To(Equal("a%20b%2Fc"))
+	})
+})
@@ -0,0 +1,174 @@
+package zeropush
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	CAP_EXCEEDED    = "cap_exceeded"
+	CAP_STORE_ERROR = "store_error"
+)
+
+// CounterStore counts sends per key over a sliding window. Acquire must be
+// atomic so concurrent campaigns cannot both take the last slot.
+type CounterStore interface {
+	//records a send at now unless limit sends were recorded within window before it
+	Acquire(key string, now time.Time, window time.Duration, limit int) (bool, error)
+	//forgets a send recorded by Acquire, e.g. because it failed
+	Release(key string, at time.Time) error
+}
+
+// UserLookup maps a device token to its user, so all devices of a user share
+// one cap. An empty ID caps the token on its own.
+type UserLookup interface {
+	UserID(device_token string) (string, error)
+}
+
+type MemoryCounterStore struct {
+	mutex sync.Mutex
+	sends map[string][]time.Time
+}
+
+func NewMemoryCounterStore() *MemoryCounterStore {
+	return &MemoryCounterStore{sends: make(map[string][]time.Time)}
+}
+
+func (s *MemoryCounterStore) Acquire(key string, now time.Time, window time.Duration, limit int) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	start := now.Add(-window)
+	sends := s.sends[key]
+	//sends are kept sorted, drop the ones that left the window
+	first := sort.Search(len(sends), func(i int) bool { return sends[i].After(start) })
+	sends = sends[first:]
+	if len(sends) >= limit {
+		s.sends[key] = sends
+		return false, nil
+	}
+	at := sort.Search(len(sends), func(i int) bool { return sends[i].After(now) })
+	sends = append(sends, time.Time{})
+	copy(sends[at+1:], sends[at:])
+	sends[at] = now
+	s.sends[key] = sends
+	return true, nil
+}
+
+func (s *MemoryCounterStore) Release(key string, at time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sends := s.sends[key]
+	for i, sent_at := range sends {
+		if sent_at.Equal(at) {
+			s.sends[key] = append(sends[:i], sends[i+1:]...)
+			break
+		}
+	}
+	if len(s.sends[key]) == 0 {
+		delete(s.sends, key)
+	}
+	return nil
+}
+
+type SuppressedToken struct {
+	DeviceToken string
+	//the user ID or device token the cap was counted on
+	Key    string
+	Reason string
+}
+
+type CapResult struct {
+	//nil when every token was suppressed
+	Response   *NotifyResponse
+	Sent       []string
+	Suppressed []SuppressedToken
+}
+
+// FrequencyCap sends a notification only to the tokens whose user got fewer
+// than Limit notifications within the last Window. A notification to several
+// devices of one user counts once. Urgent notifications are neither capped
+// nor counted.
+type FrequencyCap struct {
+	Client *Client
+	Store  CounterStore
+	Limit  int
+	Window time.Duration
+	//optional, tokens are capped on their own without it
+	Users UserLookup
+}
+
+func NewFrequencyCap(client *Client, store CounterStore, limit int, window time.Duration) *FrequencyCap {
+	return &FrequencyCap{Client: client, Store: store, Limit: limit, Window: window}
+}
+
+func (f *FrequencyCap) Send(n *Notification) (*CapResult, error) {
+	if n == nil {
+		return nil, errors.New("notification cannot be nil")
+	}
+	if n.Channel != "" {
+		return nil, errors.New("broadcasts cannot be capped, their recipients are unknown")
+	}
+	if n.Urgent {
+		response, err := f.Client.Send(n)
+		return &CapResult{Response: response, Sent: n.DeviceTokens}, err
+	}
+
+	now := time.Now()
+	result := &CapResult{}
+	allowed := make(map[string]bool)
+	var acquired []string
+	for _, token := range n.DeviceTokens {
+		key := f.key(token)
+		ok, seen := allowed[key]
+		if !seen {
+			var err error
+			ok, err = f.Store.Acquire(key, now, f.Window, f.Limit)
+			if err != nil {
+				//the cap is a promise to the user, do not send when it cannot be checked
+				log.Printf("Error checking the frequency cap of %s: %s", key, err)
+				result.Suppressed = append(result.Suppressed, SuppressedToken{DeviceToken: token, Key: key, Reason: CAP_STORE_ERROR})
+				continue
+			}
+			allowed[key] = ok
+			if ok {
+				acquired = append(acquired, key)
+			}
+		}
+		if ok {
+			result.Sent = append(result.Sent, token)
+		} else {
+			result.Suppressed = append(result.Suppressed, SuppressedToken{DeviceToken: token, Key: key, Reason: CAP_EXCEEDED})
+		}
+	}
+	if len(result.Sent) == 0 {
+		return result, nil
+	}
+
+	capped := *n
+	capped.DeviceTokens = result.Sent
+	response, err := f.Client.Send(&capped)
+	result.Response = response
+	if err != nil {
+		for _, key := range acquired {
+			if release_err := f.Store.Release(key, now); release_err != nil {
+				log.Printf("Error releasing the frequency cap of %s: %s", key, release_err)
+			}
+		}
+	}
+	return result, err
+}
+
+func (f *FrequencyCap) key(token string) string {
+	if f.Users != nil {
+		user_id, err := f.Users.UserID(token)
+		if err != nil {
+			log.Printf("Error looking up the user of %s, capping the token on its own: %s", token, err)
+		} else if user_id != "" {
+			return "user:" + user_id
+		}
+	}
+	return "token:" + token
+}
@@ -0,0 +1,124 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+type user_map map[string]string
+
+func (m user_map) UserID(device_token string) (string, error) {
+	return m[device_token], nil
+}
+
+type broken_counter_store struct{}
+
+func (broken_counter_store) Acquire(key string, now time.Time, window time.Duration, limit int) (bool, error) {
+	return false, errors.New("store is down")
+}
+
+func (broken_counter_store) Release(key string, at time.Time) error {
+	return nil
+}
+
+var _ = Describe("FrequencyCap", func() {
+	var (
+		client        *Client
+		server        *testutil.RecordingServer
+		frequency_cap *FrequencyCap
+	)
+	requests := func() [][]string {
+		var tokens [][]string
+		for _, query := range server.Queries("/notify") {
+			tokens = append(tokens, query["device_tokens[]"])
+		}
+		return tokens
+	}
+	campaign := func(tokens ...string) *Notification {
+		return &Notification{Alert: "Sale!", DeviceTokens: tokens}
+	}
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+		frequency_cap = NewFrequencyCap(client, NewMemoryCounterStore(), 2, 24*time.Hour)
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("With tokens capped on their own", func() {
+		It("should filter out tokens over the cap", func() {
+			frequency_cap.Send(campaign("a", "b"))
+			frequency_cap.Send(campaign("a"))
+			result, err := frequency_cap.Send(campaign("a", "b"))
+			Expect(err).Should(BeNil())
+			Expect(result.Sent).To(Equal([]string{"b"}))
+			Expect(result.Suppressed).To(Equal([]SuppressedToken{{DeviceToken: "a", Key: "token:a", Reason: CAP_EXCEEDED}}))
+			Expect(requests()).To(Equal([][]string{{"a", "b"}, {"a"}, {"b"}}))
+		})
+		It("should not send anything when every token is capped", func() {
+			frequency_cap.Limit = 0
+			result, err := frequency_cap.Send(campaign("a"))
+			Expect(err).Should(BeNil())
+			Expect(result.Response).To(BeNil())
+			Expect(requests()).To(BeEmpty())
+		})
+		It("should not count urgent notifications", func() {
+			frequency_cap.Limit = 1
+			frequency_cap.Send(&Notification{Alert: "Your code is 1234", Urgent: true, DeviceTokens: []string{"a"}})
+			result, _ := frequency_cap.Send(campaign("a"))
+			Expect(result.Sent).To(Equal([]string{"a"}))
+		})
+		It("should not count failed sends", func() {
+			frequency_cap.Limit = 1
+			client.AuthToken = testutil.WRONG_AUTH_TOKEN
+			_, err := frequency_cap.Send(campaign("a"))
+			Expect(err).ShouldNot(BeNil())
+			client.AuthToken = testutil.CORRECT_AUTH_TOKEN
+			result, _ := frequency_cap.Send(campaign("a"))
+			Expect(result.Sent).To(Equal([]string{"a"}))
+		})
+		It("should suppress tokens when the store fails", func() {
+			frequency_cap.Store = broken_counter_store{}
+			result, _ := frequency_cap.Send(campaign("a"))
+			Expect(result.Suppressed[0].Reason).To(Equal(CAP_STORE_ERROR))
+			Expect(requests()).To(BeEmpty())
+		})
+		It("should refuse broadcasts", func() {
+			_, err := frequency_cap.Send(&Notification{Alert: "Sale!", Channel: "everyone"})
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+
+	Context("With tokens mapped to users", func() {
+		It("should count a notification to several devices of a user once", func() {
+			frequency_cap.Users = user_map{"phone": "ayse", "tablet": "ayse"}
+			frequency_cap.Send(campaign("phone", "tablet"))
+			result, _ := frequency_cap.Send(campaign("phone", "tablet"))
+			Expect(result.Sent).To(Equal([]string{"phone", "tablet"}))
+			result, _ = frequency_cap.Send(campaign("tablet", "other"))
+			Expect(result.Sent).To(Equal([]string{"other"}))
+			Expect(result.Suppressed[0].Key).To(Equal("user:ayse"))
+		})
+	})
+
+	Context("With a memory store", func() {
+		It("should slide the window", func() {
+			store := NewMemoryCounterStore()
+			start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			Expect(store.Acquire("k", start, time.Hour, 2)).To(BeTrue())
+			Expect(store.Acquire("k", start.Add(30*time.Minute), time.Hour, 2)).To(BeTrue())
+			Expect(store.Acquire("k", start.Add(59*time.Minute), time.Hour, 2)).To(BeFalse())
+			Expect(store.Acquire("k", start.Add(61*time.Minute), time.Hour, 2)).To(BeTrue())
+			Expect(store.Release("k", start.Add(61*time.Minute))).To(Succeed())
+			Expect(store.Acquire("k", start.Add(62*time.Minute), time.Hour, 2)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,273 @@
+package zeropush
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	IDEMPOTENCY_HEADER      = "Idempotency-Key"
+	DEFAULT_IDEMPOTENCY_TTL = 24 * time.Hour
+)
+
+// IdempotencyStore remembers the responses of sends made with an idempotency
+// key, so repeating the send within the TTL returns the original response.
+type IdempotencyStore interface {
+	Get(key string) (*NotifyResponse, bool)
+	Put(key string, response *NotifyResponse, ttl time.Duration)
+}
+
+type idempotency_entry struct {
+	Key       string          `json:"key"`
+	Response  *NotifyResponse `json:"response"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// idempotent_call is a send with an idempotency key that is in flight.
+type idempotent_call struct {
+	id       idempotent_call_id
+	done     chan struct{}
+	response *NotifyResponse
+	err      error
+}
+
+// keys are tracked per store, as clients sharing a store share their keys
+type idempotent_call_id struct {
+	store IdempotencyStore
+	key   string
+}
+
+var (
+	idempotent_calls_mutex sync.Mutex
+	idempotent_calls       = make(map[idempotent_call_id]*idempotent_call)
+)
+
+// begin_idempotent_call returns the call in flight for the key, or registers
+// a new one and reports that the caller has to make it.
+func begin_idempotent_call(store IdempotencyStore, key string) (*idempotent_call, bool) {
+	call := &idempotent_call{done: make(chan struct{})}
+	if !reflect.TypeOf(store).Comparable() {
+		//cannot be a map key, so calls with such a store are not tracked
+		return call, true
+	}
+	call.id = idempotent_call_id{store: store, key: key}
+	idempotent_calls_mutex.Lock()
+	defer idempotent_calls_mutex.Unlock()
+	if in_flight, ok := idempotent_calls[call.id]; ok {
+		return in_flight, false
+	}
+	idempotent_calls[call.id] = call
+	return call, true
+}
+
+func (call *idempotent_call) finish(response *NotifyResponse, err error) {
+	idempotent_calls_mutex.Lock()
+	if idempotent_calls[call.id] == call {
+		delete(idempotent_calls, call.id)
+	}
+	idempotent_calls_mutex.Unlock()
+	call.response, call.err = response, err
+	close(call.done)
+}
+
+// MemoryIdempotencyStore is an LRU of at most capacity responses.
+type MemoryIdempotencyStore struct {
+	capacity int
+	mutex    sync.Mutex
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+func NewMemoryIdempotencyStore(capacity int) *MemoryIdempotencyStore {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &MemoryIdempotencyStore{capacity: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (s *MemoryIdempotencyStore) Get(key string) (*NotifyResponse, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*idempotency_entry)
+	if time.Now().After(entry.ExpiresAt) {
+		s.order.Remove(element)
+		delete(s.entries, key)
+		return nil, false
+	}
+	s.order.MoveToFront(element)
+	return entry.Response, true
+}
+
+func (s *MemoryIdempotencyStore) Put(key string, response *NotifyResponse, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.put(&idempotency_entry{Key: key, Response: response, ExpiresAt: time.Now().Add(ttl)})
+}
+
+func (s *MemoryIdempotencyStore) put(entry *idempotency_entry) {
+	if element, ok := s.entries[entry.Key]; ok {
+		element.Value = entry
+		s.order.MoveToFront(element)
+		return
+	}
+	s.entries[entry.Key] = s.order.PushFront(entry)
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*idempotency_entry).Key)
+	}
+}
+
+// FileIdempotencyStore is a MemoryIdempotencyStore whose entries are also
+// appended to a file and loaded again when it is reopened. Put returns once
+// the entry is synced to disk.
+type FileIdempotencyStore struct {
+	*MemoryIdempotencyStore
+	path    string
+	file    *os.File
+	written int
+}
+
+func OpenFileIdempotencyStore(path string, capacity int) (*FileIdempotencyStore, error) {
+	s := &FileIdempotencyStore{MemoryIdempotencyStore: NewMemoryIdempotencyStore(capacity), path: path}
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		now := time.Now()
+		for scanner.Scan() {
+			entry := &idempotency_entry{}
+			if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+				log.Printf("Error reading the idempotency store, skipping an entry: %s", err)
+				continue
+			}
+			if entry.ExpiresAt.After(now) {
+				s.put(entry)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	//start from a compact file
+	if err := s.rewrite(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileIdempotencyStore) Put(key string, response *NotifyResponse, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := &idempotency_entry{Key: key, Response: response, ExpiresAt: time.Now().Add(ttl)}
+	s.put(entry)
+	if s.written >= 2*s.capacity {
+		if err := s.rewrite(); err != nil {
+			log.Printf("Error compacting the idempotency store: %s", err)
+		}
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		_, err = s.file.Write(append(data, '\n'))
+	}
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		log.Printf("Error writing to the idempotency store: %s", err)
+		return
+	}
+	s.written++
+}
+
+// rewrite replaces the file with the entries in memory; callers hold the mutex.
+func (s *FileIdempotencyStore) rewrite() error {
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	//oldest first so the LRU order survives a reload
+	for element := s.order.Back(); element != nil; element = element.Prev() {
+		if err = encoder.Encode(element.Value); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	if s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	s.written = s.order.Len()
+	return nil
+}
+
+func (s *FileIdempotencyStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// NotifyWithKey is Notify with an idempotency key.
+func (c *Client) NotifyWithKey(key string, alert string, badge string, sound string, info string, expiry string, content_available string, category string, device_tokens ...string) (*NotifyResponse, error) {
+	return c.Send(&Notification{
+		Alert:            alert,
+		Badge:            badge,
+		Sound:            sound,
+		Info:             info,
+		Expiry:           expiry,
+		ContentAvailable: content_available,
+		Category:         category,
+		DeviceTokens:     device_tokens,
+		IdempotencyKey:   key,
+	})
+}
+
+// BroadcastWithKey is Broadcast with an idempotency key.
+func (c *Client) BroadcastWithKey(key string, channel string, alert string, badge string, sound string, info string, expiry string, content_available string, category string) (*BroadcastResponse, error) {
+	response, err := c.Send(&Notification{
+		Channel:          channel,
+		Alert:            alert,
+		Badge:            badge,
+		Sound:            sound,
+		Info:             info,
+		Expiry:           expiry,
+		ContentAvailable: content_available,
+		Category:         category,
+		IdempotencyKey:   key,
+	})
+	if response == nil {
+		return nil, err
+	}
+	return &BroadcastResponse{ZeroResponse: response.ZeroResponse, SentCount: response.SentCount}, err
+}
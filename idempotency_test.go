@@ -0,0 +1,182 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Idempotency", func() {
+	var (
+		client *Client
+		server *testutil.RecordingServer
+	)
+	sent_keys := func() []string {
+		var keys []string
+		for _, request := range server.Requests() {
+			keys = append(keys, request.Header.Get(IDEMPOTENCY_HEADER))
+		}
+		return keys
+	}
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+		client.Idempotency = NewMemoryIdempotencyStore(10)
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("When notifying with a key", func() {
+		It("should send the key as a header", func() {
+			_, err := client.NotifyWithKey("key-1", "alert", "", "", "", "", "", "", "abc")
+			Expect(err).Should(BeNil())
+			Expect(sent_keys()).To(Equal([]string{"key-1"}))
+		})
+		It("should return the original response for a repeated key", func() {
+			first, err := client.NotifyWithKey("key-1", "alert", "", "", "", "", "", "", "abc")
+			Expect(err).Should(BeNil())
+			second, err := client.NotifyWithKey("key-1", "alert", "", "", "", "", "", "", "abc")
+			Expect(err).Should(BeNil())
+			Expect(second).To(Equal(first))
+			Expect(sent_keys()).To(HaveLen(1))
+		})
+		It("should send again once the key has expired", func() {
+			client.IdempotencyTTL = time.Millisecond
+			client.NotifyWithKey("key-1", "alert", "", "", "", "", "", "", "abc")
+			time.Sleep(5 * time.Millisecond)
+			client.NotifyWithKey("key-1", "alert", "", "", "", "", "", "", "abc")
+			Expect(sent_keys()).To(HaveLen(2))
+		})
+		It("should not remember failed sends", func() {
+			client.AuthToken = testutil.WRONG_AUTH_TOKEN
+			_, err := client.NotifyWithKey("key-1", "alert", "", "", "", "", "", "", "abc")
+			Expect(err).ShouldNot(BeNil())
+			client.AuthToken = testutil.CORRECT_AUTH_TOKEN
+			_, err = client.NotifyWithKey("key-1", "alert", "", "", "", "", "", "", "abc")
+			Expect(err).Should(BeNil())
+			Expect(sent_keys()).To(HaveLen(2))
+		})
+	})
+
+	Context("When sending with a key that is in flight", func() {
+		It("should wait for the first send and return its response", func() {
+			entered := make(chan struct{}, 10)
+			release := make(chan struct{})
+			client.Use(func(next Doer) Doer {
+				return DoerFunc(func(req *http.Request) (*http.Response, error) {
+					entered <- struct{}{}
+					<-release
+					return next.Do(req)
+				})
+			})
+			var wg sync.WaitGroup
+			responses := make([]*NotifyResponse, 5)
+			for i := range responses {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					responses[i], _ = client.NotifyWithKey("key-1", "alert", "", "", "", "", "", "", "abc")
+				}(i)
+			}
+			<-entered
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+			wg.Wait()
+			Expect(sent_keys()).To(Equal([]string{"key-1"}))
+			for _, response := range responses {
+				Expect(response).To(BeIdenticalTo(responses[0]))
+			}
+		})
+	})
+
+	Context("When broadcasting with a key", func() {
+		It("should return the original response for a repeated key", func() {
+			first, err := client.BroadcastWithKey("key-2", "foo", "alert", "", "", "", "", "", "")
+			Expect(err).Should(BeNil())
+			second, _ := client.BroadcastWithKey("key-2", "foo", "alert", "", "", "", "", "", "")
+			Expect(second.SentCount).To(Equal(first.SentCount))
+			Expect(sent_keys()).To(Equal([]string{"key-2"}))
+		})
+	})
+
+	Context("Without a key", func() {
+		It("should always send", func() {
+			client.Notify("alert", "", "", "", "", "", "", "abc")
+			client.Notify("alert", "", "", "", "", "", "", "abc")
+			Expect(sent_keys()).To(Equal([]string{"", ""}))
+		})
+	})
+
+	Context("With an in-memory store", func() {
+		It("should evict the least recently used key", func() {
+			store := NewMemoryIdempotencyStore(2)
+			store.Put("a", &NotifyResponse{SentCount: 1}, time.Hour)
+			store.Put("b", &NotifyResponse{SentCount: 2}, time.Hour)
+			store.Get("a")
+			store.Put("c", &NotifyResponse{SentCount: 3}, time.Hour)
+			_, ok := store.Get("b")
+			Expect(ok).To(BeFalse())
+			response, ok := store.Get("a")
+			Expect(ok).To(BeTrue())
+			Expect(response.SentCount).To(Equal(1))
+		})
+	})
+
+	Context("With a file-backed store", func() {
+		var (
+			dir  string
+			path string
+		)
+		BeforeEach(func() {
+			dir, _ = os.MkdirTemp("", "zeropush")
+			path = filepath.Join(dir, "idempotency.log")
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should remember keys across reopening", func() {
+			store, err := OpenFileIdempotencyStore(path, 10)
+			Expect(err).Should(BeNil())
+			client.Idempotency = store
+			first, err := client.NotifyWithKey("key-1", "alert", "", "", "", "", "", "", "abc")
+			Expect(err).Should(BeNil())
+			Expect(store.Close()).To(Succeed())
+
+			store, err = OpenFileIdempotencyStore(path, 10)
+			Expect(err).Should(BeNil())
+			defer store.Close()
+			client.Idempotency = store
+			second, err := client.NotifyWithKey("key-1", "alert", "", "", "", "", "", "", "abc")
+			Expect(err).Should(BeNil())
+			Expect(second.UnregisteredTokens).To(Equal(first.UnregisteredTokens))
+			Expect(sent_keys()).To(HaveLen(1))
+		})
+		It("should stay bounded", func() {
+			store, err := OpenFileIdempotencyStore(path, 2)
+			Expect(err).Should(BeNil())
+			for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+				store.Put(key, &NotifyResponse{}, time.Hour)
+			}
+			Expect(store.Close()).To(Succeed())
+
+			store, err = OpenFileIdempotencyStore(path, 2)
+			Expect(err).Should(BeNil())
+			defer store.Close()
+			_, ok := store.Get("d")
+			Expect(ok).To(BeFalse())
+			_, ok = store.Get("f")
+			Expect(ok).To(BeTrue())
+		})
+	})
+})
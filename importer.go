@@ -0,0 +1,387 @@
+package zeropush
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IMPORT_CSV   = "csv"
+	IMPORT_JSONL = "jsonl"
+
+	IMPORT_OK     = "ok"
+	IMPORT_FAILED = "failed"
+)
+
+// ImportRecord is one device of an import file. In CSV files the columns are
+// token,channels,badge with channels separated by ';'.
+type ImportRecord struct {
+	Line        int      `json:"-"`
+	DeviceToken string   `json:"token"`
+	Channels    []string `json:"channels"`
+	Badge       *int     `json:"badge"`
+	seq         int
+	err         error
+}
+
+type ImportOptions struct {
+	//csv (default) or jsonl
+	Format string
+	//number of rows processed in parallel, defaults to 1
+	Concurrency int
+	//maximum API requests per second, 0 means unlimited
+	RequestsPerSecond float64
+	//the number of completed rows is kept in this file, followed by the rows among them that failed;
+	//the next run skips the completed rows and retries the failed ones
+	CheckpointFile string
+	//how many completed rows between checkpoint writes, defaults to 100
+	CheckpointEvery int
+	//per-row results are written here as CSV (line,token,status,error)
+	Report io.Writer
+}
+
+type ImportResult struct {
+	Line        int
+	DeviceToken string
+	Status      string
+	Error       string
+	seq         int
+}
+
+type ImportSummary struct {
+	Total     int
+	Succeeded int
+	Failed    int
+	Skipped   int
+}
+
+type rate_limiter struct {
+	ticker *time.Ticker
+}
+
+func new_rate_limiter(per_second float64) *rate_limiter {
+	if per_second <= 0 {
+		return &rate_limiter{}
+	}
+	return &rate_limiter{ticker: time.NewTicker(time.Duration(float64(time.Second) / per_second))}
+}
+
+func (l *rate_limiter) wait() {
+	if l.ticker != nil {
+		<-l.ticker.C
+	}
+}
+
+func (l *rate_limiter) stop() {
+	if l.ticker != nil {
+		l.ticker.Stop()
+	}
+}
+
+// checkpoint tracks how many leading rows have all completed and which of
+// them failed, so a resumed import retries those.
+type checkpoint struct {
+	path    string
+	every   int
+	rows    int
+	done    map[int]bool
+	failed  map[int]bool
+	pending int
+}
+
+func load_checkpoint(path string, every int) (*checkpoint, error) {
+	cp := &checkpoint{path: path, every: every, done: make(map[int]bool), failed: make(map[int]bool)}
+	if path == "" {
+		return cp, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cp, nil
+		}
+		return nil, err
+	}
+	lines := strings.Fields(string(data))
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("invalid checkpoint file %s: it is empty", path)
+	}
+	if cp.rows, err = strconv.Atoi(lines[0]); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %s", path, err)
+	}
+	for _, line := range lines[1:] {
+		seq, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checkpoint file %s: %s", path, err)
+		}
+		cp.failed[seq] = true
+	}
+	return cp, nil
+}
+
+// skipped returns the rows a resumed import leaves out: the completed ones
+// that did not fail.
+func (cp *checkpoint) skipped() func(seq int) bool {
+	rows := cp.rows
+	retry := make(map[int]bool, len(cp.failed))
+	for seq := range cp.failed {
+		retry[seq] = true
+	}
+	return func(seq int) bool {
+		return seq <= rows && !retry[seq]
+	}
+}
+
+func (cp *checkpoint) complete(seq int, ok bool) error {
+	if ok {
+		delete(cp.failed, seq)
+	} else {
+		cp.failed[seq] = true
+	}
+	//a retried row already lies within the completed ones
+	if seq > cp.rows {
+		cp.done[seq] = true
+	}
+	cp.pending++
+	for cp.done[cp.rows+1] {
+		delete(cp.done, cp.rows+1)
+		cp.rows++
+	}
+	if cp.pending >= cp.every {
+		return cp.save()
+	}
+	return nil
+}
+
+func (cp *checkpoint) save() error {
+	cp.pending = 0
+	if cp.path == "" {
+		return nil
+	}
+	failed := make([]int, 0, len(cp.failed))
+	for seq := range cp.failed {
+		if seq <= cp.rows {
+			failed = append(failed, seq)
+		}
+	}
+	sort.Ints(failed)
+	lines := []string{strconv.Itoa(cp.rows)}
+	for _, seq := range failed {
+		lines = append(lines, strconv.Itoa(seq))
+	}
+	tmp := cp.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cp.path)
+}
+
+// Import registers the devices read from r, subscribes them to their channels
+// and sets their badges. Rows that fail are reported and do not stop the import;
+// with a checkpoint file they are retried on the next run.
+func (c *Client) Import(r io.Reader, opts ImportOptions) (*ImportSummary, error) {
+	if opts.Format == "" {
+		opts.Format = IMPORT_CSV
+	}
+	if opts.Format != IMPORT_CSV && opts.Format != IMPORT_JSONL {
+		return nil, fmt.Errorf("unknown import format %q", opts.Format)
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	if opts.CheckpointEvery < 1 {
+		opts.CheckpointEvery = 100
+	}
+	cp, err := load_checkpoint(opts.CheckpointFile, opts.CheckpointEvery)
+	if err != nil {
+		return nil, err
+	}
+	var report *csv.Writer
+	if opts.Report != nil {
+		report = csv.NewWriter(opts.Report)
+		report.Write([]string{"line", "token", "status", "error"})
+	}
+
+	limiter := new_rate_limiter(opts.RequestsPerSecond)
+	defer limiter.stop()
+
+	records := make(chan *ImportRecord)
+	results := make(chan ImportResult)
+	summary := &ImportSummary{}
+
+	skip := cp.skipped()
+	var read_err error
+	go func() {
+		defer close(records)
+		read_err = read_import(r, opts.Format, func(record *ImportRecord) {
+			summary.Total++
+			record.seq = summary.Total
+			if skip(record.seq) {
+				summary.Skipped++
+				return
+			}
+			records <- record
+		})
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for record := range records {
+				results <- c.import_record(record, limiter)
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var checkpoint_err error
+	for result := range results {
+		if result.Status == IMPORT_OK {
+			summary.Succeeded++
+		} else {
+			summary.Failed++
+		}
+		if report != nil {
+			report.Write([]string{strconv.Itoa(result.Line), result.DeviceToken, result.Status, result.Error})
+		}
+		if err = cp.complete(result.seq, result.Status == IMPORT_OK); err != nil && checkpoint_err == nil {
+			log.Printf("Error writing the checkpoint: %s", err)
+			checkpoint_err = err
+		}
+	}
+	if err = cp.save(); err != nil && checkpoint_err == nil {
+		checkpoint_err = err
+	}
+	if report != nil {
+		report.Flush()
+		if err = report.Error(); err != nil {
+			return summary, err
+		}
+	}
+	if read_err != nil {
+		return summary, read_err
+	}
+	return summary, checkpoint_err
+}
+
+func (c *Client) import_record(record *ImportRecord, limiter *rate_limiter) ImportResult {
+	result := ImportResult{Line: record.Line, DeviceToken: record.DeviceToken, Status: IMPORT_FAILED, seq: record.seq}
+	if record.err != nil {
+		result.Error = record.err.Error()
+		return result
+	}
+	if record.DeviceToken == "" {
+		result.Error = "device token is empty"
+		return result
+	}
+	if record.Badge != nil && *record.Badge < 0 {
+		result.Error = "badge should be a positive number"
+		return result
+	}
+	limiter.wait()
+	if _, err := c.Register(record.DeviceToken, ""); err != nil {
+		result.Error = "register: " + err.Error()
+		return result
+	}
+	for _, channel := range record.Channels {
+		limiter.wait()
+		if _, err := c.Subscribe(record.DeviceToken, channel); err != nil {
+			result.Error = "subscribe " + channel + ": " + err.Error()
+			return result
+		}
+	}
+	if record.Badge != nil {
+		limiter.wait()
+		if _, err := c.SetBadge(record.DeviceToken, *record.Badge); err != nil {
+			result.Error = "set badge: " + err.Error()
+			return result
+		}
+	}
+	result.Status = IMPORT_OK
+	return result
+}
+
+// read_import streams the records of r to fn. Malformed rows are passed on
+// with their error so they show up as failures in the report.
+func read_import(r io.Reader, format string, fn func(*ImportRecord)) error {
+	if format == IMPORT_JSONL {
+		return read_jsonl(r, fn)
+	}
+	return read_csv(r, fn)
+}
+
+func read_csv(r io.Reader, fn func(*ImportRecord)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	line := 0
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		line++
+		if err != nil {
+			var parse_err *csv.ParseError
+			if errors.As(err, &parse_err) {
+				fn(&ImportRecord{Line: line, err: parse_err.Err})
+				continue
+			}
+			return err
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(fields[0]), "token") {
+			continue
+		}
+		record := &ImportRecord{Line: line, DeviceToken: strings.TrimSpace(fields[0])}
+		if len(fields) > 1 {
+			for _, channel := range strings.Split(fields[1], ";") {
+				if channel = strings.TrimSpace(channel); channel != "" {
+					record.Channels = append(record.Channels, channel)
+				}
+			}
+		}
+		if len(fields) > 2 && strings.TrimSpace(fields[2]) != "" {
+			badge, err := strconv.Atoi(strings.TrimSpace(fields[2]))
+			if err != nil {
+				record.err = fmt.Errorf("invalid badge %q", fields[2])
+			}
+			record.Badge = &badge
+		}
+		fn(record)
+	}
+}
+
+func read_jsonl(r io.Reader, fn func(*ImportRecord)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		record := &ImportRecord{}
+		if err := json.Unmarshal([]byte(text), record); err != nil {
+			record = &ImportRecord{err: err}
+		}
+		record.Line = line
+		fn(record)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,120 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Import", func() {
+	var (
+		client *Client
+		server *testutil.RecordingServer
+	)
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("With a CSV file", func() {
+		It("should register, subscribe and set the badge of every row", func() {
+			input := "token,channels,badge\nabc,foo;bar,3\ndef,,\n"
+			report := &bytes.Buffer{}
+			summary, err := client.Import(strings.NewReader(input), ImportOptions{Report: report})
+			Expect(err).Should(BeNil())
+			Expect(summary.Total).To(Equal(2))
+			Expect(summary.Succeeded).To(Equal(2))
+			Expect(server.Calls()).To(ConsistOf(
+				"POST /register", "POST /subscribe/foo", "POST /subscribe/bar", "POST /set_badge",
+				"POST /register"))
+			Expect(report.String()).To(Equal("line,token,status,error\n2,abc,ok,\n3,def,ok,\n"))
+		})
+		It("should report invalid rows without stopping", func() {
+			input := "abc,,x\n,foo,\ndef,,1\n"
+			report := &bytes.Buffer{}
+			summary, err := client.Import(strings.NewReader(input), ImportOptions{Report: report, Concurrency: 2})
+			Expect(err).Should(BeNil())
+			Expect(summary.Succeeded).To(Equal(1))
+			Expect(summary.Failed).To(Equal(2))
+			Expect(report.String()).To(ContainSubstring(`1,abc,failed,"invalid badge ""x"""`))
+			Expect(report.String()).To(ContainSubstring("2,,failed,device token is empty"))
+		})
+	})
+
+	Context("With a JSONL file", func() {
+		It("should import every line", func() {
+			input := `{"token":"abc","channels":["foo"],"badge":1}` + "\n\n" + `{"token":"def"}` + "\n" + `{broken` + "\n"
+			summary, err := client.Import(strings.NewReader(input), ImportOptions{Format: IMPORT_JSONL})
+			Expect(err).Should(BeNil())
+			Expect(summary.Total).To(Equal(3))
+			Expect(summary.Succeeded).To(Equal(2))
+			Expect(summary.Failed).To(Equal(1))
+			Expect(server.Calls()).To(HaveLen(4))
+		})
+	})
+
+	Context("With an unknown format", func() {
+		It("should come back with an error", func() {
+			_, err := client.Import(strings.NewReader(""), ImportOptions{Format: "xml"})
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+
+	Context("With a checkpoint file", func() {
+		It("should skip the rows completed by a previous run", func() {
+			dir, _ := os.MkdirTemp("", "zeropush")
+			defer os.RemoveAll(dir)
+			checkpoint := filepath.Join(dir, "import.checkpoint")
+			opts := ImportOptions{CheckpointFile: checkpoint, CheckpointEvery: 1, Concurrency: 3}
+
+			summary, err := client.Import(strings.NewReader("a\nb\n"), opts)
+			Expect(err).Should(BeNil())
+			Expect(summary.Succeeded).To(Equal(2))
+			data, _ := os.ReadFile(checkpoint)
+			Expect(string(data)).To(Equal("2\n"))
+
+			server.Reset()
+			summary, err = client.Import(strings.NewReader("a\nb\nc\n"), opts)
+			Expect(err).Should(BeNil())
+			Expect(summary.Skipped).To(Equal(2))
+			Expect(summary.Succeeded).To(Equal(1))
+			Expect(server.Calls()).To(Equal([]string{"POST /register"}))
+			data, _ = os.ReadFile(checkpoint)
+			Expect(string(data)).To(Equal("3\n"))
+		})
+		It("should retry the rows that failed in a previous run", func() {
+			dir, _ := os.MkdirTemp("", "zeropush")
+			defer os.RemoveAll(dir)
+			checkpoint := filepath.Join(dir, "import.checkpoint")
+			opts := ImportOptions{CheckpointFile: checkpoint}
+
+			server.FailWith(503, "/subscribe/foo")
+			summary, err := client.Import(strings.NewReader("a\nb,foo\nc\n"), opts)
+			Expect(err).Should(BeNil())
+			Expect(summary.Failed).To(Equal(1))
+			data, _ := os.ReadFile(checkpoint)
+			Expect(string(data)).To(Equal("3\n2\n"))
+
+			server.FailWith(0)
+			server.Reset()
+			summary, err = client.Import(strings.NewReader("a\nb,foo\nc\n"), opts)
+			Expect(err).Should(BeNil())
+			Expect(summary.Skipped).To(Equal(2))
+			Expect(summary.Succeeded).To(Equal(1))
+			Expect(server.Calls()).To(Equal([]string{"POST /register", "POST /subscribe/foo"}))
+			data, _ = os.ReadFile(checkpoint)
+			Expect(string(data)).To(Equal("3\n"))
+		})
+	})
+})
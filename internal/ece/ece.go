@@ -0,0 +1,139 @@
+// Package ece implements the aes128gcm content encoding of RFC 8188 with the
+// Web Push key derivation of RFC 8291.
+package ece
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// RECORD_SIZE is the record size of encrypted messages. Push services
+// accept 4096 bytes of payload, so a message is always a single record.
+const RECORD_SIZE = 4096
+
+const (
+	salt_length   = 16
+	header_length = salt_length + 4 + 1 + 65
+)
+
+// MAX_PLAINTEXT is the longest plaintext that fits a single record with
+// its delimiter and tag.
+const MAX_PLAINTEXT = RECORD_SIZE - header_length - 16 - 1
+
+// Encrypt encrypts plaintext for the subscription with the p256dh public
+// key and auth secret of a browser PushSubscription.
+func Encrypt(ua_public []byte, auth_secret []byte, plaintext []byte) ([]byte, error) {
+	if len(plaintext) > MAX_PLAINTEXT {
+		return nil, errors.New("payload too large")
+	}
+	ua_key, err := ecdh.P256().NewPublicKey(ua_public)
+	if err != nil {
+		return nil, err
+	}
+	as_private, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, salt_length)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	secret, err := as_private.ECDH(ua_key)
+	if err != nil {
+		return nil, err
+	}
+	as_public := as_private.PublicKey().Bytes()
+	gcm, nonce, err := derive(secret, auth_secret, salt, ua_public, as_public)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, header_length)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, RECORD_SIZE)
+	header = append(header, byte(len(as_public)))
+	header = append(header, as_public...)
+	//0x02 marks the last record, no padding
+	record := append(append([]byte(nil), plaintext...), 2)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+// Decrypt reverses Encrypt with the private key of the subscription, as
+// the browser does.
+func Decrypt(ua_private *ecdh.PrivateKey, auth_secret []byte, body []byte) ([]byte, error) {
+	if len(body) < salt_length+5 {
+		return nil, errors.New("message too short")
+	}
+	salt := body[:salt_length]
+	record_size := binary.BigEndian.Uint32(body[salt_length:])
+	id_length := int(body[salt_length+4])
+	if len(body) < salt_length+5+id_length {
+		return nil, errors.New("message too short")
+	}
+	as_public := body[salt_length+5 : salt_length+5+id_length]
+	ciphertext := body[salt_length+5+id_length:]
+	if uint32(len(ciphertext)) > record_size {
+		return nil, errors.New("only single record messages are supported")
+	}
+	as_key, err := ecdh.P256().NewPublicKey(as_public)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ua_private.ECDH(as_key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, nonce, err := derive(secret, auth_secret, salt, ua_private.PublicKey().Bytes(), as_public)
+	if err != nil {
+		return nil, err
+	}
+	record, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	//strip the padding back to the delimiter
+	for i := len(record) - 1; i >= 0; i-- {
+		switch record[i] {
+		case 0:
+			continue
+		case 2:
+			return record[:i], nil
+		}
+		break
+	}
+	return nil, errors.New("missing last record delimiter")
+}
+
+// derive returns the content encryption cipher and nonce of RFC 8291
+// section 3.4.
+func derive(secret []byte, auth_secret []byte, salt []byte, ua_public []byte, as_public []byte) (cipher.AEAD, []byte, error) {
+	key_info := append([]byte("WebPush: info\x00"), ua_public...)
+	key_info = append(key_info, as_public...)
+	ikm := hkdf(auth_secret, secret, key_info, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, nonce, nil
+}
+
+// hkdf is HKDF-SHA-256 for outputs of at most one hash block.
+func hkdf(salt []byte, ikm []byte, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:length]
+}
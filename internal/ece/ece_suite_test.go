@@ -0,0 +1,13 @@
+package ece_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestECE(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ECE Suite")
+}
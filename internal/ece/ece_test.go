@@ -0,0 +1,60 @@
+package ece_test
+
+import (
+	. "github.com/sinangedik/zeropush/internal/ece"
+
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func decode(s string) []byte {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	Expect(err).Should(BeNil())
+	return data
+}
+
+var _ = Describe("ECE", func() {
+	var (
+		ua_private  *ecdh.PrivateKey
+		auth_secret []byte
+	)
+
+	BeforeEach(func() {
+		ua_private, _ = ecdh.P256().GenerateKey(rand.Reader)
+		auth_secret = make([]byte, 16)
+		rand.Read(auth_secret)
+	})
+
+	It("should decrypt the example of RFC 8291", func() {
+		key, err := ecdh.P256().NewPrivateKey(decode("q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"))
+		Expect(err).Should(BeNil())
+		body := decode("DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN")
+		plaintext, err := Decrypt(key, decode("BTBZMqHH6r4Tts7J_aSIgg"), body)
+		Expect(err).Should(BeNil())
+		Expect(string(plaintext)).To(Equal("When I grow up, I want to be a watermelon"))
+	})
+	It("should round trip a payload", func() {
+		body, err := Encrypt(ua_private.PublicKey().Bytes(), auth_secret, []byte(`{"alert":"hello"}`))
+		Expect(err).Should(BeNil())
+		Expect(body[16:20]).To(Equal([]byte{0, 0, 0x10, 0}))
+		plaintext, err := Decrypt(ua_private, auth_secret, body)
+		Expect(err).Should(BeNil())
+		Expect(string(plaintext)).To(Equal(`{"alert":"hello"}`))
+	})
+	It("should not decrypt with another auth secret", func() {
+		body, _ := Encrypt(ua_private.PublicKey().Bytes(), auth_secret, []byte("hello"))
+		_, err := Decrypt(ua_private, make([]byte, 16), body)
+		Expect(err).ShouldNot(BeNil())
+	})
+	It("should refuse payloads larger than a record", func() {
+		_, err := Encrypt(ua_private.PublicKey().Bytes(), auth_secret, []byte(strings.Repeat("a", MAX_PLAINTEXT+1)))
+		Expect(err).ShouldNot(BeNil())
+		_, err = Encrypt(ua_private.PublicKey().Bytes(), auth_secret, []byte(strings.Repeat("a", MAX_PLAINTEXT)))
+		Expect(err).Should(BeNil())
+	})
+})
@@ -0,0 +1,155 @@
+// Package jws signs the compact JSON Web Tokens used to authenticate with
+// APNs (ES256), Google OAuth2 (RS256) and Web Push VAPID (ES256).
+package jws
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var encoding = base64.RawURLEncoding
+
+// Sign returns header.claims.signature. The "alg" header is set from the
+// key: ES256 for P-256 keys, RS256 for RSA keys.
+func Sign(header map[string]interface{}, claims interface{}, key crypto.Signer) (string, error) {
+	h := map[string]interface{}{"typ": "JWT"}
+	for k, v := range header {
+		h[k] = v
+	}
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		if k.Curve.Params().BitSize != 256 {
+			return "", errors.New("ES256 needs a P-256 key")
+		}
+		h["alg"] = "ES256"
+	case *rsa.PrivateKey:
+		h["alg"] = "RS256"
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+	header_json, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	claims_json, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signing_input := encoding.EncodeToString(header_json) + "." + encoding.EncodeToString(claims_json)
+	digest := sha256.Sum256([]byte(signing_input))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", err
+		}
+		//JWS wants the fixed size r||s, not ASN.1
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case *rsa.PrivateKey:
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	}
+	return signing_input + "." + encoding.EncodeToString(signature), nil
+}
+
+// VerifyES256 checks the signature of an ES256 token, meant for tests and
+// stand-in servers.
+func VerifyES256(token string, key *ecdsa.PublicKey) error {
+	signing_input, signature, err := split(token)
+	if err != nil {
+		return err
+	}
+	if len(signature) != 64 {
+		return errors.New("bad ES256 signature length")
+	}
+	digest := sha256.Sum256([]byte(signing_input))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		return errors.New("bad ES256 signature")
+	}
+	return nil
+}
+
+// VerifyRS256 checks the signature of an RS256 token.
+func VerifyRS256(token string, key *rsa.PublicKey) error {
+	signing_input, signature, err := split(token)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(signing_input))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+}
+
+// Claims decodes the claims of a token without checking the signature.
+func Claims(token string, claims interface{}) error {
+	parts, err := split_parts(token)
+	if err != nil {
+		return err
+	}
+	data, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, claims)
+}
+
+func split_parts(token string) ([]string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	return parts, nil
+}
+
+// split returns the signing input and the signature of a token.
+func split(token string) (string, []byte, error) {
+	parts, err := split_parts(token)
+	if err != nil {
+		return "", nil, err
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, err
+	}
+	return parts[0] + "." + parts[1], signature, nil
+}
+
+// ParsePrivateKey reads a PEM encoded PKCS#8, PKCS#1 or SEC 1 private key,
+// such as an APNs .p8 file or the private_key of a Google service account.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format")
+}
@@ -0,0 +1,13 @@
+package jws_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestJWS(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "JWS Suite")
+}
@@ -0,0 +1,59 @@
+package jws_test
+
+import (
+	. "github.com/sinangedik/zeropush/internal/jws"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JWS", func() {
+	claims := map[string]interface{}{"iss": "team"}
+
+	It("should sign and verify ES256 tokens", func() {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		token, err := Sign(map[string]interface{}{"kid": "abc"}, claims, key)
+		Expect(err).Should(BeNil())
+		Expect(VerifyES256(token, &key.PublicKey)).To(Succeed())
+
+		other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(VerifyES256(token, &other.PublicKey)).ShouldNot(Succeed())
+
+		var decoded map[string]interface{}
+		Expect(Claims(token, &decoded)).To(Succeed())
+		Expect(decoded["iss"]).To(Equal("team"))
+	})
+	It("should sign and verify RS256 tokens", func() {
+		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		token, err := Sign(nil, claims, key)
+		Expect(err).Should(BeNil())
+		Expect(VerifyRS256(token, &key.PublicKey)).To(Succeed())
+	})
+	It("should refuse keys of other curves", func() {
+		key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		_, err := Sign(nil, claims, key)
+		Expect(err).ShouldNot(BeNil())
+	})
+	It("should parse PKCS#8 and PKCS#1 keys", func() {
+		ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, _ := x509.MarshalPKCS8PrivateKey(ec)
+		key, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+		Expect(err).Should(BeNil())
+		Expect(key).To(BeAssignableToTypeOf(&ecdsa.PrivateKey{}))
+
+		rsa_key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		key, err = ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsa_key)}))
+		Expect(err).Should(BeNil())
+		Expect(key).To(BeAssignableToTypeOf(&rsa.PrivateKey{}))
+
+		_, err = ParsePrivateKey([]byte("nonsense"))
+		Expect(err).ShouldNot(BeNil())
+	})
+})
@@ -0,0 +1,62 @@
+package zeropush
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const QUOTA_REMAINING_HEADER = "X-Device-Quota-Remaining"
+
+// Metrics receives measurements from the client, see the metrics/prometheus
+// and metrics/expvar packages. Endpoints are the first path segment of the
+// API call, e.g. "/notify" or "/devices", so device tokens and channels do
+// not end up in labels.
+type Metrics interface {
+	//an API call and its HTTP status, 0 when no response came back
+	ObserveRequest(method string, endpoint string, status int, duration time.Duration)
+	//a send retried by the Outbox, or an API call retried by the Retry middleware
+	ObserveRetry(endpoint string)
+	//the outcome of a notify or broadcast
+	ObserveTokens(endpoint string, sent int, inactive int, unregistered int)
+	//the device quota left, from the X-Device-Quota-Remaining header
+	ObserveQuota(remaining int)
+}
+
+func endpoint_name(path string) string {
+	return "/" + strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+}
+
+// WithMetrics observes every request that reaches it, so placed inside Retry
+// it sees each attempt and reports the retries with ObserveRetry. The client
+// adds it innermost when Metrics is set.
+func WithMetrics(metrics Metrics) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(req *http.Request) (*http.Response, error) {
+			endpoint := endpoint_name(req.URL.Path)
+			if retry_attempt(req) > 1 {
+				metrics.ObserveRetry(endpoint)
+			}
+			started := time.Now()
+			res, err := next.Do(req)
+			if err != nil {
+				metrics.ObserveRequest(req.Method, endpoint, 0, time.Since(started))
+				return res, err
+			}
+			metrics.ObserveRequest(req.Method, endpoint, res.StatusCode, time.Since(started))
+			if values := res.Header[QUOTA_REMAINING_HEADER]; len(values) > 0 {
+				if remaining, err := strconv.Atoi(values[0]); err == nil {
+					metrics.ObserveQuota(remaining)
+				}
+			}
+			return res, nil
+		})
+	}
+}
+
+func (c *Client) observe_tokens(endpoint string, sent int, inactive int, unregistered int) {
+	if c.Metrics != nil {
+		c.Metrics.ObserveTokens(endpoint, sent, inactive, unregistered)
+	}
+}
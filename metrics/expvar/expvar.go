@@ -0,0 +1,68 @@
+// Package expvar publishes the client metrics with the standard expvar
+// package, served at /debug/vars.
+package expvar
+
+import (
+	"expvar"
+	"strconv"
+	"time"
+
+	"github.com/sinangedik/zeropush"
+)
+
+// Metrics implements zeropush.Metrics on an expvar.Map:
+//
+//	requests          {"POST /notify 200": 12, ...}
+//	request_seconds   {"POST /notify": 1.52, ...}, the total time per endpoint
+//	retries           {"/notify": 2, ...}
+//	tokens            {"/notify sent": 40, "/notify inactive": 1, ...}
+//	quota_remaining   the device quota left
+type Metrics struct {
+	Map *expvar.Map
+
+	requests        *expvar.Map
+	request_seconds *expvar.Map
+	retries         *expvar.Map
+	tokens          *expvar.Map
+	quota_remaining *expvar.Int
+}
+
+var _ zeropush.Metrics = (*Metrics)(nil)
+
+// New publishes the metrics under name, which like any expvar name can only
+// be published once.
+func New(name string) *Metrics {
+	m := &Metrics{
+		Map:             expvar.NewMap(name),
+		requests:        new(expvar.Map).Init(),
+		request_seconds: new(expvar.Map).Init(),
+		retries:         new(expvar.Map).Init(),
+		tokens:          new(expvar.Map).Init(),
+		quota_remaining: new(expvar.Int),
+	}
+	m.Map.Set("requests", m.requests)
+	m.Map.Set("request_seconds", m.request_seconds)
+	m.Map.Set("retries", m.retries)
+	m.Map.Set("tokens", m.tokens)
+	m.Map.Set("quota_remaining", m.quota_remaining)
+	return m
+}
+
+func (m *Metrics) ObserveRequest(method string, endpoint string, status int, duration time.Duration) {
+	m.requests.Add(method+" "+endpoint+" "+strconv.Itoa(status), 1)
+	m.request_seconds.AddFloat(method+" "+endpoint, duration.Seconds())
+}
+
+func (m *Metrics) ObserveRetry(endpoint string) {
+	m.retries.Add(endpoint, 1)
+}
+
+func (m *Metrics) ObserveTokens(endpoint string, sent int, inactive int, unregistered int) {
+	m.tokens.Add(endpoint+" sent", int64(sent))
+	m.tokens.Add(endpoint+" inactive", int64(inactive))
+	m.tokens.Add(endpoint+" unregistered", int64(unregistered))
+}
+
+func (m *Metrics) ObserveQuota(remaining int) {
+	m.quota_remaining.Set(int64(remaining))
+}
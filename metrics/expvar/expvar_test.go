@@ -0,0 +1,31 @@
+package expvar_test
+
+import (
+	. "github.com/sinangedik/zeropush/metrics/expvar"
+
+	"encoding/json"
+	"expvar"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	It("should publish the observations", func() {
+		metrics := New("zeropush")
+		metrics.ObserveRequest("POST", "/notify", 200, 500*time.Millisecond)
+		metrics.ObserveRequest("POST", "/notify", 200, 250*time.Millisecond)
+		metrics.ObserveRetry("/notify")
+		metrics.ObserveTokens("/notify", 3, 1, 0)
+		metrics.ObserveQuota(42)
+
+		var published map[string]interface{}
+		Expect(json.Unmarshal([]byte(expvar.Get("zeropush").String()), &published)).To(Succeed())
+		Expect(published["requests"]).To(Equal(map[string]interface{}{"POST /notify 200": 2.0}))
+		Expect(published["request_seconds"]).To(Equal(map[string]interface{}{"POST /notify": 0.75}))
+		Expect(published["retries"]).To(Equal(map[string]interface{}{"/notify": 1.0}))
+		Expect(published["tokens"]).To(Equal(map[string]interface{}{"/notify sent": 3.0, "/notify inactive": 1.0, "/notify unregistered": 0.0}))
+		Expect(published["quota_remaining"]).To(Equal(42.0))
+	})
+})
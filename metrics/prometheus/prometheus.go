@@ -0,0 +1,93 @@
+// Package prometheus exposes the client metrics as a Prometheus collector.
+package prometheus
+
+import (
+	"strconv"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/sinangedik/zeropush"
+)
+
+// Collector implements zeropush.Metrics. Register it and set it as the
+// Metrics of the clients to watch:
+//
+//	collector := prometheus.NewCollector("zeropush")
+//	prom.MustRegister(collector)
+//	client.Metrics = collector
+type Collector struct {
+	requests *prom.CounterVec
+	latency  *prom.HistogramVec
+	retries  *prom.CounterVec
+	tokens   *prom.CounterVec
+	quota    prom.Gauge
+}
+
+var _ zeropush.Metrics = (*Collector)(nil)
+var _ prom.Collector = (*Collector)(nil)
+
+func NewCollector(namespace string) *Collector {
+	return &Collector{
+		requests: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "API calls by method, endpoint and HTTP status, 0 when no response came back.",
+		}, []string{"method", "endpoint", "status"}),
+		latency: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of API calls.",
+			Buckets:   prom.DefBuckets,
+		}, []string{"method", "endpoint"}),
+		retries: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "retries_total",
+			Help:      "Sends retried by the outbox and API calls retried by the Retry middleware.",
+		}, []string{"endpoint"}),
+		tokens: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "tokens_total",
+			Help:      "Device tokens of notify and broadcast responses by result: sent, inactive or unregistered.",
+		}, []string{"endpoint", "result"}),
+		quota: prom.NewGauge(prom.GaugeOpts{
+			Namespace: namespace,
+			Name:      "device_quota_remaining",
+			Help:      "The device quota left, as last reported by the API.",
+		}),
+	}
+}
+
+func (c *Collector) ObserveRequest(method string, endpoint string, status int, duration time.Duration) {
+	c.requests.WithLabelValues(method, endpoint, strconv.Itoa(status)).Inc()
+	c.latency.WithLabelValues(method, endpoint).Observe(duration.Seconds())
+}
+
+func (c *Collector) ObserveRetry(endpoint string) {
+	c.retries.WithLabelValues(endpoint).Inc()
+}
+
+func (c *Collector) ObserveTokens(endpoint string, sent int, inactive int, unregistered int) {
+	c.tokens.WithLabelValues(endpoint, "sent").Add(float64(sent))
+	c.tokens.WithLabelValues(endpoint, "inactive").Add(float64(inactive))
+	c.tokens.WithLabelValues(endpoint, "unregistered").Add(float64(unregistered))
+}
+
+func (c *Collector) ObserveQuota(remaining int) {
+	c.quota.Set(float64(remaining))
+}
+
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	c.requests.Describe(ch)
+	c.latency.Describe(ch)
+	c.retries.Describe(ch)
+	c.tokens.Describe(ch)
+	c.quota.Describe(ch)
+}
+
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	c.requests.Collect(ch)
+	c.latency.Collect(ch)
+	c.retries.Collect(ch)
+	c.tokens.Collect(ch)
+	c.quota.Collect(ch)
+}
@@ -0,0 +1,73 @@
+package prometheus_test
+
+import (
+	. "github.com/sinangedik/zeropush/metrics/prometheus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/sinangedik/zeropush"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Collector", func() {
+	var (
+		collector *Collector
+		registry  *prom.Registry
+		server    *testutil.RecordingServer
+		client    *zeropush.Client
+	)
+	// value returns the value of the metric with the given labels
+	value := func(name string, labels map[string]string) float64 {
+		families, err := registry.Gather()
+		Expect(err).Should(BeNil())
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+		metrics:
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if labels[label.GetName()] != label.GetValue() {
+						continue metrics
+					}
+				}
+				switch {
+				case metric.Counter != nil:
+					return metric.GetCounter().GetValue()
+				case metric.Gauge != nil:
+					return metric.GetGauge().GetValue()
+				case metric.Histogram != nil:
+					return float64(metric.GetHistogram().GetSampleCount())
+				}
+			}
+		}
+		return -1
+	}
+
+	BeforeEach(func() {
+		collector = NewCollector("zeropush")
+		registry = prom.NewRegistry()
+		registry.MustRegister(collector)
+		server = testutil.NewRecordingServer()
+		server.SetHeader(zeropush.QUOTA_REMAINING_HEADER, "42")
+		client = server.Client()
+		client.Metrics = collector
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should count requests, tokens and the quota", func() {
+		client.Notify("hello", "", "", "", "", "", "", "abc")
+		client.Notify("hello", "", "", "", "", "", "", "abc")
+		Expect(value("zeropush_requests_total", map[string]string{"method": "POST", "endpoint": "/notify", "status": "200"})).To(Equal(2.0))
+		Expect(value("zeropush_request_duration_seconds", map[string]string{"method": "POST", "endpoint": "/notify"})).To(Equal(2.0))
+		Expect(value("zeropush_tokens_total", map[string]string{"endpoint": "/notify", "result": "unregistered"})).To(Equal(4.0))
+		Expect(value("zeropush_device_quota_remaining", nil)).To(Equal(42.0))
+	})
+	It("should count retries", func() {
+		collector.ObserveRetry("/notify")
+		Expect(value("zeropush_retries_total", map[string]string{"endpoint": "/notify"})).To(Equal(1.0))
+	})
+})
@@ -0,0 +1,116 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+// recording_metrics keeps every observation as a string
+type recording_metrics struct {
+	mutex        sync.Mutex
+	observations []string
+}
+
+func (m *recording_metrics) record(format string, args ...interface{}) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.observations = append(m.observations, fmt.Sprintf(format, args...))
+}
+
+func (m *recording_metrics) ObserveRequest(method string, endpoint string, status int, duration time.Duration) {
+	m.record("request %s %s %d", method, endpoint, status)
+}
+
+func (m *recording_metrics) ObserveRetry(endpoint string) {
+	m.record("retry %s", endpoint)
+}
+
+func (m *recording_metrics) ObserveTokens(endpoint string, sent int, inactive int, unregistered int) {
+	m.record("tokens %s %d/%d/%d", endpoint, sent, inactive, unregistered)
+}
+
+func (m *recording_metrics) ObserveQuota(remaining int) {
+	m.record("quota %d", remaining)
+}
+
+func (m *recording_metrics) Observations() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string(nil), m.observations...)
+}
+
+var _ = Describe("Metrics", func() {
+	var (
+		client  *Client
+		server  *testutil.RecordingServer
+		metrics *recording_metrics
+	)
+
+	BeforeEach(func() {
+		metrics = &recording_metrics{}
+		server = testutil.NewRecordingServer()
+		server.SetHeader(QUOTA_REMAINING_HEADER, "42")
+		client = server.Client()
+		client.Metrics = metrics
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should observe requests, tokens and the quota", func() {
+		_, err := client.Notify("hello", "", "", "", "", "", "", "abc")
+		Expect(err).Should(BeNil())
+		Expect(metrics.Observations()).To(Equal([]string{
+			"request POST /notify 200",
+			"quota 42",
+			"tokens /notify 0/0/2",
+		}))
+	})
+	It("should leave device tokens and channels out of the endpoint", func() {
+		client.GetDevice("abc")
+		client.Broadcast("news", "hello", "", "", "", "", "", "")
+		Expect(metrics.Observations()).To(ContainElement("request GET /devices 200"))
+		Expect(metrics.Observations()).To(ContainElement("request POST /broadcast 200"))
+	})
+	It("should observe failed requests", func() {
+		server.FailNext(1)
+		client.Notify("hello", "", "", "", "", "", "", "abc")
+		Expect(metrics.Observations()).To(Equal([]string{"request POST /notify 503"}))
+
+		server.Close()
+		client.Notify("hello", "", "", "", "", "", "", "abc")
+		Expect(metrics.Observations()[1]).To(Equal("request POST /notify 0"))
+	})
+	It("should observe retries of the outbox", func() {
+		dir, _ := os.MkdirTemp("", "zeropush")
+		defer os.RemoveAll(dir)
+		outbox, err := OpenOutbox(filepath.Join(dir, "outbox.log"), client)
+		Expect(err).Should(BeNil())
+		defer outbox.Close()
+		outbox.Backoff = func(attempt int) time.Duration { return time.Millisecond }
+		server.FailNext(2)
+		outbox.Start()
+		id, _ := outbox.Enqueue(&Notification{Alert: "hello", DeviceTokens: []string{"abc"}})
+		Eventually(func() string {
+			job, _ := outbox.Status(id)
+			return job.Status
+		}).Should(Equal(JOB_DONE))
+		Expect(metrics.Observations()).To(ContainElement("retry /notify"))
+		retries := 0
+		for _, observation := range metrics.Observations() {
+			if observation == "retry /notify" {
+				retries++
+			}
+		}
+		Expect(retries).To(Equal(2))
+	})
+})
@@ -0,0 +1,124 @@
+package zeropush
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Doer makes an HTTP request, like *http.Client.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type DoerFunc func(req *http.Request) (*http.Response, error)
+
+func (f DoerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Middleware wraps the Doer of the API calls, e.g. to add headers, sign or
+// log requests.
+type Middleware func(next Doer) Doer
+
+// Use adds middleware around the API calls, the first one added outermost.
+// Middleware sees the request after the authorization header was set. The
+// client's Tracer, Breaker and Metrics come after it, in that order, as
+// WithTracer, WithBreaker and WithMetrics, so each attempt of Retry gets its
+// own span, breaker permit and observation; leave those fields unset and Use
+// the functions to place them elsewhere. Call Use before the client is shared.
+func (c *Client) Use(middleware ...Middleware) {
+	c.middleware = append(append([]Middleware(nil), c.middleware...), middleware...)
+}
+
+func (c *Client) doer() Doer {
+	var doer Doer = c.HTTPClient
+	if c.HTTPClient == nil {
+		doer = default_http_client
+	}
+	middleware := c.middleware
+	if c.Tracer != nil {
+		middleware = append(middleware[:len(middleware):len(middleware)], WithTracer(c.Tracer))
+	}
+	if c.Breaker != nil {
+		middleware = append(middleware[:len(middleware):len(middleware)], WithBreaker(c.Breaker))
+	}
+	if c.Metrics != nil {
+		middleware = append(middleware[:len(middleware):len(middleware)], WithMetrics(c.Metrics))
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		doer = middleware[i](doer)
+	}
+	return doer
+}
+
+// WithHeader sets a header on every API call.
+func WithHeader(key string, value string) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(req *http.Request) (*http.Response, error) {
+			req.Header.Set(key, value)
+			return next.Do(req)
+		})
+	}
+}
+
+// Logging logs each API call with its status and duration, leaving out the
+// query, which has the device tokens.
+func Logging(logger *log.Logger) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(req *http.Request) (*http.Response, error) {
+			started := time.Now()
+			res, err := next.Do(req)
+			if err != nil {
+				logger.Printf("%s %s failed after %s: %s", req.Method, req.URL.Path, time.Since(started), err)
+			} else {
+				logger.Printf("%s %s %d in %s", req.Method, req.URL.Path, res.StatusCode, time.Since(started))
+			}
+			return res, err
+		})
+	}
+}
+
+// Retry retries API calls that failed in transport or with a 5xx status up
+// to attempts times in all, waiting backoff(retry) in between. Calls refused
+// by an open circuit are not retried. Send with an idempotency key so a
+// retried notify is not delivered twice.
+func Retry(attempts int, backoff func(retry int) time.Duration) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(req *http.Request) (*http.Response, error) {
+			var res *http.Response
+			var err error
+			for attempt := 1; ; attempt++ {
+				res, err = next.Do(req.WithContext(context.WithValue(req.Context(), retry_attempt_key{}, attempt)))
+				if attempt >= attempts || (err == nil && res.StatusCode < 500) || errors.Is(err, ErrCircuitOpen) || req.Body != nil && req.GetBody == nil {
+					return res, err
+				}
+				if err == nil {
+					res.Body.Close()
+				}
+				select {
+				case <-req.Context().Done():
+					return nil, req.Context().Err()
+				case <-time.After(backoff(attempt)):
+				}
+				if req.GetBody != nil {
+					if req.Body, err = req.GetBody(); err != nil {
+						return nil, err
+					}
+				}
+			}
+		})
+	}
+}
+
+type retry_attempt_key struct{}
+
+// retry_attempt returns which attempt of Retry req is, 1 outside of Retry.
+func retry_attempt(req *http.Request) int {
+	if attempt, ok := req.Context().Value(retry_attempt_key{}).(int); ok {
+		return attempt
+	}
+	return 1
+}
@@ -0,0 +1,152 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Middleware", func() {
+	var (
+		client *Client
+		server *testutil.RecordingServer
+	)
+	no_backoff := func(retry int) time.Duration { return 0 }
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should run the middleware in the order it was added", func() {
+		var order []string
+		trace := func(name string) Middleware {
+			return func(next Doer) Doer {
+				return DoerFunc(func(req *http.Request) (*http.Response, error) {
+					order = append(order, name+" "+req.Header.Get("X-Signature"))
+					res, err := next.Do(req)
+					order = append(order, name+" done")
+					return res, err
+				})
+			}
+		}
+		sign := func(next Doer) Doer {
+			return DoerFunc(func(req *http.Request) (*http.Response, error) {
+				req.Header.Set("X-Signature", "signed "+req.Header.Get("Authorization"))
+				return next.Do(req)
+			})
+		}
+		client.Use(trace("outer"), sign, trace("inner"))
+		_, err := client.VerifyCredentials()
+		Expect(err).Should(BeNil())
+		Expect(order).To(Equal([]string{"outer ", "inner signed Token token=\"" + testutil.CORRECT_AUTH_TOKEN + "\"", "inner done", "outer done"}))
+		Expect(server.Requests()[0].Header.Get("X-Signature")).ShouldNot(BeEmpty())
+	})
+	It("should set headers", func() {
+		client.Use(WithHeader("X-Request-Source", "billing"))
+		client.VerifyCredentials()
+		Expect(server.Requests()[0].Header.Get("X-Request-Source")).To(Equal("billing"))
+	})
+	It("should log calls without their query", func() {
+		var buffer bytes.Buffer
+		client.Use(Logging(log.New(&buffer, "", 0)))
+		client.Notify("hello", "", "", "", "", "", "", "secret_token")
+		Expect(buffer.String()).To(MatchRegexp(`^POST /notify 200 in \S+\n$`))
+	})
+	It("should retry server errors", func() {
+		client.Use(Retry(3, no_backoff))
+		server.FailNext(2)
+		_, err := client.VerifyCredentials()
+		Expect(err).Should(BeNil())
+		Expect(server.Requests()).To(HaveLen(3))
+
+		server.FailNext(3)
+		_, err = client.VerifyCredentials()
+		Expect(err).To(MatchError("service unavailable"))
+		Expect(server.Requests()).To(HaveLen(6))
+	})
+	It("should not retry client errors", func() {
+		client.Use(Retry(3, no_backoff))
+		client.AuthToken = "wrong"
+		client.VerifyCredentials()
+		Expect(server.Requests()).To(HaveLen(1))
+	})
+	It("should be seen by the metrics once per attempt", func() {
+		metrics := &recording_metrics{}
+		client.Metrics = metrics
+		client.Use(Retry(2, no_backoff))
+		server.FailNext(1)
+		client.VerifyCredentials()
+		Expect(metrics.Observations()).To(Equal([]string{
+			"request GET /verify_credentials 503",
+			"retry /verify_credentials",
+			"request GET /verify_credentials 200",
+		}))
+	})
+	It("should trace each attempt in a span of its own", func() {
+		tracer := &recording_tracer{}
+		client.Tracer = tracer
+		client.Use(Retry(3, no_backoff))
+		server.FailNext(2)
+		_, err := client.VerifyCredentials()
+		Expect(err).Should(BeNil())
+		spans := tracer.Spans()
+		Expect(spans).To(HaveLen(3))
+		Expect(spans[0].events).To(BeEmpty())
+		Expect(spans[0].errors).To(HaveLen(1))
+		Expect(spans[1].events).To(Equal([]string{"retry"}))
+		Expect(spans[2].events).To(Equal([]string{"retry"}))
+		Expect(spans[2].attributes["zeropush.attempt"]).To(Equal(3))
+		Expect(spans[2].errors).To(BeEmpty())
+	})
+	It("should take a breaker permit for each attempt", func() {
+		breaker := NewCircuitBreaker(0.5, time.Hour)
+		breaker.MinRequests = 2
+		client.Breaker = breaker
+		client.Use(Retry(5, no_backoff))
+		server.FailWith(503)
+		_, err := client.VerifyCredentials()
+		Expect(errors.Is(err, ErrCircuitOpen)).To(BeTrue())
+		Expect(server.Requests()).To(HaveLen(2))
+	})
+	It("should compose metrics, tracing and the breaker as middleware", func() {
+		metrics := &recording_metrics{}
+		tracer := &recording_tracer{}
+		client.Use(WithTracer(tracer), WithMetrics(metrics), Retry(2, no_backoff), WithBreaker(NewCircuitBreaker(0.5, time.Hour)))
+		server.FailNext(1)
+		_, err := client.VerifyCredentials()
+		Expect(err).Should(BeNil())
+		Expect(tracer.Spans()).To(HaveLen(1))
+		Expect(metrics.Observations()).To(Equal([]string{"request GET /verify_credentials 200"}))
+		Expect(server.Requests()).To(HaveLen(2))
+	})
+	It("should send through the HTTP client", func() {
+		var used int32
+		transport := http.DefaultTransport
+		client.HTTPClient = &http.Client{Transport: round_tripper(func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&used, 1)
+			return transport.RoundTrip(req)
+		})}
+		client.VerifyCredentials()
+		Expect(atomic.LoadInt32(&used)).To(Equal(int32(1)))
+	})
+})
+
+// round_tripper adapts a function to http.RoundTripper
+type round_tripper func(req *http.Request) (*http.Response, error)
+
+func (f round_tripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,118 @@
+package zeropush
+
+import (
+	"errors"
+	"net/url"
+)
+
+// Notification is the payload of a Notify call, or of a Broadcast call when
+// Channel is set.
+type Notification struct {
+	Alert            string   `json:"alert,omitempty"`
+	Badge            string   `json:"badge,omitempty"`
+	Sound            string   `json:"sound,omitempty"`
+	Info             string   `json:"info,omitempty"`
+	Expiry           string   `json:"expiry,omitempty"`
+	ContentAvailable string   `json:"content_available,omitempty"`
+	Category         string   `json:"category,omitempty"`
+	DeviceTokens     []string `json:"device_tokens,omitempty"`
+	Channel          string   `json:"channel,omitempty"`
+	//sent as the Idempotency-Key header, see Client.Idempotency
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	//bypasses delivery policies such as QuietHours and FrequencyCap, never sent to the API
+	Urgent bool `json:"urgent,omitempty"`
+}
+
+// validate runs the checks of Notify and Broadcast up front, so a job that
+// can never be sent is refused instead of retried.
+func (n *Notification) validate() error {
+	if n.Channel == "" && len(n.DeviceTokens) == 0 {
+		return errors.New("device tokens cannot be empty")
+	}
+	if n.Alert == "" && n.Info == "" {
+		return errors.New("Either alert of info must be set")
+	}
+	return nil
+}
+
+func (n *Notification) values() url.Values {
+	data := url.Values{}
+	if n.Alert != "" {
+		data.Add("alert", n.Alert)
+	}
+	if n.Badge != "" {
+		data.Add("badge", n.Badge)
+	}
+	if n.Sound != "" {
+		data.Add("sound", n.Sound)
+	}
+	if n.Info != "" {
+		data.Add("info", n.Info)
+	}
+	if n.Expiry != "" {
+		data.Add("expiry", n.Expiry)
+	}
+	if n.Category != "" {
+		data.Add("category", n.Category)
+	}
+	if n.ContentAvailable != "" {
+		data.Add("content_available", n.ContentAvailable)
+	}
+	return data
+}
+
+// Send notifies the notification's device tokens, or broadcasts it to its
+// channel. Broadcasts only fill in SentCount of the response.
+// A repeated IdempotencyKey returns the stored response of the first send
+// without sending again, if the client has an Idempotency store. A send
+// whose key is already in flight waits for the first one and returns its
+// response, or sends itself if the first one failed.
+func (c *Client) Send(n *Notification) (*NotifyResponse, error) {
+	key := n.IdempotencyKey
+	if key == "" || c.Idempotency == nil {
+		return c.send(n)
+	}
+	for {
+		if response, ok := c.Idempotency.Get(key); ok {
+			return response, nil
+		}
+		call, first := begin_idempotent_call(c.Idempotency, key)
+		if !first {
+			select {
+			case <-call.done:
+			case <-c.context().Done():
+				return nil, c.context().Err()
+			}
+			if call.err == nil {
+				return call.response, nil
+			}
+			continue
+		}
+		//the first call may have finished between Get and begin_idempotent_call
+		if response, ok := c.Idempotency.Get(key); ok {
+			call.finish(response, nil)
+			return response, nil
+		}
+		response, err := c.send(n)
+		if err == nil {
+			ttl := c.IdempotencyTTL
+			if ttl <= 0 {
+				ttl = DEFAULT_IDEMPOTENCY_TTL
+			}
+			c.Idempotency.Put(key, response, ttl)
+		}
+		call.finish(response, err)
+		return response, err
+	}
+}
+
+func (c *Client) send(n *Notification) (*NotifyResponse, error) {
+	if n.Channel == "" {
+		return c.notify(n)
+	}
+	response, err := c.broadcast(n)
+	if response == nil {
+		return nil, err
+	}
+	return &NotifyResponse{ZeroResponse: response.ZeroResponse, SentCount: response.SentCount}, err
+}
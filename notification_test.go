@@ -0,0 +1,85 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Send", func() {
+	var (
+		client *Client
+		server *testutil.RecordingServer
+	)
+	last := func() testutil.RecordedRequest {
+		requests := server.Requests()
+		return requests[len(requests)-1]
+	}
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("With device tokens", func() {
+		It("should notify the devices", func() {
+			res, err := client.Send(&Notification{Alert: "hi", Sound: "default", DeviceTokens: []string{"a", "b"}})
+			Expect(err).Should(BeNil())
+			Expect(last().Path).To(Equal("/notify"))
+			Expect(last().Query["device_tokens[]"]).To(Equal([]string{"a", "b"}))
+			Expect(last().Query.Get("sound")).To(Equal("default"))
+			Expect(res.UnregisteredTokens).To(HaveLen(2))
+		})
+	})
+	Context("With a channel", func() {
+		It("should broadcast with the whole payload", func() {
+			res, err := client.Send(&Notification{Alert: "hi", Sound: "default", Category: "news", Channel: "foo"})
+			Expect(err).Should(BeNil())
+			Expect(last().Path).To(Equal("/broadcast/foo"))
+			Expect(last().Query.Get("alert")).To(Equal("hi"))
+			Expect(last().Query.Get("sound")).To(Equal("default"))
+			Expect(last().Query.Get("category")).To(Equal("news"))
+			Expect(res.SentCount).To(Equal(100))
+		})
+	})
+	Context("Without an alert or info", func() {
+		It("should come back with an error", func() {
+			_, err := client.Send(&Notification{DeviceTokens: []string{"a"}})
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+})
+
+var _ = Describe("Broadcast", func() {
+	var (
+		client *Client
+		server *testutil.RecordingServer
+	)
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should send the alert, sound and category along with the rest", func() {
+		_, err := client.Broadcast("foo", "hi", "+1", "default", `{"a":1}`, "60", "true", "news")
+		Expect(err).Should(BeNil())
+		query := server.Queries("/broadcast/foo")[0]
+		Expect(query).To(HaveLen(7))
+		Expect(query.Get("alert")).To(Equal("hi"))
+		Expect(query.Get("badge")).To(Equal("+1"))
+		Expect(query.Get("sound")).To(Equal("default"))
+		Expect(query.Get("info")).To(Equal(`{"a":1}`))
+		Expect(query.Get("expiry")).To(Equal("60"))
+		Expect(query.Get("content_available")).To(Equal("true"))
+		Expect(query.Get("category")).To(Equal("news"))
+	})
+})
@@ -0,0 +1,463 @@
+package zeropush
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	JOB_PENDING = "pending"
+	JOB_DONE    = "done"
+	JOB_FAILED  = "failed"
+)
+
+var ErrJobNotFound = errors.New("outbox job not found")
+
+type OutboxJob struct {
+	ID           string
+	Notification *Notification
+	Status       string
+	Attempts     int
+	LastError    string
+	EnqueuedAt   time.Time
+	CompletedAt  time.Time
+	//set once the job is done
+	SentCount          int
+	InactiveTokens     []string
+	UnregisteredTokens []string
+
+	next_attempt time.Time
+	seq          int
+}
+
+// one line of the outbox log
+type outbox_record struct {
+	Op                 string        `json:"op"`
+	ID                 string        `json:"id"`
+	Time               time.Time     `json:"time"`
+	Notification       *Notification `json:"notification,omitempty"`
+	Error              string        `json:"error,omitempty"`
+	SentCount          int           `json:"sent_count,omitempty"`
+	InactiveTokens     []string      `json:"inactive_tokens,omitempty"`
+	UnregisteredTokens []string      `json:"unregistered_tokens,omitempty"`
+}
+
+// Outbox is a file-backed queue of notifications. Every change is appended
+// to the log and synced before it is acknowledged, and unfinished jobs are
+// picked up again when the outbox is reopened, so each job is delivered at
+// least once.
+type Outbox struct {
+	Client *Client
+	//delivery attempts before a job is marked failed, 0 means no limit
+	MaxAttempts int
+	//delay before the given retry, defaults to exponential backoff from 1s to 5m
+	Backoff func(attempt int) time.Duration
+
+	path  string
+	mutex sync.Mutex
+	file  *os.File
+	jobs  map[string]*OutboxJob
+	seq   int
+	wake  chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// OpenOutbox opens or creates the log at path and replays it.
+func OpenOutbox(path string, client *Client) (*Outbox, error) {
+	o := &Outbox{
+		Client:      client,
+		MaxAttempts: 10,
+		Backoff:     default_backoff,
+		path:        path,
+		jobs:        make(map[string]*OutboxJob),
+		wake:        make(chan struct{}, 1),
+	}
+	if err := o.replay(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	o.file = file
+	return o, nil
+}
+
+func default_backoff(attempt int) time.Duration {
+	delay := time.Second << uint(attempt-1)
+	if attempt > 10 || delay > 5*time.Minute {
+		return 5 * time.Minute
+	}
+	return delay
+}
+
+func (o *Outbox) replay() error {
+	file, err := os.OpenFile(o.path, os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	//end of the last complete line
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) == 0 {
+				return nil
+			}
+			//a torn write from a crash, the job it belonged to was never acknowledged;
+			//cut it off so the next record starts on a line of its own
+			log.Printf("Error reading the outbox, dropping a torn record of %d bytes", len(line))
+			return file.Truncate(offset)
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+		record := &outbox_record{}
+		if err := json.Unmarshal(line, record); err != nil {
+			log.Printf("Error reading the outbox, skipping a record: %s", err)
+			continue
+		}
+		o.apply(record)
+	}
+}
+
+func (o *Outbox) apply(record *outbox_record) {
+	if record.Op == "enqueue" {
+		o.seq++
+		o.jobs[record.ID] = &OutboxJob{
+			ID:           record.ID,
+			Notification: record.Notification,
+			Status:       JOB_PENDING,
+			EnqueuedAt:   record.Time,
+			seq:          o.seq,
+		}
+		return
+	}
+	job, ok := o.jobs[record.ID]
+	if !ok {
+		return
+	}
+	switch record.Op {
+	case "attempt":
+		job.Attempts++
+		job.LastError = record.Error
+	case "done":
+		job.Attempts++
+		job.Status = JOB_DONE
+		job.CompletedAt = record.Time
+		job.SentCount = record.SentCount
+		job.InactiveTokens = record.InactiveTokens
+		job.UnregisteredTokens = record.UnregisteredTokens
+	case "failed":
+		job.Attempts++
+		job.Status = JOB_FAILED
+		job.LastError = record.Error
+		job.CompletedAt = record.Time
+	}
+}
+
+// append writes and syncs a record; callers hold the mutex.
+func (o *Outbox) append(record *outbox_record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = o.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return o.file.Sync()
+}
+
+func new_job_id() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Enqueue stores a Notify (or, with Channel set, Broadcast) job and returns
+// its ID once it is on disk.
+func (o *Outbox) Enqueue(n *Notification) (string, error) {
+	if n == nil {
+		return "", errors.New("notification cannot be nil")
+	}
+	if err := n.validate(); err != nil {
+		return "", err
+	}
+	record := &outbox_record{Op: "enqueue", ID: new_job_id(), Time: time.Now(), Notification: n}
+	o.mutex.Lock()
+	if err := o.append(record); err != nil {
+		o.mutex.Unlock()
+		log.Printf("Error writing to the outbox: %s", err)
+		return "", err
+	}
+	o.apply(record)
+	o.mutex.Unlock()
+	o.signal()
+	return record.ID, nil
+}
+
+func (o *Outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns a copy of the job.
+func (o *Outbox) Status(id string) (*OutboxJob, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	job, ok := o.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	job_copy := *job
+	return &job_copy, nil
+}
+
+// Pending returns the unfinished jobs in the order they were enqueued.
+func (o *Outbox) Pending() []*OutboxJob {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	var pending []*OutboxJob
+	for _, job := range o.jobs {
+		if job.Status == JOB_PENDING {
+			job_copy := *job
+			pending = append(pending, &job_copy)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].seq < pending[j].seq })
+	return pending
+}
+
+// next_job returns the oldest pending job and how long until it is due.
+func (o *Outbox) next_job() (*OutboxJob, time.Duration) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	var next *OutboxJob
+	for _, job := range o.jobs {
+		if job.Status != JOB_PENDING {
+			continue
+		}
+		if next == nil || job.next_attempt.Before(next.next_attempt) ||
+			(job.next_attempt.Equal(next.next_attempt) && job.seq < next.seq) {
+			next = job
+		}
+	}
+	if next == nil {
+		return nil, 0
+	}
+	return next, time.Until(next.next_attempt)
+}
+
+// deliver sends one job and records the outcome.
+func (o *Outbox) deliver(job *OutboxJob) error {
+	n := job.Notification
+	if n.IdempotencyKey == "" {
+		//retries after a crash or a lost response are not delivered twice
+		n_copy := *n
+		n_copy.IdempotencyKey = job.ID
+		n = &n_copy
+	}
+	if job.Attempts > 0 && o.Client.Metrics != nil {
+		endpoint := "/notify"
+		if n.Channel != "" {
+			endpoint = "/broadcast"
+		}
+		o.Client.Metrics.ObserveRetry(endpoint)
+	}
+	client := o.Client
+	var span Span
+	if client.Tracer != nil {
+		//the API call becomes a child of the delivery
+		var ctx context.Context
+		ctx, span = client.Tracer.Start(client.context(), "zeropush outbox delivery")
+		defer span.End()
+		span.SetAttributes(map[string]interface{}{"zeropush.job_id": job.ID, "zeropush.attempt": job.Attempts + 1})
+		if job.Attempts > 0 {
+			span.AddEvent("retry", map[string]interface{}{"zeropush.attempt": job.Attempts + 1, "zeropush.last_error": job.LastError})
+		}
+		client = client.WithContext(ctx)
+	}
+	response, err := client.Send(n)
+	if err != nil && span != nil {
+		span.RecordError(err)
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	record := &outbox_record{ID: job.ID, Time: time.Now()}
+	if err == nil {
+		record.Op = "done"
+		record.SentCount = response.SentCount
+		record.InactiveTokens = response.InactiveTokens
+		record.UnregisteredTokens = response.UnregisteredTokens
+	} else if o.MaxAttempts > 0 && job.Attempts+1 >= o.MaxAttempts {
+		record.Op = "failed"
+		record.Error = err.Error()
+	} else {
+		record.Op = "attempt"
+		record.Error = err.Error()
+	}
+	if write_err := o.append(record); write_err != nil {
+		//leave the job as it was, it will be retried
+		log.Printf("Error writing to the outbox: %s", write_err)
+		job.next_attempt = time.Now().Add(o.Backoff(job.Attempts + 1))
+		return write_err
+	}
+	o.apply(record)
+	if record.Op == "attempt" {
+		job.next_attempt = time.Now().Add(o.Backoff(job.Attempts))
+	}
+	return err
+}
+
+// Start delivers pending jobs in the background until Stop is called.
+func (o *Outbox) Start() {
+	o.mutex.Lock()
+	if o.stop != nil {
+		o.mutex.Unlock()
+		return
+	}
+	o.stop = make(chan struct{})
+	o.done = make(chan struct{})
+	stop, done := o.stop, o.done
+	o.mutex.Unlock()
+
+	go func() {
+		defer close(done)
+		for {
+			job, wait := o.next_job()
+			if job != nil && wait <= 0 {
+				if err := o.deliver(job); err != nil {
+					log.Printf("Error delivering outbox job %s: %s", job.ID, err)
+				}
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				continue
+			}
+			var timer <-chan time.Time
+			if job != nil {
+				timer = time.After(wait)
+			}
+			select {
+			case <-stop:
+				return
+			case <-o.wake:
+			case <-timer:
+			}
+		}
+	}()
+}
+
+// Stop waits for the job in flight, if any, and stops the worker.
+func (o *Outbox) Stop() {
+	o.mutex.Lock()
+	stop, done := o.stop, o.done
+	o.stop, o.done = nil, nil
+	o.mutex.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// Compact rewrites the log without the jobs that finished more than
+// older_than ago. Their status can no longer be queried afterwards.
+func (o *Outbox) Compact(older_than time.Duration) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	cutoff := time.Now().Add(-older_than)
+	jobs := make([]*OutboxJob, 0, len(o.jobs))
+	for _, job := range o.jobs {
+		if job.Status != JOB_PENDING && job.CompletedAt.Before(cutoff) {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].seq < jobs[j].seq })
+
+	tmp := o.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, job := range jobs {
+		for _, record := range job_records(job) {
+			if err = encoder.Encode(record); err != nil {
+				file.Close()
+				return err
+			}
+		}
+	}
+	if err = writer.Flush(); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+	o.file.Close()
+	if o.file, err = os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	o.jobs = make(map[string]*OutboxJob, len(jobs))
+	for _, job := range jobs {
+		o.jobs[job.ID] = job
+	}
+	return nil
+}
+
+// job_records returns the records that rebuild job on replay.
+func job_records(job *OutboxJob) []*outbox_record {
+	records := []*outbox_record{{Op: "enqueue", ID: job.ID, Time: job.EnqueuedAt, Notification: job.Notification}}
+	attempts := job.Attempts
+	if job.Status != JOB_PENDING {
+		attempts--
+	}
+	for i := 0; i < attempts; i++ {
+		records = append(records, &outbox_record{Op: "attempt", ID: job.ID, Time: job.EnqueuedAt, Error: job.LastError})
+	}
+	switch job.Status {
+	case JOB_DONE:
+		records = append(records, &outbox_record{Op: "done", ID: job.ID, Time: job.CompletedAt, SentCount: job.SentCount,
+			InactiveTokens: job.InactiveTokens, UnregisteredTokens: job.UnregisteredTokens})
+	case JOB_FAILED:
+		records = append(records, &outbox_record{Op: "failed", ID: job.ID, Time: job.CompletedAt, Error: job.LastError})
+	}
+	return records
+}
+
+// Close stops the worker and closes the log.
+func (o *Outbox) Close() error {
+	o.Stop()
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.file.Close()
+}
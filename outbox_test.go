@@ -0,0 +1,163 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Outbox", func() {
+	var (
+		client *Client
+		server *testutil.RecordingServer
+		dir    string
+		path   string
+		outbox *Outbox
+	)
+	notification := &Notification{Alert: "hello", DeviceTokens: []string{"abc"}}
+
+	open := func() *Outbox {
+		o, err := OpenOutbox(path, client)
+		Expect(err).Should(BeNil())
+		o.Backoff = func(attempt int) time.Duration { return time.Millisecond }
+		return o
+	}
+	status := func(id string) func() string {
+		return func() string {
+			job, err := outbox.Status(id)
+			Expect(err).Should(BeNil())
+			return job.Status
+		}
+	}
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+		dir, _ = os.MkdirTemp("", "zeropush")
+		path = filepath.Join(dir, "outbox.log")
+		outbox = open()
+	})
+	AfterEach(func() {
+		outbox.Close()
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("With a running worker", func() {
+		It("should deliver enqueued notifications", func() {
+			outbox.Start()
+			id, err := outbox.Enqueue(notification)
+			Expect(err).Should(BeNil())
+			Eventually(status(id)).Should(Equal(JOB_DONE))
+			job, _ := outbox.Status(id)
+			Expect(job.Attempts).To(Equal(1))
+			Expect(job.UnregisteredTokens).To(HaveLen(2))
+			Expect(outbox.Pending()).To(BeEmpty())
+		})
+		It("should deliver broadcasts", func() {
+			outbox.Start()
+			id, err := outbox.Enqueue(&Notification{Alert: "hello", Channel: "foo"})
+			Expect(err).Should(BeNil())
+			Eventually(status(id)).Should(Equal(JOB_DONE))
+			job, _ := outbox.Status(id)
+			Expect(job.SentCount).To(Equal(100))
+		})
+		It("should retry failed deliveries", func() {
+			server.FailNext(2)
+			outbox.Start()
+			id, _ := outbox.Enqueue(notification)
+			Eventually(status(id)).Should(Equal(JOB_DONE))
+			job, _ := outbox.Status(id)
+			Expect(job.Attempts).To(Equal(3))
+		})
+		It("should give up after the maximum number of attempts", func() {
+			server.FailNext(100)
+			outbox.MaxAttempts = 2
+			outbox.Start()
+			id, _ := outbox.Enqueue(notification)
+			Eventually(status(id)).Should(Equal(JOB_FAILED))
+			job, _ := outbox.Status(id)
+			Expect(job.Attempts).To(Equal(2))
+			Expect(job.LastError).To(Equal("service unavailable"))
+		})
+	})
+
+	Context("When reopened", func() {
+		It("should replay unfinished jobs and remember finished ones", func() {
+			outbox.Start()
+			done_id, _ := outbox.Enqueue(notification)
+			Eventually(status(done_id)).Should(Equal(JOB_DONE))
+			outbox.Stop()
+			pending_id, _ := outbox.Enqueue(notification)
+			Expect(outbox.Close()).To(Succeed())
+
+			//simulate a crash in the middle of a write
+			file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			file.WriteString(`{"op":"done","id":"` + pending_id[:4])
+			file.Close()
+
+			outbox = open()
+			Expect(outbox.Pending()).To(HaveLen(1))
+			Expect(outbox.Pending()[0].ID).To(Equal(pending_id))
+			Expect(status(done_id)()).To(Equal(JOB_DONE))
+
+			outbox.Start()
+			Eventually(status(pending_id)).Should(Equal(JOB_DONE))
+			Expect(server.Succeeded()).To(Equal(2))
+
+			//the torn record is gone, so the next one is readable
+			outbox.Stop()
+			next_id, err := outbox.Enqueue(notification)
+			Expect(err).Should(BeNil())
+			Expect(outbox.Close()).To(Succeed())
+			outbox = open()
+			Expect(outbox.Pending()).To(HaveLen(1))
+			Expect(outbox.Pending()[0].ID).To(Equal(next_id))
+		})
+	})
+
+	Context("With an invalid notification", func() {
+		It("should refuse to enqueue it", func() {
+			_, err := outbox.Enqueue(&Notification{Alert: "hello"})
+			Expect(err).ShouldNot(BeNil())
+			_, err = outbox.Enqueue(&Notification{DeviceTokens: []string{"abc"}})
+			Expect(err).ShouldNot(BeNil())
+			Expect(outbox.Pending()).To(BeEmpty())
+		})
+	})
+
+	Context("When compacted", func() {
+		It("should drop old finished jobs and keep the rest", func() {
+			outbox.Start()
+			done_id, _ := outbox.Enqueue(notification)
+			Eventually(status(done_id)).Should(Equal(JOB_DONE))
+			outbox.Stop()
+			pending_id, _ := outbox.Enqueue(notification)
+
+			Expect(outbox.Compact(0)).To(Succeed())
+			_, err := outbox.Status(done_id)
+			Expect(err).To(Equal(ErrJobNotFound))
+			Expect(outbox.Close()).To(Succeed())
+
+			data, _ := os.ReadFile(path)
+			Expect(strings.Count(string(data), "\n")).To(Equal(1))
+			outbox = open()
+			Expect(outbox.Pending()).To(HaveLen(1))
+			Expect(outbox.Pending()[0].ID).To(Equal(pending_id))
+		})
+	})
+
+	Context("With an unknown job", func() {
+		It("should come back with an error", func() {
+			_, err := outbox.Status("nope")
+			Expect(err).To(Equal(ErrJobNotFound))
+		})
+	})
+})
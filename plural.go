@@ -0,0 +1,226 @@
+package zeropush
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parse_plural_forms compiles the C expression of a gettext Plural-Forms
+// header, "nplurals=3; plural=(n==1 ? 0 : n<5 ? 1 : 2);", or a bare
+// expression into a function from a count to a form index.
+func parse_plural_forms(forms string) (func(n int) int, error) {
+	expression := forms
+	if i := strings.Index(forms, "plural="); i >= 0 {
+		expression = forms[i+len("plural="):]
+	}
+	expression = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(expression), ";"))
+	tokens, err := tokenize_plural(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &plural_parser{tokens: tokens}
+	f, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in %q", p.tokens[p.pos], expression)
+	}
+	return f, nil
+}
+
+func tokenize_plural(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		case i+1 < len(s) && is_plural_operator(s[i:i+2]):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case strings.IndexByte("n?:<>+-*/%!()", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q in %q", c, s)
+		}
+	}
+	return tokens, nil
+}
+
+func is_plural_operator(s string) bool {
+	switch s {
+	case "||", "&&", "==", "!=", "<=", ">=":
+		return true
+	}
+	return false
+}
+
+type plural_parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *plural_parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *plural_parser) accept(token string) bool {
+	if p.peek() == token {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func bool_int(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (p *plural_parser) ternary() (func(int) int, error) {
+	condition, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return condition, err
+	}
+	then, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept(":") {
+		return nil, fmt.Errorf("expected : at %q", p.peek())
+	}
+	otherwise, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	return func(n int) int {
+		if condition(n) != 0 {
+			return then(n)
+		}
+		return otherwise(n)
+	}, nil
+}
+
+// binary operators from the loosest to the tightest
+var plural_precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", ">", "<=", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *plural_parser) binary(level int) (func(int) int, error) {
+	if level == len(plural_precedence) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, candidate := range plural_precedence[level] {
+			if p.peek() == candidate {
+				op = candidate
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = plural_operator(op, left, right)
+	}
+}
+
+func plural_operator(op string, left func(int) int, right func(int) int) func(int) int {
+	return func(n int) int {
+		a, b := left(n), right(n)
+		switch op {
+		case "||":
+			return bool_int(a != 0 || b != 0)
+		case "&&":
+			return bool_int(a != 0 && b != 0)
+		case "==":
+			return bool_int(a == b)
+		case "!=":
+			return bool_int(a != b)
+		case "<":
+			return bool_int(a < b)
+		case ">":
+			return bool_int(a > b)
+		case "<=":
+			return bool_int(a <= b)
+		case ">=":
+			return bool_int(a >= b)
+		case "+":
+			return a + b
+		case "-":
+			return a - b
+		case "*":
+			return a * b
+		case "/":
+			if b == 0 {
+				return 0
+			}
+			return a / b
+		case "%":
+			if b == 0 {
+				return 0
+			}
+			return a % b
+		}
+		return 0
+	}
+}
+
+func (p *plural_parser) unary() (func(int) int, error) {
+	token := p.peek()
+	p.pos++
+	switch {
+	case token == "!":
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(n int) int { return bool_int(operand(n) == 0) }, nil
+	case token == "n":
+		return func(n int) int { return n }, nil
+	case token == "(":
+		inner, err := p.ternary()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("expected ) at %q", p.peek())
+		}
+		return inner, nil
+	case token != "" && token[0] >= '0' && token[0] <= '9':
+		value, err := strconv.Atoi(token)
+		if err != nil {
+			return nil, err
+		}
+		return func(int) int { return value }, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", token)
+}
@@ -0,0 +1,18 @@
+package zeropush
+
+import (
+	"errors"
+)
+
+// Provider is a push backend. Client implements it on top of ZeroPush, the
+// apns, fcm and webpush packages talk to the platforms directly, so code
+// written against Provider can switch between them.
+type Provider interface {
+	Notify(alert string, badge string, sound string, info string, expiry string, content_available string, category string, device_tokens ...string) (*NotifyResponse, error)
+	Broadcast(channel string, alert string, badge string, sound string, info string, expiry string, content_available string, category string) (*BroadcastResponse, error)
+	Send(n *Notification) (*NotifyResponse, error)
+}
+
+var _ Provider = (*Client)(nil)
+
+var ErrBroadcastNotSupported = errors.New("the provider does not support broadcasts")
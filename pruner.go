@@ -0,0 +1,250 @@
+package zeropush
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	PRUNE_INACTIVE     = "inactive"
+	PRUNE_UNREGISTERED = "unregistered"
+)
+
+// DEFAULT_PRUNE_INTERVAL is used by Start when Interval is not set.
+const DEFAULT_PRUNE_INTERVAL = time.Hour
+
+type DeadToken struct {
+	DeviceToken      string
+	Reason           string
+	MarkedInactiveAt time.Time
+}
+
+// TokenSink is implemented by the application to mark tokens as dead in its
+// own store. Returning an error makes the Pruner retry the batch later.
+type TokenSink interface {
+	MarkDead(tokens []DeadToken) error
+}
+
+// WaterMarkStore can also be implemented by a TokenSink to keep the Pruner's
+// high-water mark across restarts.
+type WaterMarkStore interface {
+	LoadWaterMark() (time.Time, error)
+	SaveWaterMark(mark time.Time) error
+}
+
+// Pruner periodically fetches the inactive tokens, hands the ones it has not
+// seen yet to the sink and optionally unregisters them.
+type Pruner struct {
+	Client   *Client
+	Sink     TokenSink
+	Interval time.Duration
+	//unregister inactive tokens once the sink has accepted them
+	Unregister bool
+	//called with errors of background passes
+	OnError func(err error)
+
+	//serializes passes, which run without holding mutex
+	pass       sync.Mutex
+	mutex      sync.Mutex
+	water_mark time.Time
+	at_mark    map[string]bool
+	loaded     bool
+	//bumped by SetWaterMark so a pass under way does not overwrite it
+	generation int
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+func NewPruner(client *Client, sink TokenSink) *Pruner {
+	return &Pruner{Client: client, Sink: sink, Interval: DEFAULT_PRUNE_INTERVAL}
+}
+
+// WaterMark returns the newest MarkedInactiveAt processed so far.
+func (p *Pruner) WaterMark() time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.water_mark
+}
+
+// SetWaterMark makes the Pruner skip tokens marked inactive before mark.
+func (p *Pruner) SetWaterMark(mark time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.water_mark = mark
+	p.at_mark = nil
+	p.loaded = true
+	p.generation++
+}
+
+func (p *Pruner) load_water_mark() error {
+	p.mutex.Lock()
+	loaded, generation := p.loaded, p.generation
+	p.mutex.Unlock()
+	if loaded {
+		return nil
+	}
+	var mark time.Time
+	if store, ok := p.Sink.(WaterMarkStore); ok {
+		var err error
+		if mark, err = store.LoadWaterMark(); err != nil {
+			return err
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.generation == generation {
+		p.water_mark = mark
+		p.loaded = true
+	}
+	return nil
+}
+
+// Prune runs a single pass and returns the number of tokens handed to the sink.
+func (p *Pruner) Prune() (int, error) {
+	p.pass.Lock()
+	defer p.pass.Unlock()
+	if err := p.load_water_mark(); err != nil {
+		return 0, err
+	}
+	//at_mark is replaced, never changed in place, so it can be read unlocked
+	p.mutex.Lock()
+	water_mark, seen_at_mark, generation := p.water_mark, p.at_mark, p.generation
+	p.mutex.Unlock()
+
+	response, err := p.Client.GetInactiveTokensSince(water_mark)
+	if err != nil {
+		return 0, err
+	}
+
+	mark := water_mark
+	at_mark := make(map[string]bool)
+	for token := range seen_at_mark {
+		at_mark[token] = true
+	}
+	var dead []DeadToken
+	seen := make(map[string]bool)
+	for _, detail := range response.TokenDetails {
+		if seen[detail.DeviceToken] {
+			continue
+		}
+		seen[detail.DeviceToken] = true
+		marked_at := detail.MarkedInactiveAt
+		if marked_at.Before(water_mark) || (marked_at.Equal(water_mark) && seen_at_mark[detail.DeviceToken]) {
+			continue
+		}
+		dead = append(dead, DeadToken{
+			DeviceToken:      detail.DeviceToken,
+			Reason:           PRUNE_INACTIVE,
+			MarkedInactiveAt: detail.MarkedInactiveAt,
+		})
+		if marked_at.After(mark) {
+			mark = marked_at
+			at_mark = make(map[string]bool)
+		}
+		if marked_at.Equal(mark) {
+			at_mark[detail.DeviceToken] = true
+		}
+	}
+	if len(dead) == 0 {
+		return 0, nil
+	}
+	if err = p.deliver(dead); err != nil {
+		return 0, err
+	}
+	if store, ok := p.Sink.(WaterMarkStore); ok && mark.After(water_mark) {
+		if err = store.SaveWaterMark(mark); err != nil {
+			return len(dead), err
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.generation == generation {
+		p.water_mark = mark
+		p.at_mark = at_mark
+	}
+	return len(dead), nil
+}
+
+// Consume hands the inactive and unregistered tokens reported by Notify to the sink.
+func (p *Pruner) Consume(response *NotifyResponse) error {
+	if response == nil {
+		return nil
+	}
+	var dead []DeadToken
+	for _, token := range response.InactiveTokens {
+		dead = append(dead, DeadToken{DeviceToken: token, Reason: PRUNE_INACTIVE})
+	}
+	for _, token := range response.UnregisteredTokens {
+		dead = append(dead, DeadToken{DeviceToken: token, Reason: PRUNE_UNREGISTERED})
+	}
+	if len(dead) == 0 {
+		return nil
+	}
+	return p.deliver(dead)
+}
+
+func (p *Pruner) deliver(dead []DeadToken) error {
+	if err := p.Sink.MarkDead(dead); err != nil {
+		log.Printf("Error marking tokens dead: %s", err)
+		return err
+	}
+	if !p.Unregister {
+		return nil
+	}
+	for _, token := range dead {
+		if token.Reason != PRUNE_INACTIVE {
+			continue
+		}
+		if _, err := p.Client.Unregister(token.DeviceToken, ""); err != nil {
+			log.Printf("Error unregistering %s: %s", token.DeviceToken, err)
+		}
+	}
+	return nil
+}
+
+// Start runs Prune every Interval, DEFAULT_PRUNE_INTERVAL when it is not set,
+// until Stop is called.
+func (p *Pruner) Start() {
+	p.mutex.Lock()
+	if p.stop != nil {
+		p.mutex.Unlock()
+		return
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	stop, done := p.stop, p.done
+	interval := p.Interval
+	if interval <= 0 {
+		interval = DEFAULT_PRUNE_INTERVAL
+	}
+	p.mutex.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := p.Prune(); err != nil && p.OnError != nil {
+				p.OnError(err)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (p *Pruner) Stop() {
+	p.mutex.Lock()
+	stop, done := p.stop, p.done
+	p.stop, p.done = nil, nil
+	p.mutex.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,191 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+type fake_sink struct {
+	mutex sync.Mutex
+	dead  []DeadToken
+	err   error
+}
+
+func (s *fake_sink) MarkDead(tokens []DeadToken) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.dead = append(s.dead, tokens...)
+	return nil
+}
+
+func (s *fake_sink) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.dead)
+}
+
+type water_mark_sink struct {
+	fake_sink
+	mark time.Time
+}
+
+func (s *water_mark_sink) LoadWaterMark() (time.Time, error) { return s.mark, nil }
+func (s *water_mark_sink) SaveWaterMark(mark time.Time) error {
+	s.mark = mark
+	return nil
+}
+
+type blocking_sink struct {
+	mutex   sync.Mutex
+	entered bool
+	release chan struct{}
+}
+
+func (s *blocking_sink) MarkDead(tokens []DeadToken) error {
+	s.mutex.Lock()
+	s.entered = true
+	s.mutex.Unlock()
+	<-s.release
+	return nil
+}
+
+func (s *blocking_sink) Entered() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.entered
+}
+
+var _ = Describe("Pruner", func() {
+	var (
+		client *Client
+		server *testutil.RecordingServer
+		sink   *fake_sink
+		pruner *Pruner
+	)
+	inactive_token := "1234567890abcdef1234567890abcdef1234567890abcdef1234567890abcedf"
+	marked_at, _ := time.Parse(time.RFC3339, "2013-03-11T16:25:14-04:00")
+	unregistered := func() []string {
+		var tokens []string
+		for _, query := range server.Queries("/unregister") {
+			tokens = append(tokens, query.Get("device_token"))
+		}
+		return tokens
+	}
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+		sink = &fake_sink{}
+		pruner = NewPruner(client, sink)
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("With new inactive tokens", func() {
+		It("should hand them to the sink once", func() {
+			n, err := pruner.Prune()
+			Expect(err).Should(BeNil())
+			Expect(n).To(Equal(1))
+			Expect(sink.dead).To(Equal([]DeadToken{{
+				DeviceToken:      inactive_token,
+				Reason:           PRUNE_INACTIVE,
+				MarkedInactiveAt: marked_at,
+			}}))
+			Expect(pruner.WaterMark().Equal(marked_at)).To(BeTrue())
+			Expect(unregistered()).To(BeEmpty())
+
+			n, err = pruner.Prune()
+			Expect(err).Should(BeNil())
+			Expect(n).To(Equal(0))
+			Expect(sink.dead).To(HaveLen(1))
+		})
+		It("should unregister them when asked to", func() {
+			pruner.Unregister = true
+			_, err := pruner.Prune()
+			Expect(err).Should(BeNil())
+			Expect(unregistered()).To(Equal([]string{inactive_token}))
+		})
+	})
+
+	Context("When the sink fails", func() {
+		It("should not advance the water mark", func() {
+			sink.err = errors.New("database is down")
+			_, err := pruner.Prune()
+			Expect(err).ShouldNot(BeNil())
+			Expect(pruner.WaterMark().IsZero()).To(BeTrue())
+
+			sink.err = nil
+			n, err := pruner.Prune()
+			Expect(err).Should(BeNil())
+			Expect(n).To(Equal(1))
+		})
+	})
+
+	Context("With tokens older than the water mark", func() {
+		It("should skip them", func() {
+			pruner.SetWaterMark(marked_at.Add(time.Second))
+			n, err := pruner.Prune()
+			Expect(err).Should(BeNil())
+			Expect(n).To(Equal(0))
+		})
+		It("should load and save the water mark through the sink", func() {
+			store := &water_mark_sink{mark: marked_at.Add(-time.Hour)}
+			pruner = NewPruner(client, store)
+			n, err := pruner.Prune()
+			Expect(err).Should(BeNil())
+			Expect(n).To(Equal(1))
+			Expect(store.mark.Equal(marked_at)).To(BeTrue())
+		})
+	})
+
+	Context("With a notify response", func() {
+		It("should hand its inactive and unregistered tokens to the sink", func() {
+			err := pruner.Consume(&NotifyResponse{InactiveTokens: []string{"a"}, UnregisteredTokens: []string{"b"}})
+			Expect(err).Should(BeNil())
+			Expect(sink.dead).To(Equal([]DeadToken{
+				{DeviceToken: "a", Reason: PRUNE_INACTIVE},
+				{DeviceToken: "b", Reason: PRUNE_UNREGISTERED},
+			}))
+		})
+	})
+
+	Context("When started", func() {
+		It("should prune in the background until stopped", func() {
+			pruner.Interval = 10 * time.Millisecond
+			pruner.Start()
+			Eventually(sink.count).Should(Equal(1))
+			pruner.Stop()
+		})
+		It("should default the interval of a Pruner built without NewPruner", func() {
+			pruner = &Pruner{Client: client, Sink: sink}
+			Expect(pruner.Start).NotTo(Panic())
+			Eventually(sink.count).Should(Equal(1))
+			pruner.Stop()
+		})
+	})
+
+	Context("While a pass is under way", func() {
+		It("should not block the water mark", func() {
+			blocking := &blocking_sink{release: make(chan struct{})}
+			pruner.Sink = blocking
+			go pruner.Prune()
+			Eventually(blocking.Entered).Should(BeTrue())
+			done := make(chan time.Time)
+			go func() { done <- pruner.WaterMark() }()
+			Eventually(done).Should(Receive(BeZero()))
+			close(blocking.release)
+			Eventually(pruner.WaterMark).Should(Equal(marked_at))
+		})
+	})
+})
@@ -0,0 +1,135 @@
+package zeropush
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// Recipient is the delivery preference of a device. The quiet hours run from
+// QuietStart to QuietEnd, both local times of day given as durations, and
+// wrap around midnight when QuietStart is after QuietEnd, e.g. 22h to 7h.
+// They keep to the wall clock on days with a DST change.
+type Recipient struct {
+	Location   *time.Location
+	QuietStart time.Duration
+	QuietEnd   time.Duration
+}
+
+// RecipientLookup returns the preference of a device token, or nil when it
+// has none.
+type RecipientLookup interface {
+	Recipient(device_token string) (*Recipient, error)
+}
+
+// QuietUntil returns the end of the quiet hours t falls into, if any.
+func (r *Recipient) QuietUntil(t time.Time) (time.Time, bool) {
+	if r == nil || r.QuietStart == r.QuietEnd {
+		return time.Time{}, false
+	}
+	location := r.Location
+	if location == nil {
+		location = time.UTC
+	}
+	local := t.In(location)
+	at := func(days int, time_of_day time.Duration) time.Time {
+		hour := int(time_of_day / time.Hour)
+		minute := int(time_of_day % time.Hour / time.Minute)
+		second := int(time_of_day % time.Minute / time.Second)
+		return time.Date(local.Year(), local.Month(), local.Day()+days, hour, minute, second, 0, location)
+	}
+	if r.QuietStart < r.QuietEnd {
+		if !local.Before(at(0, r.QuietStart)) && local.Before(at(0, r.QuietEnd)) {
+			return at(0, r.QuietEnd), true
+		}
+		return time.Time{}, false
+	}
+	if local.Before(at(0, r.QuietEnd)) {
+		return at(0, r.QuietEnd), true
+	}
+	if !local.Before(at(0, r.QuietStart)) {
+		return at(1, r.QuietEnd), true
+	}
+	return time.Time{}, false
+}
+
+type HeldNotification struct {
+	JobID        string
+	ReleaseAt    time.Time
+	DeviceTokens []string
+}
+
+type DeliveryResult struct {
+	//the response for the tokens sent right away, nil if all were held
+	Sent *NotifyResponse
+	Held []HeldNotification
+}
+
+// QuietHours sends to the device tokens outside their quiet hours right away
+// and schedules the rest for the end of their window. Urgent notifications
+// and broadcasts, whose recipients are unknown, are always sent right away.
+type QuietHours struct {
+	Client *Client
+	Lookup RecipientLookup
+	//holds the tokens in quiet hours; without it Send fails, sending nothing, if there are any
+	Scheduler *Scheduler
+}
+
+func NewQuietHours(client *Client, lookup RecipientLookup, scheduler *Scheduler) *QuietHours {
+	return &QuietHours{Client: client, Lookup: lookup, Scheduler: scheduler}
+}
+
+func (q *QuietHours) Send(n *Notification) (*DeliveryResult, error) {
+	if n == nil {
+		return nil, errors.New("notification cannot be nil")
+	}
+	if n.Urgent || n.Channel != "" {
+		response, err := q.Client.Send(n)
+		return &DeliveryResult{Sent: response}, err
+	}
+
+	now := time.Now()
+	var send_now []string
+	held := make(map[time.Time][]string)
+	for _, token := range n.DeviceTokens {
+		recipient, err := q.Lookup.Recipient(token)
+		if err != nil {
+			//better late at night than never
+			log.Printf("Error looking up the recipient %s, sending now: %s", token, err)
+		}
+		if release_at, quiet := recipient.QuietUntil(now); quiet && err == nil {
+			held[release_at] = append(held[release_at], token)
+		} else {
+			send_now = append(send_now, token)
+		}
+	}
+
+	if len(held) > 0 && q.Scheduler == nil {
+		return nil, errors.New("a Scheduler must be set to hold notifications during quiet hours")
+	}
+	result := &DeliveryResult{}
+	release_times := make([]time.Time, 0, len(held))
+	for release_at := range held {
+		release_times = append(release_times, release_at)
+	}
+	sort.Slice(release_times, func(i, j int) bool { return release_times[i].Before(release_times[j]) })
+	for _, release_at := range release_times {
+		later := *n
+		later.DeviceTokens = held[release_at]
+		id, err := q.Scheduler.Schedule(&later, release_at)
+		if err != nil {
+			return result, err
+		}
+		result.Held = append(result.Held, HeldNotification{JobID: id, ReleaseAt: release_at, DeviceTokens: later.DeviceTokens})
+	}
+
+	if len(send_now) > 0 {
+		now_part := *n
+		now_part.DeviceTokens = send_now
+		response, err := q.Client.Send(&now_part)
+		result.Sent = response
+		return result, err
+	}
+	return result, nil
+}
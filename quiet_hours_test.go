@@ -0,0 +1,161 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+type recipient_map map[string]*Recipient
+
+func (m recipient_map) Recipient(device_token string) (*Recipient, error) {
+	if device_token == "broken" {
+		return nil, errors.New("lookup failed")
+	}
+	return m[device_token], nil
+}
+
+var _ = Describe("QuietHours", func() {
+	istanbul := time.FixedZone("Istanbul", 3*60*60)
+	nights := &Recipient{Location: istanbul, QuietStart: 22 * time.Hour, QuietEnd: 7 * time.Hour}
+
+	Context("With a window around midnight", func() {
+		It("should be quiet late at night until the morning", func() {
+			until, quiet := nights.QuietUntil(time.Date(2020, 1, 1, 23, 0, 0, 0, istanbul))
+			Expect(quiet).To(BeTrue())
+			Expect(until).To(BeTemporally("==", time.Date(2020, 1, 2, 7, 0, 0, 0, istanbul)))
+		})
+		It("should be quiet early in the morning", func() {
+			//00:30 UTC is 03:30 in Istanbul
+			until, quiet := nights.QuietUntil(time.Date(2020, 1, 2, 0, 30, 0, 0, time.UTC))
+			Expect(quiet).To(BeTrue())
+			Expect(until).To(BeTemporally("==", time.Date(2020, 1, 2, 7, 0, 0, 0, istanbul)))
+		})
+		It("should not be quiet during the day", func() {
+			_, quiet := nights.QuietUntil(time.Date(2020, 1, 1, 7, 0, 0, 0, istanbul))
+			Expect(quiet).To(BeFalse())
+			_, quiet = nights.QuietUntil(time.Date(2020, 1, 1, 21, 59, 0, 0, istanbul))
+			Expect(quiet).To(BeFalse())
+		})
+	})
+
+	Context("On the night of a DST change", func() {
+		It("should end the window at the wall clock time", func() {
+			new_york, err := time.LoadLocation("America/New_York")
+			Expect(err).Should(BeNil())
+			sleeper := &Recipient{Location: new_york, QuietStart: 22 * time.Hour, QuietEnd: 7 * time.Hour}
+			//clocks go from 02:00 EST to 03:00 EDT on 8 March 2020
+			until, quiet := sleeper.QuietUntil(time.Date(2020, 3, 8, 1, 0, 0, 0, new_york))
+			Expect(quiet).To(BeTrue())
+			Expect(until.Hour()).To(Equal(7))
+			Expect(until).To(BeTemporally("==", time.Date(2020, 3, 8, 11, 0, 0, 0, time.UTC)))
+			//and back from 02:00 EDT to 01:00 EST on 1 November 2020
+			until, quiet = sleeper.QuietUntil(time.Date(2020, 10, 31, 23, 0, 0, 0, new_york))
+			Expect(quiet).To(BeTrue())
+			Expect(until).To(BeTemporally("==", time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)))
+			_, quiet = sleeper.QuietUntil(time.Date(2020, 11, 1, 7, 30, 0, 0, new_york))
+			Expect(quiet).To(BeFalse())
+		})
+	})
+
+	Context("With a window within a day", func() {
+		It("should be quiet only inside it", func() {
+			siesta := &Recipient{QuietStart: 13 * time.Hour, QuietEnd: 15 * time.Hour}
+			until, quiet := siesta.QuietUntil(time.Date(2020, 1, 1, 14, 0, 0, 0, time.UTC))
+			Expect(quiet).To(BeTrue())
+			Expect(until).To(BeTemporally("==", time.Date(2020, 1, 1, 15, 0, 0, 0, time.UTC)))
+			_, quiet = siesta.QuietUntil(time.Date(2020, 1, 1, 15, 0, 0, 0, time.UTC))
+			Expect(quiet).To(BeFalse())
+		})
+	})
+
+	Context("Without a preference", func() {
+		It("should never be quiet", func() {
+			var nobody *Recipient
+			_, quiet := nobody.QuietUntil(time.Now())
+			Expect(quiet).To(BeFalse())
+		})
+	})
+
+	Context("When sending", func() {
+		var (
+			client      *Client
+			server      *testutil.RecordingServer
+			scheduler   *Scheduler
+			quiet_hours *QuietHours
+		)
+		sent := func() [][]string {
+			var tokens [][]string
+			for _, query := range server.Queries("/notify") {
+				tokens = append(tokens, query["device_tokens[]"])
+			}
+			return tokens
+		}
+
+		BeforeEach(func() {
+			server = testutil.NewRecordingServer()
+			client = server.Client()
+			scheduler = NewScheduler(client, NewMemoryScheduleStore())
+
+			//a window from an hour ago to an hour from now, whatever the time
+			offset := time.Now().UTC().Sub(time.Now().UTC().Truncate(24 * time.Hour))
+			sleeping := &Recipient{QuietStart: offset - time.Hour, QuietEnd: offset + time.Hour}
+			if sleeping.QuietStart < 0 {
+				sleeping.QuietStart += 24 * time.Hour
+			}
+			if sleeping.QuietEnd > 24*time.Hour {
+				sleeping.QuietEnd -= 24 * time.Hour
+			}
+			lookup := recipient_map{"asleep": sleeping, "also_asleep": sleeping}
+			quiet_hours = NewQuietHours(client, lookup, scheduler)
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should hold the tokens in quiet hours until the window ends", func() {
+			result, err := quiet_hours.Send(&Notification{Alert: "hi", DeviceTokens: []string{"awake", "asleep", "also_asleep"}})
+			Expect(err).Should(BeNil())
+			Expect(result.Sent).ShouldNot(BeNil())
+			Expect(sent()).To(Equal([][]string{{"awake"}}))
+
+			Expect(result.Held).To(HaveLen(1))
+			held := result.Held[0]
+			Expect(held.DeviceTokens).To(Equal([]string{"asleep", "also_asleep"}))
+			Expect(held.ReleaseAt).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+
+			scheduler.RunDue(held.ReleaseAt)
+			Expect(sent()).To(Equal([][]string{{"awake"}, {"asleep", "also_asleep"}}))
+		})
+		It("should send urgent notifications right away", func() {
+			result, err := quiet_hours.Send(&Notification{Alert: "hi", Urgent: true, DeviceTokens: []string{"asleep"}})
+			Expect(err).Should(BeNil())
+			Expect(result.Held).To(BeEmpty())
+			Expect(sent()).To(Equal([][]string{{"asleep"}}))
+		})
+		It("should not send anything now when everyone is asleep", func() {
+			result, err := quiet_hours.Send(&Notification{Alert: "hi", DeviceTokens: []string{"asleep"}})
+			Expect(err).Should(BeNil())
+			Expect(result.Sent).To(BeNil())
+			Expect(sent()).To(BeEmpty())
+		})
+		It("should come back with an error instead of holding without a scheduler", func() {
+			quiet_hours.Scheduler = nil
+			_, err := quiet_hours.Send(&Notification{Alert: "hi", DeviceTokens: []string{"awake", "asleep"}})
+			Expect(err).ShouldNot(BeNil())
+			Expect(sent()).To(BeEmpty())
+
+			_, err = quiet_hours.Send(&Notification{Alert: "hi", DeviceTokens: []string{"awake"}})
+			Expect(err).Should(BeNil())
+		})
+		It("should send when the lookup fails", func() {
+			quiet_hours.Send(&Notification{Alert: "hi", DeviceTokens: []string{"broken"}})
+			Expect(sent()).To(Equal([][]string{{"broken"}}))
+		})
+	})
+})
@@ -0,0 +1,249 @@
+package zeropush
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MAX_REGISTRATION_BODY is the largest request body RegistrationHandler reads.
+const MAX_REGISTRATION_BODY = 64 << 10
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+var channel_format = regexp.MustCompile(`^[0-9A-Za-z_.:@+-]{1,128}$`)
+
+// Authenticator checks the caller of a RegistrationHandler, e.g. by its
+// session cookie or bearer token. Errors are answered with 401, or 403 when
+// they wrap ErrForbidden.
+type Authenticator interface {
+	Authenticate(r *http.Request) error
+}
+
+type AuthenticatorFunc func(r *http.Request) error
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) error {
+	return f(r)
+}
+
+// RegistrationRequest is the JSON body the app posts to a RegistrationHandler.
+type RegistrationRequest struct {
+	DeviceToken string `json:"device_token"`
+	//channels to subscribe to on /register
+	Channels []string `json:"channels,omitempty"`
+	//channel preference changes on /channels
+	Subscribe   []string `json:"subscribe,omitempty"`
+	Unsubscribe []string `json:"unsubscribe,omitempty"`
+}
+
+type RegistrationResponse struct {
+	DeviceToken string `json:"device_token"`
+	//the channels of the device after the last subscription change
+	Channels []string `json:"channels,omitempty"`
+}
+
+// RegistrationHandler is the endpoint apps post their device tokens to. It
+// serves
+//
+//	POST /register      {"device_token": "...", "channels": ["news"]}
+//	POST /unregister    {"device_token": "..."}
+//	POST /channels      {"device_token": "...", "subscribe": ["sports"], "unsubscribe": ["news"]}
+//
+// relative to where it is mounted, and answers errors as {"error": "..."}.
+// Without an Authenticator every request is refused.
+type RegistrationHandler struct {
+	Client        *Client
+	Authenticator Authenticator
+	//defaults to accepting the APNs and FCM tokens TokenPlatform recognizes,
+	//the ones the ZeroPush API registers; web push subscriptions are refused
+	ValidateToken func(device_token string) error
+}
+
+func NewRegistrationHandler(client *Client, authenticator Authenticator) *RegistrationHandler {
+	return &RegistrationHandler{Client: client, Authenticator: authenticator}
+}
+
+type registration_error struct {
+	status  int
+	message string
+}
+
+func (e *registration_error) Error() string {
+	return e.message
+}
+
+func bad_registration(format string, args ...interface{}) error {
+	return &registration_error{status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+}
+
+func (h *RegistrationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var action func(*Client, *RegistrationRequest) (*RegistrationResponse, error)
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/register":
+		action = h.register
+	case "/unregister":
+		action = h.unregister
+	case "/channels":
+		action = h.channels
+	default:
+		write_registration_error(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		write_registration_error(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := h.authenticate(r); err != nil {
+		status := http.StatusUnauthorized
+		if errors.Is(err, ErrForbidden) {
+			status = http.StatusForbidden
+		}
+		write_registration_error(w, status, err.Error())
+		return
+	}
+
+	var req RegistrationRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_REGISTRATION_BODY))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		write_registration_error(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if err := h.validate_token(req.DeviceToken); err != nil {
+		write_registration_error(w, http.StatusBadRequest, "invalid device_token: "+err.Error())
+		return
+	}
+
+	response, err := action(h.Client.WithContext(r.Context()), &req)
+	if err != nil {
+		var reg_err *registration_error
+		var open_err *CircuitOpenError
+		switch {
+		case errors.As(err, &reg_err):
+			write_registration_error(w, reg_err.status, reg_err.message)
+		case errors.As(err, &open_err):
+			if wait := time.Until(open_err.RetryAt); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			}
+			write_registration_error(w, http.StatusServiceUnavailable, "push service unavailable")
+		default:
+			log.Printf("Error handling %s for %s: %s", r.URL.Path, req.DeviceToken, err)
+			write_registration_error(w, http.StatusBadGateway, "push service error")
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *RegistrationHandler) authenticate(r *http.Request) error {
+	if h.Authenticator == nil {
+		return ErrUnauthorized
+	}
+	return h.Authenticator.Authenticate(r)
+}
+
+func (h *RegistrationHandler) validate_token(device_token string) error {
+	if device_token == "" {
+		return errors.New("device_token cannot be blank")
+	}
+	if h.ValidateToken != nil {
+		return h.ValidateToken(device_token)
+	}
+	switch TokenPlatform(device_token) {
+	case PLATFORM_IOS, PLATFORM_ANDROID:
+		return nil
+	case PLATFORM_WEB:
+		return errors.New("web push subscriptions cannot be registered")
+	}
+	return errors.New("unrecognized token format")
+}
+
+func validate_channels(channels ...string) error {
+	for _, channel := range channels {
+		//"." and ".." would be dot segments in the path of the subscribe call
+		if !channel_format.MatchString(channel) || channel == "." || channel == ".." {
+			return bad_registration("invalid channel %q", channel)
+		}
+	}
+	return nil
+}
+
+func (h *RegistrationHandler) register(client *Client, req *RegistrationRequest) (*RegistrationResponse, error) {
+	if len(req.Subscribe) > 0 || len(req.Unsubscribe) > 0 {
+		return nil, bad_registration("use /channels to change subscriptions")
+	}
+	if err := validate_channels(req.Channels...); err != nil {
+		return nil, err
+	}
+	if _, err := client.Register(req.DeviceToken, ""); err != nil {
+		return nil, err
+	}
+	response := &RegistrationResponse{DeviceToken: req.DeviceToken}
+	for _, channel := range req.Channels {
+		subscribed, err := client.Subscribe(req.DeviceToken, channel)
+		if err != nil {
+			return nil, fmt.Errorf("subscribe %s: %w", channel, err)
+		}
+		response.Channels = subscribed.Channels
+	}
+	return response, nil
+}
+
+func (h *RegistrationHandler) unregister(client *Client, req *RegistrationRequest) (*RegistrationResponse, error) {
+	if len(req.Channels) > 0 || len(req.Subscribe) > 0 || len(req.Unsubscribe) > 0 {
+		return nil, bad_registration("unregister takes only a device_token")
+	}
+	if _, err := client.Unregister(req.DeviceToken, ""); err != nil {
+		return nil, err
+	}
+	return &RegistrationResponse{DeviceToken: req.DeviceToken}, nil
+}
+
+func (h *RegistrationHandler) channels(client *Client, req *RegistrationRequest) (*RegistrationResponse, error) {
+	if len(req.Channels) > 0 {
+		return nil, bad_registration("use subscribe and unsubscribe to change channels")
+	}
+	if len(req.Subscribe) == 0 && len(req.Unsubscribe) == 0 {
+		return nil, bad_registration("no channels to subscribe to or unsubscribe from")
+	}
+	if err := validate_channels(req.Subscribe...); err != nil {
+		return nil, err
+	}
+	if err := validate_channels(req.Unsubscribe...); err != nil {
+		return nil, err
+	}
+	response := &RegistrationResponse{DeviceToken: req.DeviceToken}
+	for _, channel := range req.Unsubscribe {
+		unsubscribed, err := client.Unsubscribe(req.DeviceToken, channel)
+		if err != nil {
+			return nil, fmt.Errorf("unsubscribe %s: %w", channel, err)
+		}
+		response.Channels = unsubscribed.Channels
+	}
+	for _, channel := range req.Subscribe {
+		subscribed, err := client.Subscribe(req.DeviceToken, channel)
+		if err != nil {
+			return nil, fmt.Errorf("subscribe %s: %w", channel, err)
+		}
+		response.Channels = subscribed.Channels
+	}
+	return response, nil
+}
+
+func write_registration_error(w http.ResponseWriter, status int, message string) {
+	data, _ := json.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,162 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("RegistrationHandler", func() {
+	const token = "1234567890abcdef1234567890abcdef1234567890abcdef1234567890abcdef"
+	var (
+		client  *Client
+		server  *testutil.RecordingServer
+		handler *RegistrationHandler
+	)
+	allow := AuthenticatorFunc(func(r *http.Request) error {
+		if r.Header.Get("Authorization") != "Bearer session" {
+			return ErrUnauthorized
+		}
+		return nil
+	})
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+		handler = NewRegistrationHandler(client, allow)
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	post := func(path string, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer session")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var decoded map[string]interface{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &decoded)).Should(BeNil())
+		return rec, decoded
+	}
+
+	It("should register the token and subscribe it to its channels", func() {
+		rec, body := post("/register", `{"device_token":"`+token+`","channels":["news","sports"]}`)
+		Expect(rec.Code).To(Equal(200))
+		Expect(body["device_token"]).To(Equal(token))
+		Expect(body["channels"]).To(Equal([]interface{}{"foo"}))
+		Expect(server.Calls()).To(Equal([]string{"POST /register", "POST /subscribe/news", "POST /subscribe/sports"}))
+	})
+	It("should unregister the token", func() {
+		rec, body := post("/unregister", `{"device_token":"`+token+`"}`)
+		Expect(rec.Code).To(Equal(200))
+		Expect(body["device_token"]).To(Equal(token))
+		Expect(server.Calls()).To(Equal([]string{"DELETE /unregister"}))
+	})
+	It("should update the channel preferences", func() {
+		rec, _ := post("/channels/", `{"device_token":"`+token+`","subscribe":["sports"],"unsubscribe":["news"]}`)
+		Expect(rec.Code).To(Equal(200))
+		Expect(server.Calls()).To(Equal([]string{"DELETE /subscribe/news", "POST /subscribe/sports"}))
+	})
+
+	Describe("Authentication", func() {
+		It("should refuse unauthenticated callers", func() {
+			req := httptest.NewRequest("POST", "/register", strings.NewReader(`{"device_token":"`+token+`"}`))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			Expect(rec.Code).To(Equal(401))
+			Expect(rec.Body.String()).To(MatchJSON(`{"error":"unauthorized"}`))
+			Expect(server.Calls()).To(BeEmpty())
+		})
+		It("should answer 403 for forbidden callers", func() {
+			handler.Authenticator = AuthenticatorFunc(func(r *http.Request) error {
+				return fmt.Errorf("%w: another user's device", ErrForbidden)
+			})
+			rec, body := post("/register", `{"device_token":"`+token+`"}`)
+			Expect(rec.Code).To(Equal(403))
+			Expect(body["error"]).To(Equal("forbidden: another user's device"))
+		})
+		It("should refuse everyone without an authenticator", func() {
+			handler.Authenticator = nil
+			rec, _ := post("/register", `{"device_token":"`+token+`"}`)
+			Expect(rec.Code).To(Equal(401))
+		})
+	})
+
+	Describe("Validation", func() {
+		It("should reject unknown paths and methods", func() {
+			rec, _ := post("/devices", `{}`)
+			Expect(rec.Code).To(Equal(404))
+			req := httptest.NewRequest("GET", "/register", nil)
+			rec = httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			Expect(rec.Code).To(Equal(405))
+			Expect(rec.Header().Get("Allow")).To(Equal("POST"))
+		})
+		It("should reject malformed bodies", func() {
+			rec, body := post("/register", `{"device_token":`)
+			Expect(rec.Code).To(Equal(400))
+			Expect(body["error"]).To(HavePrefix("invalid JSON body"))
+			rec, _ = post("/register", `{"device_token":"`+token+`","badge":1}`)
+			Expect(rec.Code).To(Equal(400))
+		})
+		It("should reject invalid tokens", func() {
+			rec, body := post("/register", `{"device_token":""}`)
+			Expect(rec.Code).To(Equal(400))
+			Expect(body["error"]).To(Equal("invalid device_token: device_token cannot be blank"))
+			rec, _ = post("/register", `{"device_token":"not a token"}`)
+			Expect(rec.Code).To(Equal(400))
+			rec, body = post("/register", `{"device_token":"{x"}`)
+			Expect(rec.Code).To(Equal(400))
+			Expect(body["error"]).To(Equal("invalid device_token: web push subscriptions cannot be registered"))
+			Expect(server.Calls()).To(BeEmpty())
+		})
+		It("should use ValidateToken when set", func() {
+			handler.ValidateToken = func(device_token string) error { return nil }
+			rec, _ := post("/register", `{"device_token":"abc"}`)
+			Expect(rec.Code).To(Equal(200))
+		})
+		It("should reject invalid channels", func() {
+			rec, body := post("/register", `{"device_token":"`+token+`","channels":["news/../x"]}`)
+			Expect(rec.Code).To(Equal(400))
+			Expect(body["error"]).To(Equal(`invalid channel "news/../x"`))
+			rec, body = post("/channels", `{"device_token":"`+token+`","subscribe":[".."]}`)
+			Expect(rec.Code).To(Equal(400))
+			Expect(body["error"]).To(Equal(`invalid channel ".."`))
+			rec, _ = post("/channels", `{"device_token":"`+token+`","unsubscribe":["."]}`)
+			Expect(rec.Code).To(Equal(400))
+			rec, _ = post("/channels", `{"device_token":"`+token+`"}`)
+			Expect(rec.Code).To(Equal(400))
+			rec, _ = post("/unregister", `{"device_token":"`+token+`","channels":["news"]}`)
+			Expect(rec.Code).To(Equal(400))
+			Expect(server.Calls()).To(BeEmpty())
+		})
+	})
+
+	Describe("API failures", func() {
+		It("should answer 502 without the API's error", func() {
+			server.FailNext(1)
+			rec, body := post("/register", `{"device_token":"`+token+`"}`)
+			Expect(rec.Code).To(Equal(502))
+			Expect(body["error"]).To(Equal("push service error"))
+		})
+		It("should answer 503 while the circuit is open", func() {
+			client.Breaker = NewCircuitBreaker(0.5, time.Minute)
+			client.Breaker.MinRequests = 1
+			server.FailNext(1)
+			post("/register", `{"device_token":"`+token+`"}`)
+			rec, body := post("/register", `{"device_token":"`+token+`"}`)
+			Expect(rec.Code).To(Equal(503))
+			Expect(rec.Header().Get("Retry-After")).NotTo(BeEmpty())
+			Expect(body["error"]).To(Equal("push service unavailable"))
+		})
+	})
+})
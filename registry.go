@@ -0,0 +1,281 @@
+package zeropush
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnknownApp = errors.New("no token for the application and environment")
+
+// DEFAULT_RELOAD_INTERVAL is used by Watch when no interval is given.
+const DEFAULT_RELOAD_INTERVAL = time.Minute
+
+// Registry holds a Client per application and environment. Its tokens can be
+// reloaded while it is in use, so look clients up with For on every call
+// instead of keeping them around.
+type Registry struct {
+	//base URL of the clients unless a file sets one, defaults to BASE_URL
+	BaseURL string
+	//called with errors of background reloads
+	OnError func(err error)
+
+	//serializes loads so sources are added in order
+	loading  sync.Mutex
+	mutex    sync.RWMutex
+	clients  map[string]*Client
+	base_url string
+	sources  []registry_source
+	static   map[string]string
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type registry_config struct {
+	base_url string
+	tokens   map[string]string
+}
+
+type registry_source func(cfg *registry_config) error
+
+// the file read by LoadFile
+type registry_file struct {
+	BaseURL string                       `json:"base_url"`
+	Apps    map[string]map[string]string `json:"apps"`
+}
+
+func NewRegistry() *Registry {
+	return &Registry{clients: make(map[string]*Client), static: make(map[string]string)}
+}
+
+func registry_key(app string, env string) string {
+	return strings.ToLower(app) + "/" + normalize_env(env)
+}
+
+// normalize_env maps the names ParseEnvironment accepts to "prod" and "dev"
+// and keeps other environments, e.g. "staging", as they are.
+func normalize_env(env string) string {
+	switch parsed, _ := ParseEnvironment(env); parsed {
+	case Production:
+		return "prod"
+	case Development:
+		return "dev"
+	}
+	return strings.ToLower(env)
+}
+
+// Set adds or replaces the token of an application's environment. It takes
+// precedence over the loaded sources.
+func (r *Registry) Set(app string, env string, auth_token string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := registry_key(app, env)
+	r.static[key] = auth_token
+	r.clients[key] = &Client{BaseURL: r.current_base_url(), AuthToken: auth_token}
+}
+
+func (r *Registry) current_base_url() string {
+	if r.base_url != "" {
+		return r.base_url
+	}
+	if r.BaseURL != "" {
+		return r.BaseURL
+	}
+	return BASE_URL
+}
+
+// Lookup returns the client of an application's environment, if there is one.
+func (r *Registry) Lookup(app string, env string) (*Client, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	client, ok := r.clients[registry_key(app, env)]
+	return client, ok
+}
+
+// For returns the client of an application's environment, so calls can be
+// chained, e.g. registry.For("cats", "prod").Notify(...). When the
+// application has no token, every call of the client fails with an error
+// wrapping ErrUnknownApp; use Lookup to check first.
+func (r *Registry) For(app string, env string) *Client {
+	key := registry_key(app, env)
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if client, ok := r.clients[key]; ok {
+		return client
+	}
+	return &Client{BaseURL: r.current_base_url(), err: fmt.Errorf("%w: %s", ErrUnknownApp, key)}
+}
+
+// Apps returns the registered "app/env" pairs.
+func (r *Registry) Apps() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	keys := make([]string, 0, len(r.clients))
+	for key := range r.clients {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// LoadEnv loads the ZEROPUSH_<APP>_<ENV>_TOKEN environment variables and
+// keeps reading them on Reload.
+func (r *Registry) LoadEnv() error {
+	return r.add_source(load_env_tokens)
+}
+
+// LoadFile loads a JSON file of the form
+//
+//	{"base_url": "...", "apps": {"app": {"prod": "token", "dev": "token"}}}
+//
+// and keeps reading it on Reload.
+func (r *Registry) LoadFile(path string) error {
+	return r.add_source(func(cfg *registry_config) error {
+		return load_file_tokens(path, cfg)
+	})
+}
+
+// add_source keeps the source only if it loads, so a bad file does not
+// break later reloads.
+func (r *Registry) add_source(source registry_source) error {
+	r.loading.Lock()
+	defer r.loading.Unlock()
+	r.mutex.RLock()
+	sources := append(append([]registry_source(nil), r.sources...), source)
+	r.mutex.RUnlock()
+	if err := r.load(sources); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.sources = sources
+	r.mutex.Unlock()
+	return nil
+}
+
+// Reload rereads all sources and swaps the clients in one go. On error the
+// current clients are kept.
+func (r *Registry) Reload() error {
+	r.loading.Lock()
+	defer r.loading.Unlock()
+	r.mutex.RLock()
+	sources := r.sources
+	r.mutex.RUnlock()
+	return r.load(sources)
+}
+
+func (r *Registry) load(sources []registry_source) error {
+	cfg := &registry_config{tokens: make(map[string]string)}
+	for _, source := range sources {
+		if err := source(cfg); err != nil {
+			return err
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key, auth_token := range r.static {
+		cfg.tokens[key] = auth_token
+	}
+	r.base_url = cfg.base_url
+	base_url := r.current_base_url()
+	clients := make(map[string]*Client, len(cfg.tokens))
+	for key, auth_token := range cfg.tokens {
+		//keep unchanged clients so callers holding them are not surprised
+		if client, ok := r.clients[key]; ok && client.AuthToken == auth_token && client.BaseURL == base_url {
+			clients[key] = client
+			continue
+		}
+		clients[key] = &Client{BaseURL: base_url, AuthToken: auth_token}
+	}
+	r.clients = clients
+	return nil
+}
+
+// Watch calls Reload every interval, DEFAULT_RELOAD_INTERVAL when it is not
+// positive, until Stop is called.
+func (r *Registry) Watch(interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_RELOAD_INTERVAL
+	}
+	r.mutex.Lock()
+	if r.stop != nil {
+		r.mutex.Unlock()
+		return
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	stop, done := r.stop, r.done
+	r.mutex.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := r.Reload(); err != nil && r.OnError != nil {
+					r.OnError(err)
+				}
+			}
+		}
+	}()
+}
+
+func (r *Registry) Stop() {
+	r.mutex.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mutex.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func load_env_tokens(cfg *registry_config) error {
+	for _, entry := range os.Environ() {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[1] == "" || !strings.HasPrefix(kv[0], "ZEROPUSH_") || !strings.HasSuffix(kv[0], "_TOKEN") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(kv[0], "ZEROPUSH_"), "_TOKEN")
+		//the app name may contain underscores, the environment may not
+		i := strings.LastIndex(name, "_")
+		if i <= 0 || i == len(name)-1 {
+			continue
+		}
+		cfg.tokens[registry_key(name[:i], name[i+1:])] = kv[1]
+	}
+	return nil
+}
+
+func load_file_tokens(path string, cfg *registry_config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	file := registry_file{}
+	if err = json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if len(file.Apps) == 0 {
+		return errors.New(path + ": no apps configured")
+	}
+	if file.BaseURL != "" {
+		cfg.base_url = file.BaseURL
+	}
+	for app, envs := range file.Apps {
+		for env, auth_token := range envs {
+			cfg.tokens[registry_key(app, env)] = auth_token
+		}
+	}
+	return nil
+}
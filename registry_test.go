@@ -0,0 +1,155 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Registry", func() {
+	var (
+		registry *Registry
+		server   *httptest.Server
+		dir      string
+		path     string
+	)
+
+	write_config := func(contents string) {
+		Expect(os.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+	}
+
+	client_for := func(app string, env string) *Client {
+		_, ok := registry.Lookup(app, env)
+		Expect(ok).To(BeTrue())
+		return registry.For(app, env)
+	}
+
+	BeforeEach(func() {
+		server = testutil.NewZeroTestServer()
+		registry = NewRegistry()
+		registry.BaseURL = server.URL
+		dir, _ = os.MkdirTemp("", "zeropush")
+		path = filepath.Join(dir, "registry.json")
+	})
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("With tokens in the environment", func() {
+		BeforeEach(func() {
+			os.Setenv("ZEROPUSH_CAT_APP_PROD_TOKEN", testutil.CORRECT_AUTH_TOKEN)
+			os.Setenv("ZEROPUSH_CAT_APP_DEV_TOKEN", testutil.WRONG_AUTH_TOKEN)
+		})
+		AfterEach(func() {
+			os.Unsetenv("ZEROPUSH_CAT_APP_PROD_TOKEN")
+			os.Unsetenv("ZEROPUSH_CAT_APP_DEV_TOKEN")
+		})
+		It("should route to the client of the app and environment", func() {
+			Expect(registry.LoadEnv()).To(Succeed())
+			Expect(registry.Apps()).To(ContainElement("cat_app/prod"))
+			Expect(registry.Apps()).To(ContainElement("cat_app/dev"))
+
+			_, err := registry.For("cat_app", "production").VerifyCredentials()
+			Expect(err).Should(BeNil())
+			_, err = client_for("CAT_APP", "dev").VerifyCredentials()
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+
+	Context("With tokens in a file", func() {
+		It("should load them", func() {
+			write_config(`{"apps": {"dog": {"prod": "` + testutil.CORRECT_AUTH_TOKEN + `"}}}`)
+			Expect(registry.LoadFile(path)).To(Succeed())
+			client, ok := registry.Lookup("dog", "prod")
+			Expect(ok).To(BeTrue())
+			Expect(client.AuthToken).To(Equal(testutil.CORRECT_AUTH_TOKEN))
+			Expect(client.BaseURL).To(Equal(server.URL))
+		})
+		It("should use the base URL of the file", func() {
+			write_config(`{"base_url": "http://example.com", "apps": {"dog": {"prod": "t"}}}`)
+			Expect(registry.LoadFile(path)).To(Succeed())
+			Expect(client_for("dog", "prod").BaseURL).To(Equal("http://example.com"))
+		})
+		It("should fail on a broken file", func() {
+			write_config(`{"apps":`)
+			Expect(registry.LoadFile(path)).ShouldNot(Succeed())
+		})
+		It("should not keep a source that failed to load", func() {
+			Expect(registry.LoadFile(filepath.Join(dir, "missing.json"))).ShouldNot(Succeed())
+			write_config(`{"apps": {"dog": {"prod": "t"}}}`)
+			Expect(registry.LoadFile(path)).To(Succeed())
+			Expect(registry.Reload()).To(Succeed())
+			Expect(registry.LoadEnv()).To(Succeed())
+			Expect(client_for("dog", "prod").AuthToken).To(Equal("t"))
+		})
+		It("should pick up changed tokens on reload and keep them on errors", func() {
+			write_config(`{"apps": {"dog": {"prod": "old"}}}`)
+			Expect(registry.LoadFile(path)).To(Succeed())
+			write_config(`{"apps": {"dog": {"prod": "new"}, "cat": {"dev": "cat"}}}`)
+			Expect(registry.Reload()).To(Succeed())
+			Expect(client_for("dog", "prod").AuthToken).To(Equal("new"))
+			Expect(registry.Apps()).To(Equal([]string{"cat/dev", "dog/prod"}))
+
+			write_config(`nonsense`)
+			Expect(registry.Reload()).ShouldNot(Succeed())
+			Expect(client_for("dog", "prod").AuthToken).To(Equal("new"))
+		})
+		It("should reload in the background while in use", func() {
+			write_config(`{"apps": {"dog": {"prod": "old"}}}`)
+			Expect(registry.LoadFile(path)).To(Succeed())
+			registry.Watch(time.Millisecond)
+			defer registry.Stop()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						registry.For("dog", "prod")
+					}
+				}()
+			}
+			write_config(`{"apps": {"dog": {"prod": "new"}}}`)
+			wg.Wait()
+			Eventually(func() string { return client_for("dog", "prod").AuthToken }).Should(Equal("new"))
+		})
+	})
+
+	Context("With a token set in code", func() {
+		It("should survive reloads", func() {
+			registry.Set("bird", "dev", "bird")
+			Expect(registry.Reload()).To(Succeed())
+			Expect(client_for("bird", "development").AuthToken).To(Equal("bird"))
+		})
+	})
+
+	Context("With an unknown app", func() {
+		It("should return a client whose calls fail", func() {
+			_, ok := registry.Lookup("nope", "prod")
+			Expect(ok).To(BeFalse())
+			_, err := registry.For("nope", "prod").Notify("hello", "", "", "", "", "", "", "abc")
+			Expect(errors.Is(err, ErrUnknownApp)).To(BeTrue())
+			Expect(err.Error()).To(HaveSuffix("nope/prod"))
+			_, err = registry.For("nope", "prod").VerifyCredentials()
+			Expect(errors.Is(err, ErrUnknownApp)).To(BeTrue())
+		})
+	})
+
+	Context("When watched without an interval", func() {
+		It("should use the default one", func() {
+			registry.Watch(0)
+			registry.Stop()
+		})
+	})
+})
@@ -0,0 +1,288 @@
+package zeropush
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	PLATFORM_IOS     = "ios"
+	PLATFORM_ANDROID = "android"
+	PLATFORM_WEB     = "web"
+)
+
+var ErrNoRoute = errors.New("no provider for the platform of the device token")
+
+// PlatformLookup maps a device token to its platform, e.g. from the device
+// registry. An empty platform falls back to TokenPlatform.
+type PlatformLookup interface {
+	Platform(device_token string) (string, error)
+}
+
+var (
+	apns_token_format = regexp.MustCompile(`^[0-9a-fA-F]{64,200}$`)
+	fcm_token_format  = regexp.MustCompile(`^[0-9A-Za-z_:-]{100,}$`)
+)
+
+// TokenPlatform guesses the platform from the format of a device token:
+// APNs tokens are hex, FCM registration tokens long and URL safe, and Web
+// Push subscriptions JSON. It returns "" when it cannot tell.
+func TokenPlatform(device_token string) string {
+	switch {
+	case strings.HasPrefix(device_token, "{"):
+		return PLATFORM_WEB
+	case apns_token_format.MatchString(device_token):
+		return PLATFORM_IOS
+	case fcm_token_format.MatchString(device_token):
+		return PLATFORM_ANDROID
+	}
+	return ""
+}
+
+// Route is the provider of a platform and the one to fail over to.
+type Route struct {
+	Primary Provider
+	//nil for no failover
+	Secondary Provider
+}
+
+type PlatformResult struct {
+	Platform     string
+	DeviceTokens []string
+	//the response of the provider that was used last
+	Response   *NotifyResponse
+	FailedOver bool
+	Err        error
+}
+
+// RouterResult is the merged response of all platforms, with the result of
+// each platform sorted by name.
+type RouterResult struct {
+	*NotifyResponse
+	Platforms []PlatformResult
+}
+
+// Router sends a notification to the provider of each device token's
+// platform, all platforms concurrently. When a primary provider fails
+// without delivering anything, e.g. because its circuit is open, the
+// platform fails over to its secondary provider. Partly delivered sends are
+// not retried so devices are not notified twice.
+type Router struct {
+	Routes map[string]*Route
+	//nil to go by TokenPlatform only
+	Lookup PlatformLookup
+	//the platform of tokens neither the lookup nor TokenPlatform know, if any
+	Default string
+}
+
+func NewRouter(lookup PlatformLookup) *Router {
+	return &Router{Routes: make(map[string]*Route), Lookup: lookup}
+}
+
+// Handle routes the device tokens of platform to primary, failing over to
+// secondary, which may be nil.
+func (r *Router) Handle(platform string, primary Provider, secondary Provider) {
+	r.Routes[platform] = &Route{Primary: primary, Secondary: secondary}
+}
+
+var _ Provider = (*Router)(nil)
+
+func (r *Router) Notify(alert string, badge string, sound string, info string, expiry string, content_available string, category string, device_tokens ...string) (*NotifyResponse, error) {
+	return r.Send(&Notification{
+		Alert:            alert,
+		Badge:            badge,
+		Sound:            sound,
+		Info:             info,
+		Expiry:           expiry,
+		ContentAvailable: content_available,
+		Category:         category,
+		DeviceTokens:     device_tokens,
+	})
+}
+
+func (r *Router) Broadcast(channel string, alert string, badge string, sound string, info string, expiry string, content_available string, category string) (*BroadcastResponse, error) {
+	response, err := r.Send(&Notification{
+		Channel:          channel,
+		Alert:            alert,
+		Badge:            badge,
+		Sound:            sound,
+		Info:             info,
+		Expiry:           expiry,
+		ContentAvailable: content_available,
+		Category:         category,
+	})
+	if response == nil {
+		return nil, err
+	}
+	return &BroadcastResponse{ZeroResponse: response.ZeroResponse, SentCount: response.SentCount}, err
+}
+
+func (r *Router) Send(n *Notification) (*NotifyResponse, error) {
+	result, err := r.Route(n)
+	if result == nil {
+		return nil, err
+	}
+	return result.NotifyResponse, err
+}
+
+// Route sends n and reports per platform. A broadcast goes to every
+// platform whose provider supports channels. The error is the first
+// platform error.
+func (r *Router) Route(n *Notification) (*RouterResult, error) {
+	if n == nil {
+		return nil, errors.New("notification cannot be nil")
+	}
+	groups := make(map[string][]string)
+	var claims *broadcast_claims
+	if n.Channel != "" {
+		//once per provider when platforms share one
+		claims = &broadcast_claims{}
+		for _, platform := range sorted_platforms(r.Routes) {
+			if claims.claim(r.Routes[platform].Primary) {
+				groups[platform] = nil
+			}
+		}
+	} else {
+		if len(n.DeviceTokens) == 0 {
+			return nil, errors.New("device tokens cannot be empty")
+		}
+		for _, token := range n.DeviceTokens {
+			platform := r.platform(token)
+			groups[platform] = append(groups[platform], token)
+		}
+	}
+	platforms := make([]string, 0, len(groups))
+	for platform := range groups {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+
+	results := make([]PlatformResult, len(platforms))
+	var wg sync.WaitGroup
+	for i, platform := range platforms {
+		wg.Add(1)
+		go func(i int, platform string) {
+			defer wg.Done()
+			results[i] = r.send_platform(n, platform, groups[platform], claims)
+		}(i, platform)
+	}
+	wg.Wait()
+	return merge_platform_results(n, results)
+}
+
+// broadcast_claims makes sure no provider broadcasts twice, also when
+// several platforms fail over to the same one.
+type broadcast_claims struct {
+	mutex     sync.Mutex
+	providers []Provider
+}
+
+func (c *broadcast_claims) claim(provider Provider) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, p := range c.providers {
+		if p == provider {
+			return false
+		}
+	}
+	c.providers = append(c.providers, provider)
+	return true
+}
+
+func sorted_platforms(routes map[string]*Route) []string {
+	platforms := make([]string, 0, len(routes))
+	for platform := range routes {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	return platforms
+}
+
+func (r *Router) platform(device_token string) string {
+	if r.Lookup != nil {
+		platform, err := r.Lookup.Platform(device_token)
+		if err != nil {
+			log.Printf("Error looking up the platform of %s, going by its format: %s", device_token, err)
+		} else if platform != "" {
+			return platform
+		}
+	}
+	if platform := TokenPlatform(device_token); platform != "" {
+		return platform
+	}
+	return r.Default
+}
+
+func (r *Router) send_platform(n *Notification, platform string, device_tokens []string, claims *broadcast_claims) PlatformResult {
+	result := PlatformResult{Platform: platform, DeviceTokens: device_tokens}
+	route := r.Routes[platform]
+	if route == nil || route.Primary == nil {
+		result.Err = ErrNoRoute
+		return result
+	}
+	part := *n
+	part.DeviceTokens = device_tokens
+	if part.IdempotencyKey != "" {
+		//the providers may share an idempotency store
+		part.IdempotencyKey += "/" + platform
+	}
+	result.Response, result.Err = route.Primary.Send(&part)
+	if result.Err != nil && route.Secondary != nil && delivered_nothing(result.Response) {
+		log.Printf("Error sending to %s, failing over: %s", platform, result.Err)
+		result.FailedOver = true
+		if claims != nil && !claims.claim(route.Secondary) {
+			//the secondary broadcasts for another platform already
+			result.Response, result.Err = nil, ErrBroadcastNotSupported
+			return result
+		}
+		result.Response, result.Err = route.Secondary.Send(&part)
+	}
+	return result
+}
+
+func delivered_nothing(response *NotifyResponse) bool {
+	return response == nil || response.SentCount == 0 && len(response.InactiveTokens) == 0 && len(response.UnregisteredTokens) == 0
+}
+
+// merge_platform_results sums up the platform responses. Platforms that do
+// not support broadcasts are left out of a broadcast without an error,
+// unless none does.
+func merge_platform_results(n *Notification, results []PlatformResult) (*RouterResult, error) {
+	merged := &RouterResult{NotifyResponse: &NotifyResponse{ZeroResponse: &ZeroResponse{}}}
+	var first_err error
+	broadcast_supported := false
+	for i := range results {
+		result := &results[i]
+		if n.Channel != "" && result.Err == ErrBroadcastNotSupported {
+			result.Err = nil
+			continue
+		}
+		broadcast_supported = true
+		entry := map[string]interface{}{"platform": result.Platform, "device_tokens": len(result.DeviceTokens), "failed_over": result.FailedOver}
+		if response := result.Response; response != nil {
+			entry["sent_count"] = response.SentCount
+			merged.SentCount += response.SentCount
+			merged.InactiveTokens = append(merged.InactiveTokens, response.InactiveTokens...)
+			merged.UnregisteredTokens = append(merged.UnregisteredTokens, response.UnregisteredTokens...)
+		}
+		if result.Err != nil {
+			entry["error"] = result.Err.Error()
+			if first_err == nil {
+				first_err = result.Err
+			}
+		}
+		merged.Body = append(merged.Body, entry)
+	}
+	merged.Platforms = results
+	if n.Channel != "" && !broadcast_supported {
+		return merged, ErrBroadcastNotSupported
+	}
+	if first_err != nil {
+		merged.Error = map[string]string{"error": first_err.Error()}
+	}
+	return merged, first_err
+}
@@ -0,0 +1,163 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"errors"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fake_provider records what it was asked to send
+type fake_provider struct {
+	mutex      sync.Mutex
+	sent       []*Notification
+	err        error
+	inactive   []string
+	broadcasts bool
+}
+
+func (p *fake_provider) Notify(alert string, badge string, sound string, info string, expiry string, content_available string, category string, device_tokens ...string) (*NotifyResponse, error) {
+	return p.Send(&Notification{Alert: alert, DeviceTokens: device_tokens})
+}
+
+func (p *fake_provider) Broadcast(channel string, alert string, badge string, sound string, info string, expiry string, content_available string, category string) (*BroadcastResponse, error) {
+	return nil, ErrBroadcastNotSupported
+}
+
+func (p *fake_provider) Send(n *Notification) (*NotifyResponse, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if n.Channel != "" && !p.broadcasts {
+		return nil, ErrBroadcastNotSupported
+	}
+	p.sent = append(p.sent, n)
+	if p.err != nil {
+		return nil, p.err
+	}
+	response := &NotifyResponse{ZeroResponse: &ZeroResponse{}}
+	for _, token := range n.DeviceTokens {
+		if contains(p.inactive, token) {
+			response.InactiveTokens = append(response.InactiveTokens, token)
+		} else {
+			response.SentCount++
+		}
+	}
+	if n.Channel != "" {
+		response.SentCount = 10
+	}
+	return response, nil
+}
+
+func (p *fake_provider) Sent() []*Notification {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]*Notification(nil), p.sent...)
+}
+
+func contains(tokens []string, token string) bool {
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+type platform_map map[string]string
+
+func (m platform_map) Platform(device_token string) (string, error) {
+	if device_token == "lookup_fails" {
+		return "", errors.New("registry down")
+	}
+	return m[device_token], nil
+}
+
+var _ = Describe("Router", func() {
+	var (
+		ios, android, web, fallback *fake_provider
+		router                      *Router
+	)
+	ios_token := strings.Repeat("ab", 32)
+	android_token := "dGVzdA:APA91b" + strings.Repeat("x", 120)
+	web_token := `{"endpoint":"https://push.example.com/1","keys":{"p256dh":"a","auth":"b"}}`
+
+	BeforeEach(func() {
+		ios, android, web, fallback = &fake_provider{}, &fake_provider{}, &fake_provider{}, &fake_provider{broadcasts: true}
+		router = NewRouter(platform_map{"legacy": PLATFORM_ANDROID})
+		router.Handle(PLATFORM_IOS, ios, fallback)
+		router.Handle(PLATFORM_ANDROID, android, fallback)
+		router.Handle(PLATFORM_WEB, web, nil)
+	})
+
+	It("should route tokens by the lookup and by their format", func() {
+		android.inactive = []string{"legacy"}
+		result, err := router.Route(&Notification{Alert: "hello", DeviceTokens: []string{ios_token, android_token, web_token, "legacy"}})
+		Expect(err).Should(BeNil())
+		Expect(ios.Sent()[0].DeviceTokens).To(Equal([]string{ios_token}))
+		Expect(android.Sent()[0].DeviceTokens).To(Equal([]string{android_token, "legacy"}))
+		Expect(web.Sent()[0].DeviceTokens).To(Equal([]string{web_token}))
+		Expect(fallback.Sent()).To(BeEmpty())
+
+		Expect(result.SentCount).To(Equal(3))
+		Expect(result.InactiveTokens).To(Equal([]string{"legacy"}))
+		Expect(result.Platforms).To(HaveLen(3))
+		Expect(result.Platforms[0].Platform).To(Equal(PLATFORM_ANDROID))
+		Expect(result.Body[0]["sent_count"]).To(Equal(1))
+	})
+	It("should fail over to the secondary provider", func() {
+		ios.err = errors.New("circuit open")
+		response, err := router.Notify("hello", "", "", "", "", "", "", ios_token, android_token)
+		Expect(err).Should(BeNil())
+		Expect(response.SentCount).To(Equal(2))
+		Expect(fallback.Sent()[0].DeviceTokens).To(Equal([]string{ios_token}))
+		Expect(response.Body[1]["failed_over"]).To(Equal(true))
+	})
+	It("should report platforms that failed without a secondary", func() {
+		web.err = errors.New("push service down")
+		result, err := router.Route(&Notification{Alert: "hello", DeviceTokens: []string{ios_token, web_token}})
+		Expect(err).To(Equal(web.err))
+		Expect(result.SentCount).To(Equal(1))
+		Expect(result.Platforms[1].Err).To(Equal(web.err))
+		Expect(result.Error["error"]).To(Equal("push service down"))
+	})
+	It("should report tokens without a route", func() {
+		router.Lookup = nil
+		result, err := router.Route(&Notification{Alert: "hello", DeviceTokens: []string{"short", "lookup_fails"}})
+		Expect(err).To(Equal(ErrNoRoute))
+		Expect(result.Platforms[0].DeviceTokens).To(Equal([]string{"short", "lookup_fails"}))
+
+		router.Default = PLATFORM_IOS
+		_, err = router.Notify("hello", "", "", "", "", "", "", "short")
+		Expect(err).Should(BeNil())
+		Expect(ios.Sent()).To(HaveLen(1))
+	})
+	It("should keep idempotency keys apart per platform", func() {
+		router.Send(&Notification{Alert: "hello", IdempotencyKey: "k", DeviceTokens: []string{ios_token, android_token}})
+		Expect(ios.Sent()[0].IdempotencyKey).To(Equal("k/ios"))
+		Expect(android.Sent()[0].IdempotencyKey).To(Equal("k/android"))
+	})
+	It("should broadcast once per provider that supports channels", func() {
+		response, err := router.Broadcast("news", "hello", "", "", "", "", "", "")
+		Expect(err).Should(BeNil())
+		Expect(response.SentCount).To(Equal(10))
+		//android and ios fail over to the same provider
+		Expect(fallback.Sent()).To(HaveLen(1))
+
+		web.broadcasts, router.Routes[PLATFORM_IOS].Secondary, router.Routes[PLATFORM_ANDROID].Secondary = false, nil, nil
+		_, err = router.Broadcast("news", "hello", "", "", "", "", "", "")
+		Expect(err).To(Equal(ErrBroadcastNotSupported))
+	})
+})
+
+var _ = Describe("TokenPlatform", func() {
+	It("should tell platforms apart by the token format", func() {
+		Expect(TokenPlatform(strings.Repeat("0f", 32))).To(Equal(PLATFORM_IOS))
+		Expect(TokenPlatform("cXJ:APA91b" + strings.Repeat("_-", 70))).To(Equal(PLATFORM_ANDROID))
+		Expect(TokenPlatform(`{"endpoint":"https://push.example.com"}`)).To(Equal(PLATFORM_WEB))
+		Expect(TokenPlatform("abc")).To(Equal(""))
+	})
+})
@@ -0,0 +1,467 @@
+package zeropush
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	SCHEDULE_PENDING   = "pending"
+	SCHEDULE_DONE      = "done"
+	SCHEDULE_FAILED    = "failed"
+	SCHEDULE_CANCELLED = "cancelled"
+	SCHEDULE_MISSED    = "missed"
+)
+
+// What the Scheduler does with jobs that were due more than Grace ago,
+// e.g. after downtime.
+const (
+	//drop the missed sends, recurring jobs carry on from their next time
+	MISSED_SKIP = "skip"
+	//send once, however many times a recurring job was missed
+	MISSED_RUN_ONCE = "run_once"
+	//send once for every missed occurrence of a recurring job
+	MISSED_RUN_ALL = "run_all"
+)
+
+const (
+	// DEFAULT_SCHEDULE_INTERVAL is used by Start when Interval is not set.
+	DEFAULT_SCHEDULE_INTERVAL = time.Second
+	// DEFAULT_SCHEDULE_ATTEMPTS is used when MaxAttempts is not set.
+	DEFAULT_SCHEDULE_ATTEMPTS = 5
+)
+
+var ErrScheduleNotFound = errors.New("scheduled job not found")
+
+type ScheduledJob struct {
+	ID           string        `json:"id"`
+	Notification *Notification `json:"notification"`
+	//the next time the job is due
+	SendAt time.Time `json:"send_at"`
+	//standard cron spec of recurring jobs, e.g. "0 9 * * MON" or "CRON_TZ=Europe/Istanbul @daily"
+	Cron      string    `json:"cron,omitempty"`
+	Status    string    `json:"status"`
+	Runs      int       `json:"runs"`
+	LastRunAt time.Time `json:"last_run_at"`
+	LastError string    `json:"last_error,omitempty"`
+	//failed sends of the occurrence that is retried at SendAt
+	Attempts int       `json:"attempts,omitempty"`
+	RetryOf  time.Time `json:"retry_of"`
+}
+
+// ScheduleStore keeps the scheduled jobs. Implementations must store copies,
+// the Scheduler modifies the jobs it gets back.
+type ScheduleStore interface {
+	Save(job *ScheduledJob) error
+	Get(id string) (*ScheduledJob, error)
+	//pending jobs with SendAt not after before, oldest first
+	Due(before time.Time) ([]*ScheduledJob, error)
+}
+
+type MemoryScheduleStore struct {
+	mutex sync.Mutex
+	jobs  map[string]*ScheduledJob
+}
+
+func NewMemoryScheduleStore() *MemoryScheduleStore {
+	return &MemoryScheduleStore{jobs: make(map[string]*ScheduledJob)}
+}
+
+func (s *MemoryScheduleStore) Save(job *ScheduledJob) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	job_copy := *job
+	s.jobs[job.ID] = &job_copy
+	return nil
+}
+
+func (s *MemoryScheduleStore) Get(id string) (*ScheduledJob, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+	job_copy := *job
+	return &job_copy, nil
+}
+
+func (s *MemoryScheduleStore) Due(before time.Time) ([]*ScheduledJob, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var due []*ScheduledJob
+	for _, job := range s.jobs {
+		if job.Status == SCHEDULE_PENDING && !job.SendAt.After(before) {
+			job_copy := *job
+			due = append(due, &job_copy)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].SendAt.Before(due[j].SendAt) })
+	return due, nil
+}
+
+// FileScheduleStore is a MemoryScheduleStore that rewrites a JSON file on
+// every change.
+type FileScheduleStore struct {
+	*MemoryScheduleStore
+	path string
+}
+
+func OpenFileScheduleStore(path string) (*FileScheduleStore, error) {
+	s := &FileScheduleStore{MemoryScheduleStore: NewMemoryScheduleStore(), path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*ScheduledJob
+	if err = json.Unmarshal(data, &jobs); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for _, job := range jobs {
+		s.jobs[job.ID] = job
+	}
+	return s, nil
+}
+
+func (s *FileScheduleStore) Save(job *ScheduledJob) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous, existed := s.jobs[job.ID]
+	job_copy := *job
+	s.jobs[job.ID] = &job_copy
+	if err := s.write(); err != nil {
+		//keep memory and file in step
+		if existed {
+			s.jobs[job.ID] = previous
+		} else {
+			delete(s.jobs, job.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// write replaces the file with the jobs in memory; callers hold the mutex.
+func (s *FileScheduleStore) write() error {
+	jobs := make([]*ScheduledJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Scheduler sends notifications at a given time or on a cron schedule.
+// Sends that fail with transport errors, timeouts, an open circuit or 429
+// and 5xx answers are retried after Backoff, up to MaxAttempts sends of an
+// occurrence; other failures give the occurrence up right away.
+type Scheduler struct {
+	Client   *Client
+	Store    ScheduleStore
+	Interval time.Duration
+	//jobs found more than Grace past their time count as missed
+	Grace  time.Duration
+	Missed string
+	//sends of one occurrence before it is given up, DEFAULT_SCHEDULE_ATTEMPTS when not set
+	MaxAttempts int
+	//delay before the given retry, defaults to exponential backoff from 1s to 5m
+	Backoff func(attempt int) time.Duration
+	//called with errors of background runs, job is nil when the store failed
+	OnError func(job *ScheduledJob, err error)
+
+	//serializes runs, which send without holding mutex
+	pass  sync.Mutex
+	mutex sync.Mutex
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewScheduler(client *Client, store ScheduleStore) *Scheduler {
+	return &Scheduler{
+		Client:      client,
+		Store:       store,
+		Interval:    DEFAULT_SCHEDULE_INTERVAL,
+		Grace:       time.Minute,
+		Missed:      MISSED_RUN_ONCE,
+		MaxAttempts: DEFAULT_SCHEDULE_ATTEMPTS,
+		Backoff:     default_backoff,
+	}
+}
+
+// Schedule sends n once at the given time and returns the job ID.
+func (s *Scheduler) Schedule(n *Notification, at time.Time) (string, error) {
+	return s.add(n, &ScheduledJob{SendAt: at})
+}
+
+// ScheduleCron sends n on every occurrence of the standard cron spec.
+func (s *Scheduler) ScheduleCron(n *Notification, spec string) (string, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return "", err
+	}
+	return s.add(n, &ScheduledJob{Cron: spec, SendAt: schedule.Next(time.Now())})
+}
+
+func (s *Scheduler) add(n *Notification, job *ScheduledJob) (string, error) {
+	if n == nil {
+		return "", errors.New("notification cannot be nil")
+	}
+	job.ID = new_job_id()
+	job.Notification = n
+	job.Status = SCHEDULE_PENDING
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.Store.Save(job); err != nil {
+		log.Printf("Error saving the scheduled job: %s", err)
+		return "", err
+	}
+	return job.ID, nil
+}
+
+// Cancel stops a pending job from being sent again.
+func (s *Scheduler) Cancel(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	job, err := s.Store.Get(id)
+	if err != nil {
+		return err
+	}
+	if job.Status != SCHEDULE_PENDING {
+		return fmt.Errorf("scheduled job %s is already %s", id, job.Status)
+	}
+	job.Status = SCHEDULE_CANCELLED
+	return s.Store.Save(job)
+}
+
+func (s *Scheduler) Job(id string) (*ScheduledJob, error) {
+	return s.Store.Get(id)
+}
+
+// RunDue sends the jobs due at now and returns the number of notifications
+// sent. The sends run without holding the lock, so jobs can be scheduled and
+// cancelled meanwhile; a job cancelled during its send stays cancelled.
+func (s *Scheduler) RunDue(now time.Time) (int, error) {
+	s.pass.Lock()
+	defer s.pass.Unlock()
+	s.mutex.Lock()
+	jobs, err := s.Store.Due(now)
+	s.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, due := range jobs {
+		job, ok := s.pending(due.ID, now)
+		if !ok {
+			continue
+		}
+		n, err := s.run(job, now)
+		sent += n
+		if save_err := s.save(job); save_err != nil && err == nil {
+			err = save_err
+		}
+		if err != nil {
+			log.Printf("Error running scheduled job %s: %s", job.ID, err)
+			if s.OnError != nil {
+				s.OnError(job, err)
+			}
+		}
+	}
+	return sent, nil
+}
+
+// pending returns the job if it is still pending and due.
+func (s *Scheduler) pending(id string, now time.Time) (*ScheduledJob, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	job, err := s.Store.Get(id)
+	if err != nil {
+		return nil, false
+	}
+	return job, job.Status == SCHEDULE_PENDING && !job.SendAt.After(now)
+}
+
+// save stores the outcome of a run, keeping a status set meanwhile.
+func (s *Scheduler) save(job *ScheduledJob) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if current, err := s.Store.Get(job.ID); err == nil && current.Status != SCHEDULE_PENDING {
+		job.Status = current.Status
+	}
+	return s.Store.Save(job)
+}
+
+// run sends one due job and moves it on, without saving it.
+func (s *Scheduler) run(job *ScheduledJob, now time.Time) (int, error) {
+	var schedule cron.Schedule
+	if job.Cron != "" {
+		var err error
+		if schedule, err = cron.ParseStandard(job.Cron); err != nil {
+			job.Status = SCHEDULE_FAILED
+			job.LastError = err.Error()
+			return 0, err
+		}
+	}
+
+	retrying := !job.RetryOf.IsZero()
+	first := job.SendAt
+	if retrying {
+		first = job.RetryOf
+	}
+	occurrences := []time.Time{first}
+	if retrying || now.Sub(first) > s.Grace {
+		switch {
+		case s.Missed == MISSED_SKIP && !retrying:
+			occurrences = nil
+		case s.Missed == MISSED_RUN_ALL && schedule != nil:
+			for t := schedule.Next(first); !t.After(now); t = schedule.Next(t) {
+				occurrences = append(occurrences, t)
+			}
+		}
+	}
+
+	sent := 0
+	var send_err error
+	var failed time.Time
+	for _, occurrence := range occurrences {
+		if _, send_err = s.Client.Send(occurrence_notification(job, occurrence)); send_err != nil {
+			failed = occurrence
+			break
+		}
+		sent++
+	}
+	job.Runs += sent
+	if sent > 0 {
+		job.LastRunAt = now
+	}
+	job.LastError = ""
+	if send_err != nil {
+		job.LastError = send_err.Error()
+		if failed.Equal(job.RetryOf) {
+			job.Attempts++
+		} else {
+			job.Attempts = 1
+		}
+		if retryable(send_err) && job.Attempts < s.max_attempts() {
+			job.RetryOf = failed
+			job.SendAt = now.Add(s.backoff(job.Attempts))
+			return sent, send_err
+		}
+	}
+	job.Attempts = 0
+	job.RetryOf = time.Time{}
+	switch {
+	case schedule != nil:
+		job.SendAt = schedule.Next(now)
+	case send_err != nil:
+		job.Status = SCHEDULE_FAILED
+	case len(occurrences) == 0:
+		job.Status = SCHEDULE_MISSED
+	default:
+		job.Status = SCHEDULE_DONE
+	}
+	return sent, send_err
+}
+
+func (s *Scheduler) max_attempts() int {
+	if s.MaxAttempts <= 0 {
+		return DEFAULT_SCHEDULE_ATTEMPTS
+	}
+	return s.MaxAttempts
+}
+
+func (s *Scheduler) backoff(attempt int) time.Duration {
+	if s.Backoff == nil {
+		return default_backoff(attempt)
+	}
+	return s.Backoff(attempt)
+}
+
+// occurrence_notification keys each occurrence, so a send repeated after a
+// crash between sending and saving is suppressed by the client's
+// idempotency store while the next occurrence still goes out.
+func occurrence_notification(job *ScheduledJob, occurrence time.Time) *Notification {
+	n := *job.Notification
+	key := n.IdempotencyKey
+	if key == "" {
+		key = job.ID
+	}
+	n.IdempotencyKey = fmt.Sprintf("%s/%d", key, occurrence.Unix())
+	return &n
+}
+
+// Start runs RunDue every Interval, DEFAULT_SCHEDULE_INTERVAL when it is not
+// set, until Stop is called.
+func (s *Scheduler) Start() {
+	s.mutex.Lock()
+	if s.stop != nil {
+		s.mutex.Unlock()
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	stop, done := s.stop, s.done
+	interval := s.Interval
+	if interval <= 0 {
+		interval = DEFAULT_SCHEDULE_INTERVAL
+	}
+	s.mutex.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := s.RunDue(time.Now()); err != nil {
+				log.Printf("Error reading the scheduled jobs: %s", err)
+				if s.OnError != nil {
+					s.OnError(nil, err)
+				}
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mutex.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,270 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Scheduler", func() {
+	var (
+		client    *Client
+		server    *testutil.RecordingServer
+		scheduler *Scheduler
+	)
+	notification := &Notification{Alert: "reminder", DeviceTokens: []string{"abc"}}
+	daily := "CRON_TZ=UTC 0 9 * * *"
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+		scheduler = NewScheduler(client, NewMemoryScheduleStore())
+	})
+	AfterEach(func() {
+		scheduler.Stop()
+		server.Close()
+	})
+
+	Context("With a one-off job", func() {
+		It("should send it once it is due", func() {
+			at := time.Now().Add(time.Hour)
+			id, err := scheduler.Schedule(notification, at)
+			Expect(err).Should(BeNil())
+
+			n, _ := scheduler.RunDue(at.Add(-time.Second))
+			Expect(n).To(Equal(0))
+			n, _ = scheduler.RunDue(at)
+			Expect(n).To(Equal(1))
+			n, _ = scheduler.RunDue(at.Add(time.Second))
+			Expect(n).To(Equal(0))
+
+			job, _ := scheduler.Job(id)
+			Expect(job.Status).To(Equal(SCHEDULE_DONE))
+			Expect(job.Runs).To(Equal(1))
+			Expect(server.Requests()).To(HaveLen(1))
+		})
+		It("should not send a cancelled job", func() {
+			at := time.Now().Add(time.Hour)
+			id, _ := scheduler.Schedule(notification, at)
+			Expect(scheduler.Cancel(id)).To(Succeed())
+			n, _ := scheduler.RunDue(at)
+			Expect(n).To(Equal(0))
+			job, _ := scheduler.Job(id)
+			Expect(job.Status).To(Equal(SCHEDULE_CANCELLED))
+			Expect(scheduler.Cancel(id)).ShouldNot(Succeed())
+		})
+		It("should mark a failed send", func() {
+			client.AuthToken = testutil.WRONG_AUTH_TOKEN
+			var failed *ScheduledJob
+			scheduler.OnError = func(job *ScheduledJob, err error) { failed = job }
+			at := time.Now()
+			id, _ := scheduler.Schedule(notification, at)
+			scheduler.RunDue(at)
+			job, _ := scheduler.Job(id)
+			Expect(job.Status).To(Equal(SCHEDULE_FAILED))
+			Expect(job.LastError).ShouldNot(BeEmpty())
+			Expect(failed.ID).To(Equal(id))
+		})
+		It("should retry a transient failure after the backoff", func() {
+			scheduler.Backoff = func(attempt int) time.Duration { return time.Duration(attempt) * time.Minute }
+			server.FailNext(1)
+			at := time.Now()
+			id, _ := scheduler.Schedule(notification, at)
+			n, err := scheduler.RunDue(at)
+			Expect(err).Should(BeNil())
+			Expect(n).To(Equal(0))
+			job, _ := scheduler.Job(id)
+			Expect(job.Status).To(Equal(SCHEDULE_PENDING))
+			Expect(job.Attempts).To(Equal(1))
+			Expect(job.LastError).ShouldNot(BeEmpty())
+			Expect(job.SendAt).To(Equal(at.Add(time.Minute)))
+
+			n, _ = scheduler.RunDue(at.Add(30 * time.Second))
+			Expect(n).To(Equal(0))
+			n, _ = scheduler.RunDue(at.Add(time.Minute))
+			Expect(n).To(Equal(1))
+			job, _ = scheduler.Job(id)
+			Expect(job.Status).To(Equal(SCHEDULE_DONE))
+			Expect(job.Attempts).To(Equal(0))
+			requests := server.Requests()
+			Expect(requests).To(HaveLen(2))
+			Expect(requests[1].Header.Get(IDEMPOTENCY_HEADER)).To(Equal(requests[0].Header.Get(IDEMPOTENCY_HEADER)))
+		})
+		It("should give up after the maximum number of attempts", func() {
+			scheduler.MaxAttempts = 2
+			scheduler.Backoff = func(attempt int) time.Duration { return time.Minute }
+			server.FailWith(503)
+			at := time.Now()
+			id, _ := scheduler.Schedule(notification, at)
+			scheduler.RunDue(at)
+			scheduler.RunDue(at.Add(time.Minute))
+			job, _ := scheduler.Job(id)
+			Expect(job.Status).To(Equal(SCHEDULE_FAILED))
+			Expect(server.Requests()).To(HaveLen(2))
+		})
+		It("should not block cancelling while a send is under way", func() {
+			entered := make(chan struct{}, 1)
+			release := make(chan struct{})
+			client.Use(func(next Doer) Doer {
+				return DoerFunc(func(req *http.Request) (*http.Response, error) {
+					entered <- struct{}{}
+					<-release
+					return next.Do(req)
+				})
+			})
+			at := time.Now()
+			id, _ := scheduler.Schedule(notification, at)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				scheduler.RunDue(at)
+			}()
+			<-entered
+			cancelled := make(chan error, 1)
+			go func() { cancelled <- scheduler.Cancel(id) }()
+			Eventually(cancelled).Should(Receive(BeNil()))
+			close(release)
+			<-done
+			job, _ := scheduler.Job(id)
+			Expect(job.Status).To(Equal(SCHEDULE_CANCELLED))
+			Expect(job.Runs).To(Equal(1))
+		})
+		It("should skip it when missed with the skip policy", func() {
+			scheduler.Missed = MISSED_SKIP
+			at := time.Now()
+			id, _ := scheduler.Schedule(notification, at)
+			n, _ := scheduler.RunDue(at.Add(time.Hour))
+			Expect(n).To(Equal(0))
+			job, _ := scheduler.Job(id)
+			Expect(job.Status).To(Equal(SCHEDULE_MISSED))
+		})
+		It("should send it in the background", func() {
+			scheduler.Interval = time.Millisecond
+			id, _ := scheduler.Schedule(notification, time.Now())
+			scheduler.Start()
+			Eventually(func() string {
+				job, _ := scheduler.Job(id)
+				return job.Status
+			}).Should(Equal(SCHEDULE_DONE))
+		})
+	})
+
+	Context("With a recurring job", func() {
+		It("should send on every occurrence", func() {
+			id, err := scheduler.ScheduleCron(notification, daily)
+			Expect(err).Should(BeNil())
+			job, _ := scheduler.Job(id)
+			first := job.SendAt
+			Expect(first.UTC().Hour()).To(Equal(9))
+
+			scheduler.RunDue(first)
+			job, _ = scheduler.Job(id)
+			Expect(job.SendAt).To(Equal(first.Add(24 * time.Hour)))
+			Expect(job.Status).To(Equal(SCHEDULE_PENDING))
+
+			//each occurrence gets its own idempotency key
+			client.Idempotency = NewMemoryIdempotencyStore(10)
+			scheduler.RunDue(job.SendAt)
+			Expect(server.Requests()).To(HaveLen(2))
+		})
+		It("should retry a failed occurrence before moving on", func() {
+			scheduler.Backoff = func(attempt int) time.Duration { return time.Minute }
+			id, _ := scheduler.ScheduleCron(notification, daily)
+			job, _ := scheduler.Job(id)
+			first := job.SendAt
+
+			server.FailNext(1)
+			scheduler.RunDue(first)
+			job, _ = scheduler.Job(id)
+			Expect(job.Status).To(Equal(SCHEDULE_PENDING))
+			Expect(job.SendAt).To(Equal(first.Add(time.Minute)))
+			Expect(job.RetryOf).To(Equal(first))
+
+			n, _ := scheduler.RunDue(first.Add(time.Minute))
+			Expect(n).To(Equal(1))
+			job, _ = scheduler.Job(id)
+			Expect(job.SendAt).To(Equal(first.Add(24 * time.Hour)))
+			Expect(job.RetryOf.IsZero()).To(BeTrue())
+			requests := server.Requests()
+			Expect(requests[1].Header.Get(IDEMPOTENCY_HEADER)).To(Equal(requests[0].Header.Get(IDEMPOTENCY_HEADER)))
+		})
+		It("should reject a broken spec", func() {
+			_, err := scheduler.ScheduleCron(notification, "every tuesday")
+			Expect(err).ShouldNot(BeNil())
+		})
+
+		Context("After downtime", func() {
+			var (
+				id    string
+				first time.Time
+			)
+			BeforeEach(func() {
+				id, _ = scheduler.ScheduleCron(notification, daily)
+				job, _ := scheduler.Job(id)
+				first = job.SendAt
+			})
+			//three days and an hour later
+			downtime := 3*24*time.Hour + time.Hour
+
+			It("should send once with the run once policy", func() {
+				n, _ := scheduler.RunDue(first.Add(downtime))
+				Expect(n).To(Equal(1))
+			})
+			It("should send every missed occurrence with the run all policy", func() {
+				scheduler.Missed = MISSED_RUN_ALL
+				n, _ := scheduler.RunDue(first.Add(downtime))
+				Expect(n).To(Equal(4))
+			})
+			It("should carry on from the next occurrence with the skip policy", func() {
+				scheduler.Missed = MISSED_SKIP
+				n, _ := scheduler.RunDue(first.Add(downtime))
+				Expect(n).To(Equal(0))
+				job, _ := scheduler.Job(id)
+				Expect(job.Status).To(Equal(SCHEDULE_PENDING))
+				Expect(job.SendAt).To(Equal(first.Add(4 * 24 * time.Hour)))
+			})
+		})
+	})
+
+	Context("Without an interval", func() {
+		It("should start with the default one", func() {
+			literal := &Scheduler{Client: client, Store: NewMemoryScheduleStore()}
+			literal.Start()
+			literal.Stop()
+		})
+	})
+
+	Context("With a file store", func() {
+		It("should keep jobs across restarts", func() {
+			dir, _ := os.MkdirTemp("", "zeropush")
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "schedule.json")
+			store, err := OpenFileScheduleStore(path)
+			Expect(err).Should(BeNil())
+			at := time.Now().Add(time.Hour)
+			id, _ := NewScheduler(client, store).Schedule(notification, at)
+
+			store, err = OpenFileScheduleStore(path)
+			Expect(err).Should(BeNil())
+			scheduler = NewScheduler(client, store)
+			n, _ := scheduler.RunDue(at)
+			Expect(n).To(Equal(1))
+			job, _ := scheduler.Job(id)
+			Expect(job.Status).To(Equal(SCHEDULE_DONE))
+			Expect(job.Notification.Alert).To(Equal("reminder"))
+		})
+	})
+
+	Context("With an unknown job", func() {
+		It("should come back with an error", func() {
+			Expect(scheduler.Cancel("nope")).To(Equal(ErrScheduleNotFound))
+		})
+	})
+})
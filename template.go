@@ -0,0 +1,165 @@
+package zeropush
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// MAX_TEMPLATE_TOKENS is the most device tokens SendTemplate puts in one
+// Notify call, as they all go into its URL.
+const MAX_TEMPLATE_TOKENS = 100
+
+// ErrInvalidInfo is returned by Render when info does not render to JSON.
+var ErrInvalidInfo = errors.New("info is not valid JSON")
+
+// Template renders the alert, sound, category and info of a notification
+// with text/template, e.g. "{{.Name}} started following you". Missing keys
+// are rendering errors rather than "<no value>". The json function encodes
+// a value for info, e.g. `{"user":{{json .Name}}}`, and info that does not
+// render to valid JSON is an error.
+type Template struct {
+	//badge, expiry and the rest are copied from here into every rendered notification
+	Base Notification
+
+	alert    *template.Template
+	sound    *template.Template
+	category *template.Template
+	info     *template.Template
+}
+
+// NewTemplate parses the templates; empty ones render to "".
+func NewTemplate(alert string, sound string, category string, info string) (*Template, error) {
+	t := &Template{}
+	var err error
+	if t.alert, err = parse_template("alert", alert); err != nil {
+		return nil, err
+	}
+	if t.sound, err = parse_template("sound", sound); err != nil {
+		return nil, err
+	}
+	if t.category, err = parse_template("category", category); err != nil {
+		return nil, err
+	}
+	if t.info, err = parse_template("info", info); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+var template_funcs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+func parse_template(name string, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Funcs(template_funcs).Parse(text)
+}
+
+// Render returns the notification for one recipient's data, without device tokens.
+func (t *Template) Render(data interface{}) (*Notification, error) {
+	n := t.Base
+	n.DeviceTokens = nil
+	var err error
+	if n.Alert, err = execute_template(t.alert, data); err != nil {
+		return nil, err
+	}
+	if n.Sound, err = execute_template(t.sound, data); err != nil {
+		return nil, err
+	}
+	if n.Category, err = execute_template(t.category, data); err != nil {
+		return nil, err
+	}
+	if n.Info, err = execute_template(t.info, data); err != nil {
+		return nil, err
+	}
+	if n.Info != "" && !json.Valid([]byte(n.Info)) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidInfo, n.Info)
+	}
+	return &n, nil
+}
+
+func execute_template(t *template.Template, data interface{}) (string, error) {
+	var buffer bytes.Buffer
+	if err := t.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+type TemplateRecipient struct {
+	DeviceToken string
+	Data        interface{}
+}
+
+type RenderError struct {
+	DeviceToken string
+	Err         error
+}
+
+func (e *RenderError) Error() string {
+	return fmt.Sprintf("%s: %s", e.DeviceToken, e.Err)
+}
+
+// TemplateBatch is one Notify call, for all recipients whose payload rendered the same.
+type TemplateBatch struct {
+	Notification *Notification
+	Response     *NotifyResponse
+	Err          error
+}
+
+type TemplateResult struct {
+	Batches      []*TemplateBatch
+	RenderErrors []*RenderError
+}
+
+// SendTemplate renders t for every recipient and sends one Notify per
+// distinct payload and MAX_TEMPLATE_TOKENS recipients. Recipients that fail
+// to render are reported in RenderErrors and skipped; the returned error is
+// the first failed batch.
+func (c *Client) SendTemplate(t *Template, recipients []TemplateRecipient) (*TemplateResult, error) {
+	result := &TemplateResult{}
+	//the batch being filled and the number of batches so far per payload
+	batches := make(map[string]*TemplateBatch)
+	parts := make(map[string]int)
+	for _, recipient := range recipients {
+		n, err := t.Render(recipient.Data)
+		if err != nil {
+			result.RenderErrors = append(result.RenderErrors, &RenderError{DeviceToken: recipient.DeviceToken, Err: err})
+			continue
+		}
+		key := strings.Join([]string{n.Alert, n.Sound, n.Category, n.Info}, "\x00")
+		batch, ok := batches[key]
+		if !ok || len(batch.Notification.DeviceTokens) >= MAX_TEMPLATE_TOKENS {
+			if n.IdempotencyKey != "" {
+				//the same key for every batch would suppress all but the first
+				sum := sha1.Sum([]byte(key))
+				n.IdempotencyKey += "/" + hex.EncodeToString(sum[:8])
+				if parts[key] > 0 {
+					n.IdempotencyKey += fmt.Sprintf("/%d", parts[key]+1)
+				}
+			}
+			parts[key]++
+			batch = &TemplateBatch{Notification: n}
+			batches[key] = batch
+			result.Batches = append(result.Batches, batch)
+		}
+		batch.Notification.DeviceTokens = append(batch.Notification.DeviceTokens, recipient.DeviceToken)
+	}
+
+	var first_err error
+	for _, batch := range result.Batches {
+		batch.Response, batch.Err = c.Send(batch.Notification)
+		if batch.Err != nil && first_err == nil {
+			first_err = batch.Err
+		}
+	}
+	return result, first_err
+}
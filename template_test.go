@@ -0,0 +1,123 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"errors"
+	"fmt"
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Template", func() {
+	var (
+		client *Client
+		server *testutil.RecordingServer
+	)
+	sent := func() []url.Values {
+		return server.Queries("/notify")
+	}
+
+	BeforeEach(func() {
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("When parsing", func() {
+		It("should reject broken templates", func() {
+			_, err := NewTemplate("{{.Name", "", "", "")
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+
+	Context("When rendering", func() {
+		It("should fill in every field", func() {
+			t, err := NewTemplate("{{.Name}} started following you", "{{.Sound}}.caf", "Follow", `{"user":"{{.Name}}"}`)
+			Expect(err).Should(BeNil())
+			t.Base.Badge = "+1"
+			n, err := t.Render(map[string]string{"Name": "Ayşe", "Sound": "ding"})
+			Expect(err).Should(BeNil())
+			Expect(n.Alert).To(Equal("Ayşe started following you"))
+			Expect(n.Sound).To(Equal("ding.caf"))
+			Expect(n.Category).To(Equal("Follow"))
+			Expect(n.Info).To(Equal(`{"user":"Ayşe"}`))
+			Expect(n.Badge).To(Equal("+1"))
+		})
+		It("should encode values with json", func() {
+			t, _ := NewTemplate("hi", "", "", `{"user":{{json .Name}}}`)
+			n, err := t.Render(map[string]string{"Name": `"Ali" \ Veli`})
+			Expect(err).Should(BeNil())
+			Expect(n.Info).To(Equal(`{"user":"\"Ali\" \\ Veli"}`))
+		})
+		It("should fail when info is not valid JSON", func() {
+			t, _ := NewTemplate("hi", "", "", `{"user":"{{.Name}}"}`)
+			_, err := t.Render(map[string]string{"Name": `"Ali"`})
+			Expect(errors.Is(err, ErrInvalidInfo)).To(BeTrue())
+		})
+		It("should fail on missing keys", func() {
+			t, _ := NewTemplate("{{.Name}} started following you", "", "", "")
+			_, err := t.Render(map[string]string{})
+			Expect(err).ShouldNot(BeNil())
+		})
+	})
+
+	Context("When sending", func() {
+		It("should batch recipients with the same payload and report rendering errors", func() {
+			t, _ := NewTemplate("{{.Name}} started following you", "", "", "")
+			result, err := client.SendTemplate(t, []TemplateRecipient{
+				{DeviceToken: "a", Data: map[string]string{"Name": "Ali"}},
+				{DeviceToken: "b", Data: map[string]string{"Name": "Veli"}},
+				{DeviceToken: "c", Data: map[string]string{"Name": "Ali"}},
+				{DeviceToken: "d", Data: map[string]string{}},
+			})
+			Expect(err).Should(BeNil())
+			Expect(result.Batches).To(HaveLen(2))
+			Expect(result.Batches[0].Notification.DeviceTokens).To(Equal([]string{"a", "c"}))
+			Expect(result.Batches[0].Response).ShouldNot(BeNil())
+			Expect(result.Batches[1].Notification.DeviceTokens).To(Equal([]string{"b"}))
+			Expect(result.RenderErrors).To(HaveLen(1))
+			Expect(result.RenderErrors[0].DeviceToken).To(Equal("d"))
+
+			Expect(sent()).To(HaveLen(2))
+			Expect(sent()[0].Get("alert")).To(Equal("Ali started following you"))
+			Expect(sent()[0]["device_tokens[]"]).To(Equal([]string{"a", "c"}))
+		})
+		It("should give each batch its own idempotency key", func() {
+			client.Idempotency = NewMemoryIdempotencyStore(10)
+			t, _ := NewTemplate("{{.}}", "", "", "")
+			t.Base.IdempotencyKey = "campaign"
+			result, _ := client.SendTemplate(t, []TemplateRecipient{{DeviceToken: "a", Data: "x"}, {DeviceToken: "b", Data: "y"}})
+			Expect(result.Batches[0].Notification.IdempotencyKey).ShouldNot(Equal(result.Batches[1].Notification.IdempotencyKey))
+			Expect(sent()).To(HaveLen(2))
+		})
+		It("should split large batches", func() {
+			client.Idempotency = NewMemoryIdempotencyStore(10)
+			t, _ := NewTemplate("hello", "", "", "")
+			t.Base.IdempotencyKey = "campaign"
+			recipients := make([]TemplateRecipient, MAX_TEMPLATE_TOKENS+1)
+			for i := range recipients {
+				recipients[i] = TemplateRecipient{DeviceToken: fmt.Sprintf("token-%d", i)}
+			}
+			result, err := client.SendTemplate(t, recipients)
+			Expect(err).Should(BeNil())
+			Expect(result.Batches).To(HaveLen(2))
+			Expect(result.Batches[0].Notification.DeviceTokens).To(HaveLen(MAX_TEMPLATE_TOKENS))
+			Expect(result.Batches[1].Notification.DeviceTokens).To(Equal([]string{fmt.Sprintf("token-%d", MAX_TEMPLATE_TOKENS)}))
+			Expect(result.Batches[0].Notification.IdempotencyKey).ShouldNot(Equal(result.Batches[1].Notification.IdempotencyKey))
+			Expect(sent()).To(HaveLen(2))
+		})
+		It("should report failed batches", func() {
+			client.AuthToken = testutil.WRONG_AUTH_TOKEN
+			t, _ := NewTemplate("hello", "", "", "")
+			result, err := client.SendTemplate(t, []TemplateRecipient{{DeviceToken: "a"}})
+			Expect(err).ShouldNot(BeNil())
+			Expect(result.Batches[0].Err).To(Equal(err))
+		})
+	})
+})
@@ -0,0 +1,99 @@
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/sinangedik/zeropush/internal/jws"
+)
+
+// device tokens the APNs stand-in rejects
+const (
+	APNS_UNREGISTERED_TOKEN = "apns_unregistered_token"
+	APNS_BAD_TOKEN          = "apns_bad_token"
+)
+
+type APNsRequest struct {
+	DeviceToken string
+	Header      http.Header
+	Payload     map[string]interface{}
+}
+
+// APNsTestServer is an HTTP/2 stand-in for APNs. It accepts requests signed
+// by Key or, with no Key, made with any client certificate.
+type APNsTestServer struct {
+	*httptest.Server
+	Key *ecdsa.PublicKey
+
+	mutex    sync.Mutex
+	requests []APNsRequest
+}
+
+func NewAPNsTestServer(key *ecdsa.PublicKey) *APNsTestServer {
+	s := &APNsTestServer{Key: key}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+	s.EnableHTTP2 = true
+	s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	s.StartTLS()
+	return s
+}
+
+func (s *APNsTestServer) Requests() []APNsRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]APNsRequest(nil), s.requests...)
+}
+
+func apns_error(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"reason": reason})
+}
+
+func (s *APNsTestServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		apns_error(w, 505, "HTTP/2 required")
+		return
+	}
+	if r.Method != "POST" || !strings.HasPrefix(r.URL.Path, "/3/device/") {
+		apns_error(w, 405, "MethodNotAllowed")
+		return
+	}
+	if s.Key != nil {
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "bearer ")
+		if bearer == "" {
+			apns_error(w, 403, "MissingProviderToken")
+			return
+		}
+		if jws.VerifyES256(bearer, s.Key) != nil {
+			apns_error(w, 403, "InvalidProviderToken")
+			return
+		}
+	} else if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		apns_error(w, 403, "MissingProviderToken")
+		return
+	}
+	request := APNsRequest{DeviceToken: strings.TrimPrefix(r.URL.Path, "/3/device/"), Header: r.Header}
+	if err := json.NewDecoder(r.Body).Decode(&request.Payload); err != nil {
+		apns_error(w, 400, "PayloadEmpty")
+		return
+	}
+	s.mutex.Lock()
+	s.requests = append(s.requests, request)
+	s.mutex.Unlock()
+
+	switch request.DeviceToken {
+	case APNS_UNREGISTERED_TOKEN:
+		apns_error(w, 410, "Unregistered")
+	case APNS_BAD_TOKEN:
+		apns_error(w, 400, "BadDeviceToken")
+	default:
+		w.Header().Set("apns-id", "00000000-0000-0000-0000-000000000000")
+		w.WriteHeader(200)
+	}
+}
@@ -0,0 +1,254 @@
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	CASSETTE_RECORD = "record"
+	CASSETTE_REPLAY = "replay"
+)
+
+// CASSETTE_MODE_ENV selects the mode of CassetteModeFromEnv, so the same
+// tests record against the real API locally and replay in CI.
+const CASSETTE_MODE_ENV = "ZEROPUSH_CASSETTE"
+
+// SCRUBBED replaces the auth token in recorded interactions.
+const SCRUBBED = "[SCRUBBED]"
+
+var ErrNoInteraction = errors.New("no recorded interaction matches the request")
+
+type CassetteRequest struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Params url.Values  `json:"params,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+}
+
+type CassetteResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body"`
+}
+
+// Interaction is one line of a cassette.
+type Interaction struct {
+	Request  CassetteRequest  `json:"request"`
+	Response CassetteResponse `json:"response"`
+}
+
+// Cassette is an http.RoundTripper that records API calls to a JSONL file or
+// replays them from it. Replayed requests match on method, path and
+// parameters, regardless of the order of parameters and their values.
+// Interactions that match the same request are served in the order they
+// were recorded, the last one repeatedly.
+type Cassette struct {
+	Path string
+	Mode string
+	//makes the real calls in record mode, defaults to http.DefaultTransport
+	Transport http.RoundTripper
+
+	mutex        sync.Mutex
+	interactions []Interaction
+	served       []int
+	unmatched    []string
+	file         *os.File
+}
+
+// CassetteModeFromEnv is CASSETTE_RECORD when ZEROPUSH_CASSETTE=record and
+// CASSETTE_REPLAY otherwise.
+func CassetteModeFromEnv() string {
+	if os.Getenv(CASSETTE_MODE_ENV) == CASSETTE_RECORD {
+		return CASSETTE_RECORD
+	}
+	return CASSETTE_REPLAY
+}
+
+// NewCassette truncates the file at path in record mode and loads it in
+// replay mode.
+func NewCassette(path string, mode string) (*Cassette, error) {
+	c := &Cassette{Path: path, Mode: mode}
+	switch mode {
+	case CASSETTE_RECORD:
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		c.file = file
+	case CASSETTE_REPLAY:
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var interaction Interaction
+			if err = json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+			c.interactions = append(c.interactions, interaction)
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+		c.served = make([]int, len(c.interactions))
+	default:
+		return nil, fmt.Errorf("unknown cassette mode %q", mode)
+	}
+	return c, nil
+}
+
+// Client returns an HTTP client going through the cassette, e.g. for
+// zeropush.Client.HTTPClient.
+func (c *Cassette) Client() *http.Client {
+	return &http.Client{Transport: c}
+}
+
+// Unmatched returns the requests replay found no interaction for, also
+// when the code under test swallowed the error.
+func (c *Cassette) Unmatched() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.unmatched...)
+}
+
+func (c *Cassette) Close() error {
+	if c.file == nil {
+		return nil
+	}
+	return c.file.Close()
+}
+
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.Mode == CASSETTE_RECORD {
+		return c.record(req)
+	}
+	return c.replay(req)
+}
+
+func (c *Cassette) record(req *http.Request) (*http.Response, error) {
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	secret := ""
+	if s := strings.SplitN(req.Header.Get("Authorization"), " ", 2); len(s) == 2 {
+		secret = auth_token(s[1])
+	}
+	scrub := func(value string) string {
+		if secret == "" {
+			return value
+		}
+		return strings.ReplaceAll(value, secret, SCRUBBED)
+	}
+	interaction := Interaction{
+		Request: CassetteRequest{
+			Method: req.Method,
+			Path:   req.URL.Path,
+			Params: url.Values{},
+			Header: http.Header{},
+		},
+		Response: CassetteResponse{Status: res.StatusCode, Header: res.Header.Clone(), Body: scrub(string(body))},
+	}
+	for key, values := range req.URL.Query() {
+		for _, value := range values {
+			interaction.Request.Params.Add(key, scrub(value))
+		}
+	}
+	for key, values := range req.Header {
+		for _, value := range values {
+			interaction.Request.Header.Add(key, scrub(value))
+		}
+	}
+
+	data, err := json.Marshal(&interaction)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, err = c.file.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *Cassette) replay(req *http.Request) (*http.Response, error) {
+	params := normalize_params(req.URL.Query())
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	match := -1
+	for i, interaction := range c.interactions {
+		if interaction.Request.Method != req.Method || interaction.Request.Path != req.URL.Path ||
+			!reflect.DeepEqual(normalize_params(interaction.Request.Params), params) {
+			continue
+		}
+		if c.served[i] == 0 {
+			match = i
+			break
+		}
+		//all served, repeat the last
+		match = i
+	}
+	if match < 0 {
+		request := req.Method + " " + req.URL.Path
+		if len(params) > 0 {
+			request += "?" + params.Encode()
+		}
+		c.unmatched = append(c.unmatched, request)
+		return nil, fmt.Errorf("%w: %s", ErrNoInteraction, request)
+	}
+	c.served[match]++
+	recorded := c.interactions[match].Response
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorded.Header.Clone(),
+		Body:          io.NopCloser(strings.NewReader(recorded.Body)),
+		ContentLength: int64(len(recorded.Body)),
+		Request:       req,
+	}, nil
+}
+
+// normalize_params sorts the values of each parameter, so their order does
+// not matter.
+func normalize_params(params url.Values) url.Values {
+	normalized := url.Values{}
+	for key, values := range params {
+		sorted := append([]string(nil), values...)
+		sort.Strings(sorted)
+		normalized[key] = sorted
+	}
+	return normalized
+}
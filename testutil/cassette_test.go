@@ -0,0 +1,128 @@
+package testutil_test
+
+import (
+	. "github.com/sinangedik/zeropush/testutil"
+
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var _ = Describe("Cassette", func() {
+
+	var (
+		dir  string
+		path string
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "zeropush")
+		Expect(err).Should(BeNil())
+		path = filepath.Join(dir, "cassette.jsonl")
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	record := func() {
+		server := NewZeroTestServer()
+		defer server.Close()
+		cassette, err := NewCassette(path, CASSETTE_RECORD)
+		Expect(err).Should(BeNil())
+		client := zeropush.NewClient()
+		client.BaseURL = server.URL
+		client.AuthToken = CORRECT_AUTH_TOKEN
+		client.HTTPClient = cassette.Client()
+		_, err = client.Register("abc", "news")
+		Expect(err).Should(BeNil())
+		_, err = client.Notify("Hello", "1", "", "", "", "", "", "abc", "def")
+		Expect(err).Should(BeNil())
+		response, err := client.VerifyCredentials()
+		Expect(err).Should(BeNil())
+		Expect(response.AuthTokenType).To(Equal("server_token"))
+		Expect(cassette.Close()).Should(BeNil())
+	}
+
+	replay_client := func(cassette *Cassette) *zeropush.Client {
+		client := zeropush.NewClient()
+		client.BaseURL = "http://zeropush.invalid"
+		client.AuthToken = "another_token"
+		client.HTTPClient = cassette.Client()
+		return client
+	}
+
+	Describe("Recording", func() {
+		It("should store one interaction per line", func() {
+			record()
+			data, err := os.ReadFile(path)
+			Expect(err).Should(BeNil())
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			Expect(lines).To(HaveLen(3))
+			Expect(lines[0]).To(ContainSubstring(`"path":"/register"`))
+			Expect(lines[1]).To(ContainSubstring(`"path":"/notify"`))
+		})
+		It("should scrub the auth token", func() {
+			record()
+			data, err := os.ReadFile(path)
+			Expect(err).Should(BeNil())
+			Expect(string(data)).NotTo(ContainSubstring(CORRECT_AUTH_TOKEN))
+			Expect(string(data)).To(ContainSubstring(SCRUBBED))
+		})
+	})
+
+	Describe("Replaying", func() {
+		It("should serve the recorded responses", func() {
+			record()
+			cassette, err := NewCassette(path, CASSETTE_REPLAY)
+			Expect(err).Should(BeNil())
+			client := replay_client(cassette)
+			_, err = client.Register("abc", "news")
+			Expect(err).Should(BeNil())
+			_, err = client.Notify("Hello", "1", "", "", "", "", "", "abc", "def")
+			Expect(err).Should(BeNil())
+			response, err := client.VerifyCredentials()
+			Expect(err).Should(BeNil())
+			Expect(response.AuthTokenType).To(Equal("server_token"))
+			Expect(cassette.Unmatched()).To(BeEmpty())
+		})
+		It("should match parameters regardless of their order", func() {
+			record()
+			cassette, err := NewCassette(path, CASSETTE_REPLAY)
+			Expect(err).Should(BeNil())
+			req, _ := http.NewRequest("POST", "http://zeropush.invalid/notify?device_tokens[]=def&badge=1&device_tokens[]=abc&alert=Hello", nil)
+			res, err := cassette.RoundTrip(req)
+			Expect(err).Should(BeNil())
+			Expect(res.StatusCode).To(Equal(200))
+		})
+		It("should fail on unmatched requests", func() {
+			record()
+			cassette, err := NewCassette(path, CASSETTE_REPLAY)
+			Expect(err).Should(BeNil())
+			client := replay_client(cassette)
+			_, err = client.Register("xyz", "news")
+			Expect(err).ShouldNot(BeNil())
+			Expect(errors.Is(err, ErrNoInteraction)).To(BeTrue())
+			Expect(cassette.Unmatched()).To(Equal([]string{"POST /register?channel=news&device_token=xyz"}))
+		})
+		It("should repeat the last matching interaction", func() {
+			record()
+			cassette, err := NewCassette(path, CASSETTE_REPLAY)
+			Expect(err).Should(BeNil())
+			client := replay_client(cassette)
+			for i := 0; i < 3; i++ {
+				_, err = client.VerifyCredentials()
+				Expect(err).Should(BeNil())
+			}
+		})
+	})
+
+	It("should reject unknown modes", func() {
+		_, err := NewCassette(path, "rewind")
+		Expect(err).ShouldNot(BeNil())
+	})
+})
@@ -0,0 +1,148 @@
+package testutil
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/sinangedik/zeropush/internal/jws"
+)
+
+// device tokens the FCM stand-in rejects
+const (
+	FCM_UNREGISTERED_TOKEN = "fcm_unregistered_token"
+	FCM_INVALID_TOKEN      = "fcm_invalid_token"
+	FCM_QUOTA_TOKEN        = "fcm_quota_token"
+)
+
+type FCMRequest struct {
+	ProjectID string
+	Message   map[string]interface{}
+}
+
+// FCMTestServer is a stand-in for both the Google OAuth2 token endpoint,
+// at /token, and the FCM HTTP v1 send endpoint. Assertions must be signed
+// by Key.
+type FCMTestServer struct {
+	*httptest.Server
+	Key *rsa.PublicKey
+	//seconds the issued access tokens live
+	TokenLifetime int
+
+	mutex         sync.Mutex
+	access_tokens map[string]bool
+	token_count   int
+	requests      []FCMRequest
+}
+
+func NewFCMTestServer(key *rsa.PublicKey) *FCMTestServer {
+	s := &FCMTestServer{Key: key, TokenLifetime: 3600, access_tokens: map[string]bool{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// TokenCount is the number of access tokens issued so far.
+func (s *FCMTestServer) TokenCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.token_count
+}
+
+// RevokeAccessTokens makes the send endpoint refuse the access tokens issued
+// so far with a 401.
+func (s *FCMTestServer) RevokeAccessTokens() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.access_tokens = map[string]bool{}
+}
+
+func (s *FCMTestServer) Requests() []FCMRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]FCMRequest(nil), s.requests...)
+}
+
+func fcm_error(w http.ResponseWriter, status int, code string, message string, details ...map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "status": code, "message": message, "details": details},
+	})
+}
+
+func (s *FCMTestServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		fcm_error(w, 405, "METHOD_NOT_ALLOWED", "POST only")
+		return
+	}
+	if r.URL.Path == "/token" {
+		s.serve_token(w, r)
+		return
+	}
+	project := strings.TrimPrefix(r.URL.Path, "/v1/projects/")
+	if project == r.URL.Path || !strings.HasSuffix(project, "/messages:send") {
+		fcm_error(w, 404, "NOT_FOUND", "no such method")
+		return
+	}
+	s.mutex.Lock()
+	authorized := s.access_tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	s.mutex.Unlock()
+	if !authorized {
+		fcm_error(w, 401, "UNAUTHENTICATED", "Request had invalid authentication credentials.")
+		return
+	}
+	var body struct {
+		Message map[string]interface{} `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Message == nil {
+		fcm_error(w, 400, "INVALID_ARGUMENT", "Invalid JSON payload received.")
+		return
+	}
+	request := FCMRequest{ProjectID: strings.TrimSuffix(project, "/messages:send"), Message: body.Message}
+	s.mutex.Lock()
+	s.requests = append(s.requests, request)
+	name := fmt.Sprintf("projects/%s/messages/%d", request.ProjectID, len(s.requests))
+	s.mutex.Unlock()
+
+	fcm_detail := func(code string) map[string]interface{} {
+		return map[string]interface{}{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": code}
+	}
+	switch body.Message["token"] {
+	case FCM_UNREGISTERED_TOKEN:
+		fcm_error(w, 404, "NOT_FOUND", "Requested entity was not found.", fcm_detail("UNREGISTERED"))
+	case FCM_INVALID_TOKEN:
+		fcm_error(w, 400, "INVALID_ARGUMENT", "The registration token is not a valid FCM registration token",
+			fcm_detail("INVALID_ARGUMENT"),
+			map[string]interface{}{
+				"@type":           "type.googleapis.com/google.rpc.BadRequest",
+				"fieldViolations": []map[string]interface{}{{"field": "message.token", "description": "Invalid registration token"}},
+			})
+	case FCM_QUOTA_TOKEN:
+		fcm_error(w, 429, "RESOURCE_EXHAUSTED", "Quota exceeded.", fcm_detail("QUOTA_EXCEEDED"))
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"name": name})
+	}
+}
+
+func (s *FCMTestServer) serve_token(w http.ResponseWriter, r *http.Request) {
+	assertion := r.FormValue("assertion")
+	if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || jws.VerifyRS256(assertion, s.Key) != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	s.mutex.Lock()
+	s.token_count++
+	access_token := fmt.Sprintf("fcm_access_token_%d", s.token_count)
+	s.access_tokens[access_token] = true
+	lifetime := s.TokenLifetime
+	s.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"access_token": access_token, "expires_in": lifetime, "token_type": "Bearer"})
+}
@@ -0,0 +1,149 @@
+package testutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+
+	"github.com/sinangedik/zeropush"
+)
+
+// RecordedRequest is a request a RecordingServer got.
+type RecordedRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	//answered with an injected failure instead of by the test handler
+	Failed bool
+}
+
+// RecordingServer is the ZeroPush test server recording the requests it gets,
+// and failing them on demand.
+type RecordingServer struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	handler  http.Handler
+	requests []RecordedRequest
+	failures int
+	status   int
+	paths    map[string]bool
+	header   http.Header
+}
+
+func NewRecordingServer() *RecordingServer {
+	s := &RecordingServer{handler: NewZeroTestHandler(), header: http.Header{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Client returns a client of the server with CORRECT_AUTH_TOKEN.
+func (s *RecordingServer) Client() *zeropush.Client {
+	return &zeropush.Client{BaseURL: s.URL, AuthToken: CORRECT_AUTH_TOKEN}
+}
+
+// FailNext answers the next n requests with 503.
+func (s *RecordingServer) FailNext(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures = n
+}
+
+// FailWith answers all requests, or those to the given paths, with status
+// until it is called with 0.
+func (s *RecordingServer) FailWith(status int, paths ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = status
+	s.paths = nil
+	if len(paths) > 0 {
+		s.paths = map[string]bool{}
+		for _, path := range paths {
+			s.paths[path] = true
+		}
+	}
+}
+
+// SetHeader adds a header to the responses of the test handler, e.g. a
+// numeric quota.
+func (s *RecordingServer) SetHeader(key string, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.header.Set(key, value)
+}
+
+func (s *RecordingServer) Requests() []RecordedRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]RecordedRequest(nil), s.requests...)
+}
+
+// Reset forgets the requests recorded so far.
+func (s *RecordingServer) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = nil
+}
+
+// Calls returns the requests as "METHOD /path".
+func (s *RecordingServer) Calls() []string {
+	var calls []string
+	for _, request := range s.Requests() {
+		calls = append(calls, request.Method+" "+request.Path)
+	}
+	return calls
+}
+
+// Queries returns the parameters of the requests to path.
+func (s *RecordingServer) Queries(path string) []url.Values {
+	var queries []url.Values
+	for _, request := range s.Requests() {
+		if request.Path == path {
+			queries = append(queries, request.Query)
+		}
+	}
+	return queries
+}
+
+// Succeeded counts the requests the test handler answered.
+func (s *RecordingServer) Succeeded() int {
+	n := 0
+	for _, request := range s.Requests() {
+		if !request.Failed {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *RecordingServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	status := 0
+	if s.failures > 0 {
+		s.failures--
+		status = 503
+	} else if s.status != 0 && (s.paths == nil || s.paths[r.URL.Path]) {
+		status = s.status
+	}
+	s.requests = append(s.requests, RecordedRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Header: r.Header.Clone(),
+		Failed: status != 0,
+	})
+	if status == 0 {
+		for key, values := range s.header {
+			w.Header()[key] = append([]string(nil), values...)
+		}
+	}
+	s.mutex.Unlock()
+
+	if status != 0 {
+		http.Error(w, `{"error":"service unavailable"}`, status)
+		return
+	}
+	s.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,59 @@
+package testutil_test
+
+import (
+	. "github.com/sinangedik/zeropush/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RecordingServer", func() {
+
+	var server *RecordingServer
+	BeforeEach(func() {
+		server = NewRecordingServer()
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should record the requests", func() {
+		client := server.Client()
+		_, err := client.Register("abc", "news")
+		Expect(err).Should(BeNil())
+		_, err = client.Notify("hello", "", "", "", "", "", "", "abc", "def")
+		Expect(err).Should(BeNil())
+		Expect(server.Calls()).To(Equal([]string{"POST /register", "POST /notify"}))
+		Expect(server.Queries("/notify")[0]["device_tokens[]"]).To(Equal([]string{"abc", "def"}))
+		Expect(server.Requests()[0].Header.Get("Authorization")).To(ContainSubstring(CORRECT_AUTH_TOKEN))
+		server.Reset()
+		Expect(server.Requests()).To(BeEmpty())
+	})
+	It("should fail the next requests", func() {
+		client := server.Client()
+		server.FailNext(1)
+		_, err := client.VerifyCredentials()
+		Expect(err).To(MatchError("service unavailable"))
+		_, err = client.VerifyCredentials()
+		Expect(err).Should(BeNil())
+		Expect(server.Requests()).To(HaveLen(2))
+		Expect(server.Succeeded()).To(Equal(1))
+	})
+	It("should fail the requests to a path until told otherwise", func() {
+		client := server.Client()
+		server.FailWith(500, "/set_badge")
+		_, err := client.SetBadge("abc", 1)
+		Expect(err).ShouldNot(BeNil())
+		_, err = client.VerifyCredentials()
+		Expect(err).Should(BeNil())
+		server.FailWith(0)
+		_, err = client.SetBadge("abc", 1)
+		Expect(err).Should(BeNil())
+	})
+	It("should add headers to the responses of the handler", func() {
+		server.SetHeader("X-Device-Quota-Remaining", "42")
+		response, err := server.Client().VerifyCredentials()
+		Expect(err).Should(BeNil())
+		Expect(response.Headers["X-Device-Quota-Remaining"]).To(Equal([]string{"42"}))
+	})
+})
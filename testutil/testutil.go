@@ -8,20 +8,32 @@ import (
 )
 
 const (
-	CORRECT_AUTH_TOKEN = "correct_auth_token"
-	WRONG_AUTH_TOKEN   = "wrong_auth_token"
+	CORRECT_AUTH_TOKEN     = "correct_auth_token"
+	WRONG_AUTH_TOKEN       = "wrong_auth_token"
+	PRODUCTION_AUTH_TOKEN  = "production_auth_token"
+	DEVELOPMENT_AUTH_TOKEN = "development_auth_token"
 )
 
+var token_types = map[string]string{
+	CORRECT_AUTH_TOKEN:     "server_token",
+	PRODUCTION_AUTH_TOKEN:  "production_server_token",
+	DEVELOPMENT_AUTH_TOKEN: "development_server_token",
+}
+
 // test server
 func authenticate(w http.ResponseWriter, r *http.Request) bool {
 	auth_header := r.Header.Get("Authorization")
-	if s := strings.SplitN(auth_header, " ", 2); len(s) < 2 || s[1] != `token="`+CORRECT_AUTH_TOKEN+`"` {
+	if s := strings.SplitN(auth_header, " ", 2); len(s) < 2 || token_types[auth_token(s[1])] == "" {
 		http.Error(w, `{"error":"unauthorized"}`, 401)
 		return false
 	}
 	return true
 }
 
+func auth_token(credentials string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(credentials, `token="`), `"`)
+}
+
 func add_quota_headers(w http.ResponseWriter) {
 	w.Header().Add("X-Device-Quota", "your quota")
 	w.Header().Add("X-Device-Quota-Remaining", "your quota remaining")
@@ -42,7 +54,8 @@ func verify_credentials(w http.ResponseWriter, r *http.Request) {
 	if !authenticate(w, r) {
 		return
 	}
-	w.Write([]byte(`{"message":"authenticated", "auth_token_type":"server_token"}`))
+	token_type := token_types[auth_token(strings.SplitN(r.Header.Get("Authorization"), " ", 2)[1])]
+	w.Write([]byte(`{"message":"authenticated", "auth_token_type":"` + token_type + `"}`))
 	w.WriteHeader(200)
 }
 
@@ -103,19 +116,22 @@ func subscribe(w http.ResponseWriter, r *http.Request, sub bool) {
 }
 
 func notify(w http.ResponseWriter, r *http.Request) {
-	authenticate(w, r)
-	params := mux.Vars(r)
+	if !authenticate(w, r) {
+		return
+	}
 	add_quota_headers(w)
-	if !(check_required_fields(w, params["device_tokens"])) {
+	device_tokens := r.URL.Query()["device_tokens[]"]
+	if len(device_tokens) == 0 {
+		http.Error(w, `{"error":"missing required field"}`, 400)
 		return
 	}
 	w.Write([]byte(`{
-		sent_count: 0,
-		inactive_tokens:[],
-	  unregistered_tokens:[
-	"1234567891abcdef1234567890abcdef1234567890abcdef1234567890abcedf",
-"1234567890abcdef1234567890abcdef1234567890abcdef1234567890abceee"
-	]
+		"sent_count": 0,
+		"inactive_tokens":[],
+		"unregistered_tokens":[
+			"1234567891abcdef1234567890abcdef1234567890abcdef1234567890abcedf",
+			"1234567890abcdef1234567890abcdef1234567890abcdef1234567890abceee"
+		]
 	}`))
 	w.WriteHeader(200)
 }
@@ -161,6 +177,10 @@ func get_device(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 }
 func NewZeroTestServer() *httptest.Server {
+	return httptest.NewServer(NewZeroTestHandler())
+}
+
+func NewZeroTestHandler() http.Handler {
 	rtr := mux.NewRouter()
 	rtr.HandleFunc("/verify_credentials", verify_credentials).Methods("GET")
 	rtr.HandleFunc("/inactive_tokens", get_inactive_tokens).Methods("GET")
@@ -178,7 +198,7 @@ func NewZeroTestServer() *httptest.Server {
 	rtr.HandleFunc("/subscribe/{channel}", unsubscribe_from_channel).Methods("DELETE").Queries("device_token", "{device_token}")
 	rtr.HandleFunc("/subscribe/{channel}", unsubscribe_from_channel).Methods("DELETE")
 	rtr.HandleFunc("/set_badge", set_badge).Methods("POST").Queries("device_token", "{device_token}", "badge", "{badge}")
-	rtr.HandleFunc("/notify", register_device).Methods("POST").Queries("device_tokens[]", "{device_tokens}", "alert", "{alert}", "badge", "{badge}", "sound", "{sound}", "info", "{info}", "expiry", "{expiry}", "content_available", "{content_available}", "category", "{category}")
+	rtr.HandleFunc("/notify", notify).Methods("POST")
 	rtr.HandleFunc("/devices/{device_token}", get_device).Methods("GET")
-	return httptest.NewServer(rtr)
+	return rtr
 }
@@ -0,0 +1,167 @@
+package testutil
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/sinangedik/zeropush/internal/ece"
+	"github.com/sinangedik/zeropush/internal/jws"
+)
+
+type WebPushRequest struct {
+	Subscription string
+	Header       http.Header
+	Payload      map[string]interface{}
+}
+
+type web_push_subscription struct {
+	key         *ecdh.PrivateKey
+	auth_secret []byte
+	gone        bool
+}
+
+// WebPushTestServer is a stand-in push service. It hands out subscriptions
+// like a browser would and decrypts what is pushed to them. Pushes must
+// carry a VAPID token signed by Key.
+type WebPushTestServer struct {
+	*httptest.Server
+	Key *ecdsa.PublicKey
+
+	mutex         sync.Mutex
+	subscriptions map[string]*web_push_subscription
+	requests      []WebPushRequest
+}
+
+func NewWebPushTestServer(key *ecdsa.PublicKey) *WebPushTestServer {
+	s := &WebPushTestServer{Key: key, subscriptions: map[string]*web_push_subscription{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Subscribe returns the PushSubscription JSON of a new subscription.
+func (s *WebPushTestServer) Subscribe() string {
+	key, _ := ecdh.P256().GenerateKey(rand.Reader)
+	auth_secret := make([]byte, 16)
+	rand.Read(auth_secret)
+	s.mutex.Lock()
+	id := fmt.Sprintf("%d", len(s.subscriptions)+1)
+	s.subscriptions[id] = &web_push_subscription{key: key, auth_secret: auth_secret}
+	s.mutex.Unlock()
+	data, _ := json.Marshal(map[string]interface{}{
+		"endpoint": s.URL + "/push/" + id,
+		"keys": map[string]string{
+			"p256dh": base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+			"auth":   base64.RawURLEncoding.EncodeToString(auth_secret),
+		},
+	})
+	return string(data)
+}
+
+// Unsubscribe makes the push service answer 410 Gone for the subscription.
+func (s *WebPushTestServer) Unsubscribe(subscription string) {
+	var parsed struct {
+		Endpoint string `json:"endpoint"`
+	}
+	json.Unmarshal([]byte(subscription), &parsed)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if sub, ok := s.subscriptions[parsed.Endpoint[strings.LastIndex(parsed.Endpoint, "/")+1:]]; ok {
+		sub.gone = true
+	}
+}
+
+func (s *WebPushTestServer) Requests() []WebPushRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]WebPushRequest(nil), s.requests...)
+}
+
+func (s *WebPushTestServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.URL.Path, "/push/") {
+		http.Error(w, "not found", 404)
+		return
+	}
+	s.mutex.Lock()
+	id := strings.TrimPrefix(r.URL.Path, "/push/")
+	sub, ok := s.subscriptions[id]
+	gone := ok && sub.gone
+	s.mutex.Unlock()
+	if !ok {
+		http.Error(w, "no such subscription", 404)
+		return
+	}
+	if gone {
+		http.Error(w, "subscription expired", 410)
+		return
+	}
+	if err := s.verify(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+	if r.Header.Get("TTL") == "" {
+		http.Error(w, "TTL header required", 400)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "aes128gcm" {
+		http.Error(w, "aes128gcm content encoding required", 415)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if len(body) > ece.RECORD_SIZE {
+		http.Error(w, "payload too large", 413)
+		return
+	}
+	plaintext, err := ece.Decrypt(sub.key, sub.auth_secret, body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	request := WebPushRequest{Subscription: s.URL + r.URL.Path, Header: r.Header}
+	if err = json.Unmarshal(plaintext, &request.Payload); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	s.mutex.Lock()
+	s.requests = append(s.requests, request)
+	location := fmt.Sprintf("%s/message/%d", s.URL, len(s.requests))
+	s.mutex.Unlock()
+	w.Header().Set("Location", location)
+	w.WriteHeader(201)
+}
+
+// verify checks a "vapid t=..., k=..." header against Key and this origin.
+func (s *WebPushTestServer) verify(authorization string) error {
+	if !strings.HasPrefix(authorization, "vapid ") {
+		return fmt.Errorf("vapid authorization required")
+	}
+	params := map[string]string{}
+	for _, param := range strings.Split(strings.TrimPrefix(authorization, "vapid "), ",") {
+		if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		}
+	}
+	key, _ := s.Key.ECDH()
+	if params["k"] != base64.RawURLEncoding.EncodeToString(key.Bytes()) {
+		return fmt.Errorf("unknown application server key")
+	}
+	if err := jws.VerifyES256(params["t"], s.Key); err != nil {
+		return err
+	}
+	var claims struct {
+		Audience string `json:"aud"`
+	}
+	jws.Claims(params["t"], &claims)
+	if claims.Audience != s.URL {
+		return fmt.Errorf("audience %q is not %q", claims.Audience, s.URL)
+	}
+	return nil
+}
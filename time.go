@@ -0,0 +1,47 @@
+package zeropush
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the timestamp formats the API has been seen to emit
+var time_formats = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// parse_time parses a decoded JSON timestamp. null and "" give the zero time;
+// numbers are taken as seconds since the epoch.
+func parse_time(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case nil:
+		return time.Time{}, nil
+	case float64:
+		sec := int64(v)
+		return time.Unix(sec, int64((v-float64(sec))*1e9)), nil
+	case string:
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return time.Time{}, nil
+		}
+		for _, format := range time_formats {
+			if t, err := time.Parse(format, v); err == nil {
+				return t, nil
+			}
+		}
+		if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(sec, 0), nil
+		}
+		return time.Time{}, fmt.Errorf("unrecognized time format %q", v)
+	}
+	return time.Time{}, fmt.Errorf("unexpected time value %v", value)
+}
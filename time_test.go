@@ -0,0 +1,51 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Timestamps", func() {
+	var (
+		client *Client
+		server *httptest.Server
+	)
+	expected := time.Date(2013, 3, 11, 20, 25, 14, 0, time.UTC)
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[
+				{"device_token": "rfc3339", "marked_inactive_at": "2013-03-11T16:25:14-04:00"},
+				{"device_token": "utc", "marked_inactive_at": "2013-03-11T20:25:14Z"},
+				{"device_token": "fraction", "marked_inactive_at": "2013-03-11T20:25:14.000Z"},
+				{"device_token": "no colon", "marked_inactive_at": "2013-03-11T16:25:14-0400"},
+				{"device_token": "space", "marked_inactive_at": "2013-03-11 16:25:14 -0400"},
+				{"device_token": "epoch", "marked_inactive_at": 1363033514},
+				{"device_token": "null", "marked_inactive_at": null},
+				{"device_token": "garbage", "marked_inactive_at": "yesterday"}
+			]`))
+		}))
+		client = &Client{BaseURL: server.URL, AuthToken: testutil.CORRECT_AUTH_TOKEN}
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should parse the formats the API emits", func() {
+		response, err := client.GetInactiveTokens()
+		Expect(err).Should(BeNil())
+		Expect(response.TokenDetails).To(HaveLen(8))
+		for _, detail := range response.TokenDetails[:6] {
+			Expect(detail.MarkedInactiveAt).To(BeTemporally("==", expected), detail.DeviceToken)
+		}
+		Expect(response.TokenDetails[6].MarkedInactiveAt.IsZero()).To(BeTrue())
+		Expect(response.TokenDetails[7].MarkedInactiveAt.IsZero()).To(BeTrue())
+	})
+})
@@ -0,0 +1,92 @@
+package zeropush
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Tracer starts a span around each API call, see the tracing/otel package.
+// Spans carry the endpoint, the number of device tokens, the channel and the
+// HTTP status.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+	//writes the span context of ctx into the headers of an outgoing request
+	Inject(ctx context.Context, header http.Header)
+}
+
+// Span is the part of a tracing span the client uses. Attribute values are
+// strings, ints or bools.
+type Span interface {
+	SetAttributes(attributes map[string]interface{})
+	AddEvent(name string, attributes map[string]interface{})
+	RecordError(err error)
+	End()
+}
+
+// WithContext returns a copy of the client whose API calls carry ctx, so
+// their spans join the trace of ctx and cancelling ctx cancels them.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	client := *c
+	client.ctx = ctx
+	return &client
+}
+
+func (c *Client) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// WithTracer starts a span around every request that reaches it and injects
+// its context into the headers, so placed inside Retry each attempt gets a
+// span, with a "retry" event on the ones after the first. The client adds it
+// inside its middleware when Tracer is set.
+func WithTracer(tracer Tracer) Middleware {
+	return func(next Doer) Doer {
+		return DoerFunc(func(req *http.Request) (*http.Response, error) {
+			ctx, span := tracer.Start(req.Context(), "zeropush "+endpoint_name(req.URL.Path))
+			defer span.End()
+			span.SetAttributes(request_attributes(req))
+			if attempt := retry_attempt(req); attempt > 1 {
+				span.SetAttributes(map[string]interface{}{"zeropush.attempt": attempt})
+				span.AddEvent("retry", map[string]interface{}{"zeropush.attempt": attempt})
+			}
+			req = req.WithContext(ctx)
+			tracer.Inject(ctx, req.Header)
+			res, err := next.Do(req)
+			if err != nil {
+				span.RecordError(err)
+				return res, err
+			}
+			span.SetAttributes(map[string]interface{}{"http.response.status_code": res.StatusCode})
+			if res.StatusCode > 299 {
+				span.RecordError(&APIError{Status: res.StatusCode, Message: res.Status})
+			}
+			return res, nil
+		})
+	}
+}
+
+// request_attributes reads the span attributes from the API call itself, so
+// every client method is covered.
+func request_attributes(req *http.Request) map[string]interface{} {
+	endpoint := endpoint_name(req.URL.Path)
+	attributes := map[string]interface{}{
+		"http.request.method": req.Method,
+		"zeropush.endpoint":   endpoint,
+	}
+	query := req.URL.Query()
+	if tokens := query["device_tokens[]"]; len(tokens) > 0 {
+		attributes["zeropush.token_count"] = len(tokens)
+	} else if query.Get("device_token") != "" || endpoint == "/devices" {
+		attributes["zeropush.token_count"] = 1
+	}
+	if channel := query.Get("channel"); channel != "" {
+		attributes["zeropush.channel"] = channel
+	} else if endpoint == "/broadcast" || endpoint == "/subscribe" {
+		attributes["zeropush.channel"] = strings.TrimPrefix(req.URL.Path, endpoint+"/")
+	}
+	return attributes
+}
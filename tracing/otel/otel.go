@@ -0,0 +1,83 @@
+// Package otel traces the client with OpenTelemetry.
+package otel
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/sinangedik/zeropush"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const INSTRUMENTATION_NAME = "github.com/sinangedik/zeropush"
+
+// Tracer implements zeropush.Tracer with client spans and injects the trace
+// context into API calls with Propagator.
+type Tracer struct {
+	Tracer     trace.Tracer
+	Propagator propagation.TextMapPropagator
+}
+
+var _ zeropush.Tracer = (*Tracer)(nil)
+
+// NewTracer traces with the given provider, nil for the global one, and
+// the global propagator.
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return &Tracer{Tracer: provider.Tracer(INSTRUMENTATION_NAME), Propagator: otel.GetTextMapPropagator()}
+}
+
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, zeropush.Span) {
+	ctx, span := t.Tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, &Span{Span: span}
+}
+
+func (t *Tracer) Inject(ctx context.Context, header http.Header) {
+	t.Propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+type Span struct {
+	Span trace.Span
+}
+
+func (s *Span) SetAttributes(attributes map[string]interface{}) {
+	s.Span.SetAttributes(key_values(attributes)...)
+}
+
+func (s *Span) AddEvent(name string, attributes map[string]interface{}) {
+	s.Span.AddEvent(name, trace.WithAttributes(key_values(attributes)...))
+}
+
+// RecordError adds an exception event and marks the span as failed.
+func (s *Span) RecordError(err error) {
+	s.Span.RecordError(err)
+	s.Span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *Span) End() {
+	s.Span.End()
+}
+
+func key_values(attributes map[string]interface{}) []attribute.KeyValue {
+	key_values := make([]attribute.KeyValue, 0, len(attributes))
+	for key, value := range attributes {
+		switch v := value.(type) {
+		case string:
+			key_values = append(key_values, attribute.String(key, v))
+		case int:
+			key_values = append(key_values, attribute.Int(key, v))
+		case bool:
+			key_values = append(key_values, attribute.Bool(key, v))
+		default:
+			key_values = append(key_values, attribute.String(key, fmt.Sprint(v)))
+		}
+	}
+	return key_values
+}
@@ -0,0 +1,72 @@
+package otel_test
+
+import (
+	. "github.com/sinangedik/zeropush/tracing/otel"
+
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush"
+	"github.com/sinangedik/zeropush/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ = Describe("Tracer", func() {
+	var (
+		exporter *tracetest.InMemoryExporter
+		provider *sdktrace.TracerProvider
+		client   *zeropush.Client
+		server   *testutil.RecordingServer
+	)
+
+	BeforeEach(func() {
+		exporter = tracetest.NewInMemoryExporter()
+		provider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+		tracer := NewTracer(provider)
+		tracer.Propagator = propagation.TraceContext{}
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+		client.Tracer = tracer
+	})
+	AfterEach(func() {
+		server.Close()
+		provider.Shutdown(context.Background())
+	})
+
+	It("should export a client span per call", func() {
+		client.Notify("hello", "", "", "", "", "", "", "abc", "def")
+		spans := exporter.GetSpans()
+		Expect(spans).To(HaveLen(1))
+		span := spans[0]
+		Expect(span.Name).To(Equal("zeropush /notify"))
+		Expect(span.SpanKind).To(Equal(trace.SpanKindClient))
+		Expect(span.Attributes).To(ContainElement(attribute.Int("zeropush.token_count", 2)))
+		Expect(span.Attributes).To(ContainElement(attribute.String("zeropush.endpoint", "/notify")))
+		Expect(span.Attributes).To(ContainElement(attribute.Int("http.response.status_code", 200)))
+		Expect(span.Status.Code).To(Equal(codes.Unset))
+	})
+	It("should join the trace of the context and propagate it", func() {
+		ctx, parent := provider.Tracer("test").Start(context.Background(), "handler")
+		client.WithContext(ctx).VerifyCredentials()
+		parent.End()
+
+		spans := exporter.GetSpans()
+		Expect(spans).To(HaveLen(2))
+		Expect(spans[0].Parent.SpanID()).To(Equal(parent.SpanContext().SpanID()))
+		Expect(server.Requests()[0].Header.Get("traceparent")).To(ContainSubstring(parent.SpanContext().TraceID().String()))
+	})
+	It("should record errors", func() {
+		client.AuthToken = "wrong"
+		client.VerifyCredentials()
+		span := exporter.GetSpans()[0]
+		Expect(span.Status.Code).To(Equal(codes.Error))
+		Expect(span.Events).To(HaveLen(1))
+		Expect(span.Events[0].Name).To(Equal("exception"))
+	})
+})
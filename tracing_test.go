@@ -0,0 +1,173 @@
+package zeropush_test
+
+import (
+	. "github.com/sinangedik/zeropush"
+
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+type recorded_span struct {
+	name       string
+	parent     string
+	attributes map[string]interface{}
+	events     []string
+	errors     []error
+	ended      bool
+}
+
+// recording_tracer keeps its spans and names them in the context
+type recording_tracer struct {
+	mutex sync.Mutex
+	spans []*recorded_span
+}
+
+type span_name struct{}
+
+func (t *recording_tracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	parent, _ := ctx.Value(span_name{}).(string)
+	span := &recorded_span{name: name, parent: parent, attributes: map[string]interface{}{}}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, span_name{}, name), &recording_span{tracer: t, span: span}
+}
+
+func (t *recording_tracer) Inject(ctx context.Context, header http.Header) {
+	header.Set("X-Span", ctx.Value(span_name{}).(string))
+}
+
+func (t *recording_tracer) Spans() []recorded_span {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	spans := make([]recorded_span, len(t.spans))
+	for i, span := range t.spans {
+		spans[i] = *span
+	}
+	return spans
+}
+
+type recording_span struct {
+	tracer *recording_tracer
+	span   *recorded_span
+}
+
+func (s *recording_span) SetAttributes(attributes map[string]interface{}) {
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	for key, value := range attributes {
+		s.span.attributes[key] = value
+	}
+}
+
+func (s *recording_span) AddEvent(name string, attributes map[string]interface{}) {
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.span.events = append(s.span.events, name)
+}
+
+func (s *recording_span) RecordError(err error) {
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.span.errors = append(s.span.errors, err)
+}
+
+func (s *recording_span) End() {
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.span.ended = true
+}
+
+var _ = Describe("Tracing", func() {
+	var (
+		client *Client
+		server *testutil.RecordingServer
+		tracer *recording_tracer
+	)
+
+	BeforeEach(func() {
+		tracer = &recording_tracer{}
+		server = testutil.NewRecordingServer()
+		client = server.Client()
+		client.Tracer = tracer
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should trace each call with its endpoint, tokens and status", func() {
+		_, err := client.Notify("hello", "", "", "", "", "", "", "abc", "def")
+		Expect(err).Should(BeNil())
+		spans := tracer.Spans()
+		Expect(spans).To(HaveLen(1))
+		Expect(spans[0].name).To(Equal("zeropush /notify"))
+		Expect(spans[0].ended).To(BeTrue())
+		Expect(spans[0].attributes).To(Equal(map[string]interface{}{
+			"http.request.method":       "POST",
+			"zeropush.endpoint":         "/notify",
+			"zeropush.token_count":      2,
+			"http.response.status_code": 200,
+		}))
+		Expect(server.Requests()[0].Header.Get("X-Span")).To(Equal("zeropush /notify"))
+	})
+	It("should record channels and errors", func() {
+		client.Broadcast("news", "hello", "", "", "", "", "", "")
+		server.FailNext(1)
+		client.Subscribe("abc", "sports")
+		spans := tracer.Spans()
+		Expect(spans[0].attributes["zeropush.channel"]).To(Equal("news"))
+		Expect(spans[1].attributes["zeropush.channel"]).To(Equal("sports"))
+		Expect(spans[1].attributes["zeropush.token_count"]).To(Equal(1))
+		Expect(spans[1].attributes["http.response.status_code"]).To(Equal(503))
+		Expect(spans[1].errors).To(HaveLen(1))
+	})
+	It("should carry the context of WithContext", func() {
+		parent := context.WithValue(context.Background(), span_name{}, "handler")
+		client.WithContext(parent).VerifyCredentials()
+		Expect(tracer.Spans()[0].parent).To(Equal("handler"))
+
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := client.WithContext(cancelled).VerifyCredentials()
+		Expect(err).To(MatchError(ContainSubstring("context canceled")))
+		Expect(tracer.Spans()[1].errors).To(HaveLen(1))
+	})
+	It("should record outbox retries as events of the delivery", func() {
+		dir, _ := os.MkdirTemp("", "zeropush")
+		defer os.RemoveAll(dir)
+		outbox, err := OpenOutbox(filepath.Join(dir, "outbox.log"), client)
+		Expect(err).Should(BeNil())
+		defer outbox.Close()
+		outbox.Backoff = func(attempt int) time.Duration { return time.Millisecond }
+		server.FailNext(1)
+		outbox.Start()
+		id, _ := outbox.Enqueue(&Notification{Alert: "hello", DeviceTokens: []string{"abc"}})
+		Eventually(func() string {
+			job, _ := outbox.Status(id)
+			return job.Status
+		}).Should(Equal(JOB_DONE))
+		outbox.Stop()
+
+		var deliveries []recorded_span
+		for _, span := range tracer.Spans() {
+			if span.name == "zeropush outbox delivery" {
+				deliveries = append(deliveries, span)
+			} else {
+				Expect(span.parent).To(Equal("zeropush outbox delivery"))
+			}
+		}
+		Expect(deliveries).To(HaveLen(2))
+		Expect(deliveries[0].events).To(BeEmpty())
+		Expect(deliveries[0].errors).To(HaveLen(1))
+		Expect(deliveries[1].events).To(Equal([]string{"retry"}))
+		Expect(deliveries[1].attributes["zeropush.attempt"]).To(Equal(2))
+	})
+})
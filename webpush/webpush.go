@@ -0,0 +1,361 @@
+// Package webpush sends notifications to browsers through their push
+// services (RFC 8030), encrypting payloads per RFC 8291 and authenticating
+// with VAPID (RFC 8292).
+package webpush
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sinangedik/zeropush"
+	"github.com/sinangedik/zeropush/internal/ece"
+	"github.com/sinangedik/zeropush/internal/jws"
+)
+
+// push services keep undelivered messages for at most four weeks
+const DEFAULT_TTL = 4 * 7 * 24 * 60 * 60
+
+// VAPID tokens are valid for 12 hours and renewed after TOKEN_LIFETIME.
+const TOKEN_LIFETIME = time.Hour
+
+var encoding = base64.RawURLEncoding
+
+// Subscription is the JSON of a browser PushSubscription, used as the
+// device token.
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+func ParseSubscription(device_token string) (*Subscription, error) {
+	s := &Subscription{}
+	if err := json.Unmarshal([]byte(device_token), s); err != nil {
+		return nil, err
+	}
+	if s.Endpoint == "" || s.Keys.P256dh == "" || s.Keys.Auth == "" {
+		return nil, errors.New("subscription needs an endpoint and p256dh and auth keys")
+	}
+	return s, nil
+}
+
+// VAPID signs the application server tokens of RFC 8292.
+type VAPID struct {
+	Key *ecdsa.PrivateKey
+	//a mailto: or https: contact for the push service
+	Subject string
+
+	mutex  sync.Mutex
+	tokens map[string]vapid_token
+}
+
+type vapid_token struct {
+	token     string
+	issued_at time.Time
+}
+
+func NewVAPID(key *ecdsa.PrivateKey, subject string) *VAPID {
+	return &VAPID{Key: key, Subject: subject}
+}
+
+// GenerateVAPID creates a new key pair. Persist it, subscriptions are bound
+// to the public key.
+func GenerateVAPID(subject string) (*VAPID, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewVAPID(key, subject), nil
+}
+
+// LoadVAPID reads a PEM encoded P-256 private key.
+func LoadVAPID(path string, subject string) (*VAPID, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := jws.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	key, ok := signer.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ECDSA key", path)
+	}
+	return NewVAPID(key, subject), nil
+}
+
+// PublicKey is the applicationServerKey to pass to pushManager.subscribe.
+func (v *VAPID) PublicKey() string {
+	key, err := v.Key.PublicKey.ECDH()
+	if err != nil {
+		return ""
+	}
+	return encoding.EncodeToString(key.Bytes())
+}
+
+// Authorization returns the header value for a push service, signing a new
+// token when the cached one for its origin is due.
+func (v *VAPID) Authorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	audience := u.Scheme + "://" + u.Host
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	cached, ok := v.tokens[audience]
+	if !ok || time.Since(cached.issued_at) >= TOKEN_LIFETIME {
+		now := time.Now()
+		token, err := jws.Sign(nil, map[string]interface{}{
+			"aud": audience,
+			"exp": now.Add(12 * time.Hour).Unix(),
+			"sub": v.Subject,
+		}, v.Key)
+		if err != nil {
+			return "", err
+		}
+		if v.tokens == nil {
+			v.tokens = map[string]vapid_token{}
+		}
+		cached = vapid_token{token: token, issued_at: now}
+		v.tokens[audience] = cached
+	}
+	return "vapid t=" + cached.token + ", k=" + v.PublicKey(), nil
+}
+
+// Error is a push service failure that does not mean the subscription is
+// gone, e.g. a rejected VAPID token or a payload that is too large.
+type Error struct {
+	DeviceToken string
+	Status      int
+	Message     string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("webpush: %s: %d %s", e.DeviceToken, e.Status, e.Message)
+}
+
+// Provider implements zeropush.Provider against browser push services.
+// Subscriptions the push service answers with 404 or 410, and device tokens
+// that are not subscriptions, come back as UnregisteredTokens.
+type Provider struct {
+	VAPID       *VAPID
+	HTTPClient  *http.Client
+	Concurrency int
+}
+
+var _ zeropush.Provider = (*Provider)(nil)
+
+func NewProvider(vapid *VAPID) *Provider {
+	return &Provider{
+		VAPID:       vapid,
+		HTTPClient:  &http.Client{Timeout: 30 * time.Second},
+		Concurrency: 16,
+	}
+}
+
+func (p *Provider) Notify(alert string, badge string, sound string, info string, expiry string, content_available string, category string, device_tokens ...string) (*zeropush.NotifyResponse, error) {
+	return p.Send(&zeropush.Notification{
+		Alert:            alert,
+		Badge:            badge,
+		Sound:            sound,
+		Info:             info,
+		Expiry:           expiry,
+		ContentAvailable: content_available,
+		Category:         category,
+		DeviceTokens:     device_tokens,
+	})
+}
+
+// Broadcast is not supported, push services have no channels.
+func (p *Provider) Broadcast(channel string, alert string, badge string, sound string, info string, expiry string, content_available string, category string) (*zeropush.BroadcastResponse, error) {
+	return nil, zeropush.ErrBroadcastNotSupported
+}
+
+type push_result struct {
+	device_token string
+	status       int
+	location     string
+	err          error
+}
+
+// Send encrypts n for each subscription and posts it to its endpoint. The
+// service worker receives the payload as JSON with the alert, badge, sound,
+// category and info of n.
+func (p *Provider) Send(n *zeropush.Notification) (*zeropush.NotifyResponse, error) {
+	if n.Channel != "" {
+		return nil, zeropush.ErrBroadcastNotSupported
+	}
+	if len(n.DeviceTokens) == 0 {
+		return nil, errors.New("device tokens cannot be empty")
+	}
+	body, err := payload(n)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := headers(n)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]push_result, len(n.DeviceTokens))
+	concurrency := p.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, token := range n.DeviceTokens {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, token string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = p.push(token, headers, body)
+		}(i, token)
+	}
+	wg.Wait()
+
+	response := &zeropush.NotifyResponse{ZeroResponse: &zeropush.ZeroResponse{}}
+	var first_err error
+	for _, result := range results {
+		entry := map[string]interface{}{"device_token": result.device_token, "status": result.status}
+		if result.location != "" {
+			entry["location"] = result.location
+		}
+		response.Body = append(response.Body, entry)
+		switch {
+		case result.status == http.StatusNotFound || result.status == http.StatusGone:
+			response.UnregisteredTokens = append(response.UnregisteredTokens, result.device_token)
+		case result.err != nil:
+			if first_err == nil {
+				first_err = result.err
+			}
+		default:
+			response.SentCount++
+		}
+	}
+	if first_err != nil {
+		log.Printf("Error sending web push: %s", first_err)
+		response.Error = map[string]string{"error": first_err.Error()}
+	}
+	return response, first_err
+}
+
+func (p *Provider) push(device_token string, headers http.Header, body []byte) push_result {
+	result := push_result{device_token: device_token}
+	subscription, err := ParseSubscription(device_token)
+	if err != nil {
+		//not a subscription, as good as one that is gone
+		result.status = http.StatusNotFound
+		return result
+	}
+	ua_public, err := encoding.DecodeString(subscription.Keys.P256dh)
+	if err == nil {
+		var auth_secret []byte
+		if auth_secret, err = encoding.DecodeString(subscription.Keys.Auth); err == nil {
+			body, err = ece.Encrypt(ua_public, auth_secret, body)
+		}
+	}
+	if err != nil {
+		result.err = &Error{DeviceToken: device_token, Message: err.Error()}
+		return result
+	}
+	authorization, err := p.VAPID.Authorization(subscription.Endpoint)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	req, err := http.NewRequest("POST", subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		result.err = err
+		return result
+	}
+	req.Header = headers.Clone()
+	req.Header.Set("Authorization", authorization)
+	res, err := p.HTTPClient.Do(req)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer res.Body.Close()
+	result.status = res.StatusCode
+	result.location = res.Header.Get("Location")
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		result.err = &Error{DeviceToken: device_token, Status: res.StatusCode, Message: string(data)}
+	}
+	return result
+}
+
+func headers(n *zeropush.Notification) (http.Header, error) {
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/octet-stream")
+	headers.Set("Content-Encoding", "aes128gcm")
+	ttl := DEFAULT_TTL
+	if n.Expiry != "" {
+		seconds, err := strconv.Atoi(n.Expiry)
+		if err != nil {
+			return nil, fmt.Errorf("expiry %q must be a number of seconds", n.Expiry)
+		}
+		ttl = seconds
+	}
+	headers.Set("TTL", strconv.Itoa(ttl))
+	if n.Alert == "" && n.Sound == "" && n.Badge == "" {
+		headers.Set("Urgency", "low")
+	} else {
+		headers.Set("Urgency", "high")
+	}
+	return headers, nil
+}
+
+// payload is the JSON the service worker gets in its push event. Info is
+// decoded when it is JSON, else passed on as a string.
+func payload(n *zeropush.Notification) ([]byte, error) {
+	body := map[string]interface{}{}
+	if n.Alert != "" {
+		body["alert"] = n.Alert
+	}
+	if n.Badge != "" {
+		body["badge"] = n.Badge
+	}
+	if n.Sound != "" {
+		body["sound"] = n.Sound
+	}
+	if n.Category != "" {
+		body["category"] = n.Category
+	}
+	if n.Info != "" {
+		var info interface{}
+		if json.Unmarshal([]byte(n.Info), &info) == nil {
+			body["info"] = info
+		} else {
+			body["info"] = n.Info
+		}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > ece.MAX_PLAINTEXT {
+		return nil, fmt.Errorf("payload of %d bytes is over the %d bytes push services take", len(data), ece.MAX_PLAINTEXT)
+	}
+	return data, nil
+}
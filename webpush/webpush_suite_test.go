@@ -0,0 +1,13 @@
+package webpush_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestWebPush(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Web Push Suite")
+}
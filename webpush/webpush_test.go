@@ -0,0 +1,112 @@
+package webpush_test
+
+import (
+	. "github.com/sinangedik/zeropush/webpush"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sinangedik/zeropush"
+	"github.com/sinangedik/zeropush/testutil"
+)
+
+var _ = Describe("Provider", func() {
+	var (
+		vapid    *VAPID
+		server   *testutil.WebPushTestServer
+		provider *Provider
+	)
+
+	BeforeEach(func() {
+		vapid, _ = GenerateVAPID("mailto:push@example.com")
+		server = testutil.NewWebPushTestServer(&vapid.Key.PublicKey)
+		provider = NewProvider(vapid)
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should push encrypted payloads to each subscription", func() {
+		a, b := server.Subscribe(), server.Subscribe()
+		response, err := provider.Notify("hello", "3", "default", `{"thread":"42"}`, "3600", "", "MESSAGE", a, b)
+		Expect(err).Should(BeNil())
+		Expect(response.SentCount).To(Equal(2))
+		requests := server.Requests()
+		Expect(requests).To(HaveLen(2))
+
+		request := requests[0]
+		Expect(request.Header.Get("TTL")).To(Equal("3600"))
+		Expect(request.Header.Get("Urgency")).To(Equal("high"))
+		Expect(request.Payload).To(Equal(map[string]interface{}{
+			"alert":    "hello",
+			"badge":    "3",
+			"sound":    "default",
+			"category": "MESSAGE",
+			"info":     map[string]interface{}{"thread": "42"},
+		}))
+		Expect(response.Body[0]["location"]).ShouldNot(BeEmpty())
+	})
+	It("should send silent pushes with a low urgency and the default TTL", func() {
+		provider.Send(&zeropush.Notification{Info: "sync", DeviceTokens: []string{server.Subscribe()}})
+		request := server.Requests()[0]
+		Expect(request.Header.Get("Urgency")).To(Equal("low"))
+		Expect(request.Header.Get("TTL")).To(Equal("2419200"))
+		Expect(request.Payload["info"]).To(Equal("sync"))
+	})
+	It("should map gone subscriptions and bad tokens to unregistered tokens", func() {
+		active, gone := server.Subscribe(), server.Subscribe()
+		server.Unsubscribe(gone)
+		unknown := strings.Replace(server.Subscribe(), "/push/3", "/push/99", 1)
+		response, err := provider.Notify("hello", "", "", "", "", "", "", active, gone, unknown, "not a subscription")
+		Expect(err).Should(BeNil())
+		Expect(response.SentCount).To(Equal(1))
+		Expect(response.UnregisteredTokens).To(Equal([]string{gone, unknown, "not a subscription"}))
+		Expect(response.Body[1]["status"]).To(Equal(410))
+	})
+	It("should fail with a VAPID key the subscription was not made for", func() {
+		subscription := server.Subscribe()
+		provider.VAPID, _ = GenerateVAPID("mailto:push@example.com")
+		response, err := provider.Notify("hello", "", "", "", "", "", "", subscription)
+		Expect(err).To(BeAssignableToTypeOf(&Error{}))
+		Expect(err.(*Error).Status).To(Equal(403))
+		Expect(response.UnregisteredTokens).To(BeEmpty())
+	})
+	It("should refuse payloads push services do not take", func() {
+		_, err := provider.Notify(strings.Repeat("a", 4096), "", "", "", "", "", "", server.Subscribe())
+		Expect(err).ShouldNot(BeNil())
+		Expect(server.Requests()).To(BeEmpty())
+	})
+	It("should refuse broadcasts", func() {
+		_, err := provider.Broadcast("news", "hello", "", "", "", "", "", "")
+		Expect(err).To(Equal(zeropush.ErrBroadcastNotSupported))
+	})
+})
+
+var _ = Describe("VAPID", func() {
+	It("should load a PEM key and reuse its token per origin", func() {
+		dir, _ := os.MkdirTemp("", "zeropush")
+		defer os.RemoveAll(dir)
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, _ := x509.MarshalPKCS8PrivateKey(key)
+		path := filepath.Join(dir, "vapid.pem")
+		Expect(os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)).To(Succeed())
+
+		vapid, err := LoadVAPID(path, "mailto:push@example.com")
+		Expect(err).Should(BeNil())
+		Expect(vapid.PublicKey()).To(HaveLen(87))
+		first, _ := vapid.Authorization("https://push.example.com/a")
+		second, _ := vapid.Authorization("https://push.example.com/b")
+		other, _ := vapid.Authorization("https://updates.example.net/a")
+		Expect(first).To(HavePrefix("vapid t="))
+		Expect(first).To(Equal(second))
+		Expect(first).ShouldNot(Equal(other))
+	})
+})